@@ -0,0 +1,351 @@
+package driver
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// DMG-07 protocol
+const (
+	// Header of the ping packets, followed by 3 status bytes
+	adapterPing = 0xFE
+	// Answer of a Game Boy to the first 2 bytes of a ping packet
+	adapterAck = 0x88
+	// Sent by player 1 during the ping phase to start the transmission
+	adapterStart = 0xAA
+	// Sent 4 times to every player when the transmission starts
+	adapterStarted = 0xCC
+	// Player 1 goes back to the ping phase by sending it 4 times in a row
+	adapterRestart = 0xFF
+
+	// Emulated cycles between two bytes clocked by the adapter
+	adapterByteCycles = 2 * serialTransferCycles
+	// Longest time a transmission cycle waits for the players too slow to send their data
+	adapterTimeout = 200 * time.Millisecond
+)
+
+// Phases of a port
+const (
+	adapterPinging = iota
+	adapterStarting
+	adapterTransmitting
+)
+
+/*
+FourPlayerAdapter DMG-07, links up to 4 Game Boys. The adapter clocks
+every transfer, the games select the external clock.
+
+In the ping phase it sends each player [0xFE, STAT, STAT, STAT], STAT
+being the players connected in the high nibble and the number of the
+player in the low one. Games answer [0x88, 0x88, RATE, SIZE]. When
+player 1 answers 0xAA, the adapter sends 4 times 0xCC to everyone and
+the transmission phase starts: in every cycle of 4 * SIZE bytes, each
+player sends its SIZE bytes of data and receives the data of the 4
+players of the previous cycle. Player 1 sending 0xFF 4 times goes back
+to the ping phase. The rate asked by player 1 isn't emulated, bytes come
+at a fixed pace.
+
+The emulators of the players never wait for each other: a player ahead
+of the others gets the last packet again, and a player late or still
+in the ping phase sends its last data for the cycles it misses.
+*/
+type FourPlayerAdapter struct {
+	// Shown to the players to tell the adapters apart
+	Name string
+
+	mutex sync.Mutex
+	ports [4]*AdapterPort
+	// Players answering the pings
+	acked byte
+
+	transmitting bool
+	size         int
+	// Last data of the players, and the ones which sent it in the current cycle
+	incoming [4][]byte
+	arrived  byte
+	// When the current cycle started
+	started time.Time
+	// Data of the previous cycle, sent to everyone
+	packet []byte
+}
+
+// NewFourPlayerAdapter Adapter without players plugged
+func NewFourPlayerAdapter(name string) *FourPlayerAdapter {
+	return &FourPlayerAdapter{Name: name, size: 4}
+}
+
+/*
+AdapterPort Plug of a player in a FourPlayerAdapter, the SerialIO of its
+emulator. Each port clocks its bytes with the cycles of its emulator,
+they meet only at the end of the transmission cycles.
+*/
+type AdapterPort struct {
+	adapter *FourPlayerAdapter
+	index   int
+
+	// SB and SC as last written by the game
+	data  byte
+	armed bool
+
+	cycles   int
+	phase    int
+	position int
+	// Answers of the game to the ping packet
+	answers [4]byte
+	// Bytes sent in the transmission cycle, and the ones received
+	outgoing []byte
+	incoming []byte
+	// 0xFF sent in a row by player 1
+	restart int
+}
+
+// Plug Connect a player to the first free port, the ping phase tells the others
+func (adapter *FourPlayerAdapter) Plug() (*AdapterPort, error) {
+	adapter.mutex.Lock()
+	defer adapter.mutex.Unlock()
+	for i, port := range adapter.ports {
+		if port == nil {
+			port = &AdapterPort{adapter: adapter, index: i, cycles: adapterByteCycles}
+			adapter.ports[i] = port
+			return port, nil
+		}
+	}
+	return nil, errors.New("the four players are already plugged")
+}
+
+// Players Number of players plugged
+func (adapter *FourPlayerAdapter) Players() int {
+	adapter.mutex.Lock()
+	defer adapter.mutex.Unlock()
+	players := 0
+	for _, port := range adapter.ports {
+		if port != nil {
+			players++
+		}
+	}
+	return players
+}
+
+// Ports plugged, bit 0 for player 1, with the mutex held
+func (adapter *FourPlayerAdapter) plugged() byte {
+	var plugged byte
+	for i, port := range adapter.ports {
+		if port != nil {
+			plugged |= 1 << uint(i)
+		}
+	}
+	return plugged
+}
+
+// Status byte of a ping packet for the player, with the mutex held
+func (adapter *FourPlayerAdapter) status(index int) byte {
+	return adapter.acked<<4 | byte(index+1)
+}
+
+// Back to the ping phase, with the mutex held
+func (adapter *FourPlayerAdapter) restart() {
+	adapter.transmitting = false
+	adapter.acked = 0
+}
+
+// Answers of a player to a ping packet
+func (adapter *FourPlayerAdapter) ping(index int, answers [4]byte) {
+	adapter.mutex.Lock()
+	defer adapter.mutex.Unlock()
+	if answers[0] == adapterAck && answers[1] == adapterAck {
+		adapter.acked |= 1 << uint(index)
+	} else {
+		adapter.acked &^= 1 << uint(index)
+	}
+	if index != 0 {
+		return
+	}
+	for _, answer := range answers {
+		if answer == adapterStart {
+			adapter.start()
+			return
+		}
+	}
+	if answers[0] == adapterAck {
+		adapter.size = int(answers[3])
+		if adapter.size < 1 {
+			adapter.size = 1
+		} else if adapter.size > 4 {
+			adapter.size = 4
+		}
+	}
+}
+
+// Start the transmission phase, with the mutex held
+func (adapter *FourPlayerAdapter) start() {
+	if adapter.transmitting {
+		return
+	}
+	adapter.transmitting = true
+	adapter.packet = make([]byte, 4*adapter.size)
+	adapter.incoming = [4][]byte{}
+	adapter.arrived = 0
+	adapter.started = time.Now()
+}
+
+/*
+The data of a player at the end of a transmission cycle, returns the
+packet to send it in the next one without waiting for the others. The
+cycle is over once every player sent its data, or after adapterTimeout
+without the players too slow.
+*/
+func (adapter *FourPlayerAdapter) exchange(index int, data []byte) []byte {
+	adapter.mutex.Lock()
+	defer adapter.mutex.Unlock()
+	adapter.incoming[index] = data
+	adapter.arrived |= 1 << uint(index)
+	plugged := adapter.plugged()
+	if adapter.arrived&plugged == plugged || time.Since(adapter.started) > adapterTimeout {
+		adapter.next()
+	}
+	return adapter.packet
+}
+
+// Make the packet of the cycle and start the next one, with the mutex held
+func (adapter *FourPlayerAdapter) next() {
+	packet := make([]byte, 4*adapter.size)
+	for i, data := range adapter.incoming {
+		copy(packet[i*adapter.size:(i+1)*adapter.size], data)
+	}
+	adapter.packet = packet
+	adapter.arrived = 0
+	adapter.started = time.Now()
+}
+
+// Unplug Disconnect the player, the others go back to the ping phase without any player left
+func (port *AdapterPort) Unplug() {
+	adapter := port.adapter
+	adapter.mutex.Lock()
+	defer adapter.mutex.Unlock()
+	if adapter.ports[port.index] != port {
+		return
+	}
+	adapter.ports[port.index] = nil
+	adapter.acked &^= 1 << uint(port.index)
+	adapter.incoming[port.index] = nil
+	plugged := adapter.plugged()
+	if plugged == 0 {
+		adapter.restart()
+		return
+	}
+	// The others don't wait for this player anymore
+	if adapter.arrived != 0 && adapter.arrived&plugged == plugged {
+		adapter.next()
+	}
+}
+
+// Adapter The adapter the port belongs to
+func (port *AdapterPort) Adapter() *FourPlayerAdapter {
+	return port.adapter
+}
+
+// Player Number of the player, from 1 to 4
+func (port *AdapterPort) Player() int {
+	return port.index + 1
+}
+
+func (port *AdapterPort) SetChannelStatus(master bool, status bool) {
+	port.armed = status && !master
+}
+
+// Games wait for the adapter with the external clock
+func (port *AdapterPort) SendByte(data byte) bool {
+	port.data = data
+	return false
+}
+
+func (port *AdapterPort) FetchByte(cycles int) (byte, bool) {
+	port.cycles -= cycles
+	if port.cycles > 0 {
+		return 0xFF, false
+	}
+	port.cycles += adapterByteCycles
+	// The game isn't waiting for a byte, the adapter tries again later
+	if !port.armed {
+		return 0xFF, false
+	}
+	port.armed = false
+	return port.transfer(port.data), true
+}
+
+// Swap a byte with the game: the one of the current phase goes out as the one of the game comes in
+func (port *AdapterPort) transfer(data byte) byte {
+	adapter := port.adapter
+	switch port.phase {
+	case adapterPinging:
+		position := port.position
+		port.answers[position] = data
+		port.position++
+		var out byte = adapterPing
+		if position > 0 {
+			adapter.mutex.Lock()
+			out = adapter.status(port.index)
+			adapter.mutex.Unlock()
+		}
+		if port.position == len(port.answers) {
+			port.position = 0
+			adapter.ping(port.index, port.answers)
+			adapter.mutex.Lock()
+			if adapter.transmitting {
+				port.phase = adapterStarting
+			}
+			adapter.mutex.Unlock()
+		}
+		return out
+
+	case adapterStarting:
+		port.position++
+		if port.position == 4 {
+			adapter.mutex.Lock()
+			port.begin(adapter.packet)
+			adapter.mutex.Unlock()
+		}
+		return adapterStarted
+
+	default:
+		out := port.outgoing[port.position]
+		if port.position < len(port.incoming) {
+			port.incoming[port.position] = data
+		}
+		port.position++
+		if port.index == 0 {
+			if data == adapterRestart {
+				port.restart++
+			} else {
+				port.restart = 0
+			}
+			if port.restart >= 4 {
+				adapter.mutex.Lock()
+				adapter.restart()
+				adapter.mutex.Unlock()
+			}
+		}
+		if port.position == len(port.outgoing) {
+			packet := adapter.exchange(port.index, port.incoming)
+			adapter.mutex.Lock()
+			if adapter.transmitting {
+				port.begin(packet)
+			} else {
+				port.phase = adapterPinging
+				port.position = 0
+			}
+			adapter.mutex.Unlock()
+		}
+		return out
+	}
+}
+
+// Start a transmission cycle sending the packet, with the mutex held
+func (port *AdapterPort) begin(packet []byte) {
+	port.phase = adapterTransmitting
+	port.position = 0
+	port.restart = 0
+	port.outgoing = packet
+	port.incoming = make([]byte, port.adapter.size)
+}
@@ -1,20 +1,28 @@
 package driver
 
 import (
+	"io"
 	"log"
 	"math"
-	"net"
+	"sync/atomic"
 )
 
 type ASCII struct {
 	// Origin pixel data generated by the emulator
 	pixels *[160][144][3]uint8
-	Conn   net.Conn
+	Conn   io.Writer
 	// How many frames have been sent by the emulator
 	FrameCount int
 	// Last sent data ,used for comparing with the next frame
-	last  [160][144]bool
-	title string
+	last [160][144]bool
+	// Set by Redraw, from another goroutine
+	redraw int32
+	title  string
+}
+
+// Redraw the whole screen on the next frame, e.g. after the window was resized
+func (stream *ASCII) Redraw() {
+	atomic.StoreInt32(&stream.redraw, 1)
 }
 
 func (stream *ASCII) Init(pixels *[160][144][3]uint8, title string) {
@@ -33,17 +41,13 @@ func (stream *ASCII) Run(drawSignal chan bool, onQuit func()) {
 		pixels := [160][144]bool{}
 		for y := 0; y < 144; y++ {
 			for x := 0; x < 160; x++ {
-				switch stream.pixels[x][y][0] {
-				case 255, 0xCC:
-					// White pixel
-					pixels[x][y] = true
-				default:
-					// Black pixel
-					pixels[x][y] = false
-				}
+				// Light pixels are drawn as white, whatever palette is used
+				pixel := stream.pixels[x][y]
+				luma := 299*int(pixel[0]) + 587*int(pixel[1]) + 114*int(pixel[2])
+				pixels[x][y] = luma >= 128*1000
 			}
 		}
-		stream.renderAscii(pixels)
+		stream.renderAscii(pixels, atomic.SwapInt32(&stream.redraw, 0) == 1)
 
 	}
 }
@@ -52,8 +56,8 @@ func (stream *ASCII) Run(drawSignal chan bool, onQuit func()) {
 	Render pixelsDirty as Braille
 	Reference: https://github.com/gabrielrcouto/php-terminal-gameboy-emulator/blob/master/src/Canvas/TerminalCanvas.php
 */
-func (stream *ASCII) renderAscii(pixels [160][144]bool) {
-	if stream.last == pixels {
+func (stream *ASCII) renderAscii(pixels [160][144]bool, redraw bool) {
+	if stream.last == pixels && !redraw {
 		return
 	}
 	stream.last = pixels
@@ -80,7 +84,7 @@ func (stream *ASCII) renderAscii(pixels [160][144]bool) {
 				if chars[charPosition] == 0x2880 {
 					ret += " "
 				} else {
-					ret += string(chars[charPosition])
+					ret += string(rune(chars[charPosition]))
 				}
 				if x%159 == 0 {
 					ret += "\r\n"
@@ -89,6 +93,9 @@ func (stream *ASCII) renderAscii(pixels [160][144]bool) {
 		}
 	}
 	// Clean screen
+	if redraw {
+		ret = "\033[2J\033[H" + ret
+	}
 	_, err := stream.Conn.Write([]byte("\033[H" + ret))
 
 	if err != nil {
@@ -0,0 +1,229 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// Emulator hotkeys which can be bound to keys, see gb.Core.Hotkeys
+const (
+	HotkeySaveState   = "SaveState"
+	HotkeyLoadState   = "LoadState"
+	HotkeyRewind      = "Rewind"
+	HotkeyFastForward = "FastForward"
+	HotkeyPalette     = "Palette"
+)
+
+var hotkeyNames = []string{HotkeySaveState, HotkeyLoadState, HotkeyRewind, HotkeyFastForward, HotkeyPalette}
+
+var hotkeyDescriptions = map[string]string{
+	HotkeySaveState:   "save state",
+	HotkeyLoadState:   "load state",
+	HotkeyRewind:      "rewind",
+	HotkeyFastForward: "fast-forward",
+	HotkeyPalette:     "next palette",
+}
+
+/*
+Names of the buttons in key bindings, in joypad order. The buttons of
+the players 2-4 of the Super Game Boy multiplayer are named after them,
+e.g. "P2 A", see init.
+*/
+var buttonOrder = []string{"Right", "Left", "Up", "Down", "A", "B", "Select", "Start"}
+
+var buttonNames = map[string]Button{
+	"Right":  ButtonRight,
+	"Left":   ButtonLeft,
+	"Up":     ButtonUp,
+	"Down":   ButtonDown,
+	"A":      ButtonA,
+	"B":      ButtonB,
+	"Select": ButtonSelect,
+	"Start":  ButtonStart,
+}
+
+func init() {
+	for player := 2; player <= 4; player++ {
+		for _, name := range buttonOrder[:8] {
+			playerName := fmt.Sprintf("P%d %s", player, name)
+			buttonNames[playerName] = PlayerButton(player, buttonNames[name])
+			buttonOrder = append(buttonOrder, playerName)
+		}
+	}
+}
+
+/*
+KeyBindings Action of every key, by the key names of ParseKeys: a
+button ("A", "Start", "Up"..., "P2 A" for the second player of the
+Super Game Boy multiplayer) or an emulator hotkey ("SaveState",
+"LoadState", "Rewind", "FastForward", "Palette"). In JSON:
+
+	{"a": "A", "s": "B", "F2": "SaveState", "x": ""}
+
+Bindings are loaded over the default ones, a key bound to "" is unbound.
+*/
+type KeyBindings map[string]string
+
+/*
+DefaultKeyBindings Arrows, X for A, Z for B, Backspace for SELECT and
+Enter for START. S saves the state and L loads it back, R rewinds,
+Tab turns fast-forward on and off and P switches to the next palette.
+*/
+var DefaultKeyBindings = KeyBindings{
+	"Right":     "Right",
+	"Left":      "Left",
+	"Up":        "Up",
+	"Down":      "Down",
+	"x":         "A",
+	"z":         "B",
+	"Backspace": "Select",
+	"Enter":     "Start",
+	"s":         HotkeySaveState,
+	"l":         HotkeyLoadState,
+	"r":         HotkeyRewind,
+	"Tab":       HotkeyFastForward,
+	"p":         HotkeyPalette,
+}
+
+// LoadKeyBindings Read the key bindings of a JSON file, over the default ones
+func LoadKeyBindings(path string) (KeyBindings, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var bindings KeyBindings
+	if err := json.Unmarshal(data, &bindings); err != nil {
+		return nil, fmt.Errorf("invalid key bindings %s: %v", path, err)
+	}
+	if err := bindings.Check(); err != nil {
+		return nil, err
+	}
+	return DefaultKeyBindings.Merge(bindings), nil
+}
+
+// Check Every key is bound to a button or a hotkey
+func (bindings KeyBindings) Check() error {
+	for key, action := range bindings {
+		if _, ok := buttonNames[action]; ok || action == "" || isHotkey(action) {
+			continue
+		}
+		return fmt.Errorf("unknown action %q for key %q", action, key)
+	}
+	return nil
+}
+
+func isHotkey(action string) bool {
+	for _, name := range hotkeyNames {
+		if action == name {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Merge Copy of the bindings with the keys of other rebound, e.g. the
+bindings of a game over the ones of the server. nil bindings are the
+default ones.
+*/
+func (bindings KeyBindings) Merge(other KeyBindings) KeyBindings {
+	if bindings == nil {
+		bindings = DefaultKeyBindings
+	}
+	merged := KeyBindings{}
+	for key, action := range bindings {
+		merged[key] = action
+	}
+	for key, action := range other {
+		if action == "" {
+			delete(merged, key)
+		} else {
+			merged[key] = action
+		}
+	}
+	return merged
+}
+
+// Keymap Buttons of the keys bound to one
+func (bindings KeyBindings) Keymap() Keymap {
+	if bindings == nil {
+		bindings = DefaultKeyBindings
+	}
+	keymap := Keymap{}
+	for key, action := range bindings {
+		if button, ok := buttonNames[action]; ok {
+			keymap[key] = button
+		}
+	}
+	return keymap
+}
+
+/*
+Hotkeys Actions of the keys bound to a hotkey, from the actions of the
+hotkeys by name. Hotkeys without an action are left out.
+*/
+func (bindings KeyBindings) Hotkeys(actions map[string]func()) map[string]func() {
+	if bindings == nil {
+		bindings = DefaultKeyBindings
+	}
+	hotkeys := map[string]func(){}
+	for key, name := range bindings {
+		if action, ok := actions[name]; ok {
+			hotkeys[key] = action
+		}
+	}
+	return hotkeys
+}
+
+// Keys The keys bound to the action, sorted, e.g. for help screens
+func (bindings KeyBindings) Keys(action string) []string {
+	if bindings == nil {
+		bindings = DefaultKeyBindings
+	}
+	var keys []string
+	for key, bound := range bindings {
+		if bound == action {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// DescribeButtons The keys of the buttons, e.g. "Right: Right, ..., A: X, B: Z, ..."
+func (bindings KeyBindings) DescribeButtons() string {
+	return bindings.describe(buttonOrder, nil)
+}
+
+// DescribeHotkeys The keys of the hotkeys, e.g. "save state: S, ..., fast-forward: Tab"
+func (bindings KeyBindings) DescribeHotkeys() string {
+	return bindings.describe(hotkeyNames, hotkeyDescriptions)
+}
+
+/*
+List the keys of the actions, letters in upper case, with the
+descriptions of the actions or their name. Unbound actions are left out.
+*/
+func (bindings KeyBindings) describe(actions []string, descriptions map[string]string) string {
+	var parts []string
+	for _, action := range actions {
+		keys := bindings.Keys(action)
+		if len(keys) == 0 {
+			continue
+		}
+		for i, key := range keys {
+			if len(key) == 1 {
+				keys[i] = strings.ToUpper(key)
+			}
+		}
+		description, ok := descriptions[action]
+		if !ok {
+			description = action
+		}
+		parts = append(parts, description+": "+strings.Join(keys, "/"))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -1,81 +1,57 @@
 package driver
 
 import (
-	"github.com/HFO4/gbc-in-cloud/util"
+	"strings"
 	"time"
 )
 
+/*
+ControllerDriver Source of the button presses and releases. Drivers
+map their keys to buttons with a Keymap, and usually queue the events
+in an EventQueue.
+*/
 type ControllerDriver interface {
-	// Initialize controller status
-	InitStatus(*byte)
-	// Update input status for emulator, called by the emulator
-	UpdateInput() bool
-	// Update input status for the controller itself
-	NewInput([]byte)
+	// Events since the last call, oldest first, called by the emulator once a frame
+	PollEvents() []InputEvent
 }
 
-type TelnetController struct {
-	inputStatus *byte
-	Keymap      [8]KeyMap
+// HotkeyController Controller with emulator hotkeys besides the gamepad, keyed by key name ("F1")
+type HotkeyController interface {
+	ControllerDriver
+	SetHotkeys(map[string]func())
 }
 
-type KeyMap struct {
-	// Timestamp when the key was last pressed
-	LastPress int64
-	// Timestamp when the emulator last check the input status
-	LastChecked int64
-}
+/*
+If a key is pressed again within this time, we consider the player
+"holds" it: terminals don't tell when keys are released, but repeat
+held keys.
+*/
+const telnetHoldTime = 200 * time.Millisecond
+
+// TelnetController Controller reading the keys sent by a terminal
+type TelnetController struct {
+	EventQueue
+	// Buttons of the keys, DefaultKeymap if nil
+	Keymap Keymap
 
-func (tel *TelnetController) InitStatus(statusPointer *byte) {
-	tel.inputStatus = statusPointer
+	hotkeys map[string]func()
 }
 
-func (tel *TelnetController) UpdateInput() bool {
-	var requestInterrupt bool
-	var statusCopy byte
-	statusCopy = *tel.inputStatus
-	timeNow := time.Now().UnixNano() / int64(time.Millisecond)
-	for key, offset := range tel.Keymap {
-		/*
-			If the key was pressed in 200ms,
-			We consider player "hold" the key.
-		*/
-		if timeNow-offset.LastPress <= 200 {
-			statusCopy = util.ClearBit(statusCopy, uint(key))
-			if timeNow-offset.LastChecked >= 100 {
-				requestInterrupt = true
-			}
-			offset.LastChecked = timeNow
-		} else {
-			statusCopy = util.SetBit(statusCopy, uint(key))
-		}
-	}
-	*tel.inputStatus = statusCopy
-	return requestInterrupt
+func (tel *TelnetController) SetHotkeys(hotkeys map[string]func()) {
+	tel.hotkeys = hotkeys
 }
 
+// NewInput Handle the bytes sent by the terminal
 func (tel *TelnetController) NewInput(data []byte) {
-
-	/*
-		Key map for the input key byte and the control
-		bit in Gameboy register.
-	*/
-	keyDataMap := map[byte]int{
-		65:  2,
-		66:  3,
-		68:  1,
-		67:  0,
-		10:  7,
-		8:   6,
-		122: 5,
-		120: 4,
-		0:   7,
+	for _, key := range ParseKeys(data) {
+		action, ok := tel.hotkeys[key]
+		if !ok {
+			action, ok = tel.hotkeys[strings.ToLower(key)]
+		}
+		if ok {
+			action()
+		} else if button, ok := tel.Keymap.Button(key); ok {
+			tel.Tap(button, telnetHoldTime)
+		}
 	}
-
-	key := data[len(data)-1]
-	keyId := keyDataMap[key]
-
-	timeNow := time.Now().UnixNano() / int64(time.Millisecond)
-	tel.Keymap[keyId].LastPress = timeNow
-
 }
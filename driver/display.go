@@ -4,3 +4,15 @@ type DisplayDriver interface {
 	Init(*[160][144][3]uint8, string)
 	Run(chan bool, func())
 }
+
+// SGBDisplayDriver Display driver able to show the 256x224 Super Game Boy screen with its border
+type SGBDisplayDriver interface {
+	DisplayDriver
+	InitSGB(*[256][224][3]uint8)
+}
+
+// RedrawDisplayDriver Display driver sending only what changed, Redraw makes it send the next frame whole
+type RedrawDisplayDriver interface {
+	DisplayDriver
+	Redraw()
+}
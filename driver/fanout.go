@@ -0,0 +1,130 @@
+package driver
+
+import (
+	"log"
+	"sync"
+)
+
+// A display of a spectator of a FanOut, run from its own goroutine
+type fanOutDisplay struct {
+	signal chan bool
+	done   chan struct{}
+}
+
+/*
+FanOut Display driver drawing the frames of the emulator with the
+display of the player, and with the displays of the players watching
+the game: each spectator encodes the frames for its own terminal. The
+player's display is signalled like any display driver, the others from
+their own goroutine and only if they are done with the last frame, so
+that slow ones skip frames instead of slowing the game down.
+*/
+type FanOut struct {
+	owner DisplayDriver
+
+	mutex     sync.Mutex
+	pixels    *[160][144][3]uint8
+	sgbPixels *[256][224][3]uint8
+	title     string
+	displays  map[DisplayDriver]*fanOutDisplay
+}
+
+// NewFanOut FanOut drawing with the display of the owner only
+func NewFanOut(owner DisplayDriver) *FanOut {
+	return &FanOut{owner: owner, displays: map[DisplayDriver]*fanOutDisplay{}}
+}
+
+func (fanOut *FanOut) Init(pixels *[160][144][3]uint8, title string) {
+	fanOut.mutex.Lock()
+	fanOut.pixels = pixels
+	fanOut.title = title
+	fanOut.mutex.Unlock()
+	fanOut.owner.Init(pixels, title)
+}
+
+func (fanOut *FanOut) InitSGB(pixels *[256][224][3]uint8) {
+	fanOut.mutex.Lock()
+	fanOut.sgbPixels = pixels
+	fanOut.mutex.Unlock()
+	if display, ok := fanOut.owner.(SGBDisplayDriver); ok {
+		display.InitSGB(pixels)
+	}
+}
+
+func (fanOut *FanOut) Run(drawSignal chan bool, onQuit func()) {
+	signal := make(chan bool)
+	done := make(chan struct{})
+	go func() {
+		fanOut.owner.Run(signal, onQuit)
+		close(done)
+	}()
+
+	for {
+		ok := <-drawSignal
+		if !ok {
+			log.Println("chan closed")
+			close(signal)
+			<-done
+			return
+		}
+		fanOut.mutex.Lock()
+		for _, display := range fanOut.displays {
+			select {
+			case display.signal <- true:
+			default:
+			}
+		}
+		fanOut.mutex.Unlock()
+		signal <- true
+	}
+}
+
+// Redraw the whole screen of the owner on the next frame, see RedrawDisplayDriver
+func (fanOut *FanOut) Redraw() {
+	if display, ok := fanOut.owner.(RedrawDisplayDriver); ok {
+		display.Redraw()
+	}
+}
+
+// Add Draw the next frames with the display too, once the emulator set up the screen
+func (fanOut *FanOut) Add(display DisplayDriver) {
+	w := &fanOutDisplay{
+		// The frame drawn next, the display reads the screen when it gets to it
+		signal: make(chan bool, 1),
+		done:   make(chan struct{}),
+	}
+	fanOut.mutex.Lock()
+	display.Init(fanOut.pixels, fanOut.title)
+	if sgb, ok := display.(SGBDisplayDriver); ok && fanOut.sgbPixels != nil {
+		sgb.InitSGB(fanOut.sgbPixels)
+	}
+	fanOut.displays[display] = w
+	fanOut.mutex.Unlock()
+	if redraw, ok := display.(RedrawDisplayDriver); ok {
+		redraw.Redraw()
+	}
+	go func() {
+		display.Run(w.signal, func() {})
+		close(w.done)
+	}()
+}
+
+// Remove Stop drawing with the display, once it drew the frame it was drawing
+func (fanOut *FanOut) Remove(display DisplayDriver) {
+	fanOut.mutex.Lock()
+	w, ok := fanOut.displays[display]
+	delete(fanOut.displays, display)
+	fanOut.mutex.Unlock()
+	if !ok {
+		return
+	}
+	close(w.signal)
+	<-w.done
+}
+
+// Count Number of displays besides the owner
+func (fanOut *FanOut) Count() int {
+	fanOut.mutex.Lock()
+	defer fanOut.mutex.Unlock()
+	return len(fanOut.displays)
+}
@@ -3,78 +3,93 @@
 package driver
 
 import (
-	"image/color"
 	"log"
 	"os"
 
-	"github.com/HFO4/gbc-in-cloud/util"
+	"github.com/HFO4/gbc-in-cloud/filter"
 	"github.com/faiface/pixel"
 	"github.com/faiface/pixel/pixelgl"
 )
 
 type LCD struct {
 	pixels *[160][144][3]uint8
-	window *pixelgl.Window
+	// Super Game Boy screen with the border, if the game uses it
+	sgbPixels *[256][224][3]uint8
+	window    *pixelgl.Window
 
-	pixelMap *pixel.PictureData
+	// Filters applied to every frame before it's scaled to the window
+	Filters filter.Chain
 
-	inputStatus *byte
-	title       string
+	// Buttons pressed and released in the window
+	EventQueue
+	// Buttons of the keys, DefaultKeymap if nil
+	Keymap Keymap
+
+	title   string
+	hotkeys map[string]func()
+}
+
+// Keys of the window, by the key names of ParseKeys
+var windowKeys = map[string]pixelgl.Button{
+	"Up": pixelgl.KeyUp, "Down": pixelgl.KeyDown, "Left": pixelgl.KeyLeft, "Right": pixelgl.KeyRight,
+	"Enter": pixelgl.KeyEnter, "Backspace": pixelgl.KeyBackspace, "Tab": pixelgl.KeyTab,
+	"Escape": pixelgl.KeyEscape, " ": pixelgl.KeySpace,
+	"Home": pixelgl.KeyHome, "End": pixelgl.KeyEnd, "Insert": pixelgl.KeyInsert, "Delete": pixelgl.KeyDelete,
+	"PageUp": pixelgl.KeyPageUp, "PageDown": pixelgl.KeyPageDown,
+	"F1": pixelgl.KeyF1, "F2": pixelgl.KeyF2, "F3": pixelgl.KeyF3, "F4": pixelgl.KeyF4,
+	"F5": pixelgl.KeyF5, "F6": pixelgl.KeyF6, "F7": pixelgl.KeyF7, "F8": pixelgl.KeyF8,
+	"F9": pixelgl.KeyF9, "F10": pixelgl.KeyF10, "F11": pixelgl.KeyF11, "F12": pixelgl.KeyF12,
+}
+
+func init() {
+	for i := 0; i < 26; i++ {
+		windowKeys[string(rune('a'+i))] = pixelgl.KeyA + pixelgl.Button(i)
+	}
+	for i := 0; i < 10; i++ {
+		windowKeys[string(rune('0'+i))] = pixelgl.Key0 + pixelgl.Button(i)
+	}
 }
 
 func (lcd *LCD) Init(pixels *[160][144][3]uint8, title string) {
 	lcd.pixels = pixels
 	lcd.title = title
 	log.Println("[Display] Initialize GUI display")
-	lcd.pixelMap = pixel.MakePictureData(pixel.R(0, 0, 160, 144))
-
 }
 
-func (lcd *LCD) InitStatus(statusPointer *byte) {
-	lcd.inputStatus = statusPointer
+func (lcd *LCD) InitSGB(pixels *[256][224][3]uint8) {
+	lcd.sgbPixels = pixels
 }
 
-func (lcd *LCD) UpdateInput() bool {
-	// Mapping from keys to GB index.
-	// Reference :https://github.com/Humpheh/goboy/blob/master/pkg/gbio/iopixel/pixels.go
-	var keyMap = map[pixelgl.Button]byte{
-		// A button
-		pixelgl.KeyZ: 5,
-		// B button
-		pixelgl.KeyX: 4,
-		// SELECT button
-		pixelgl.KeyBackspace: 6,
-		// START button
-		pixelgl.KeyEnter: 7,
-		// RIGHT button
-		pixelgl.KeyRight: 0,
-		// LEFT button
-		pixelgl.KeyLeft: 1,
-		// UP button
-		pixelgl.KeyUp: 2,
-		// DOWN button
-		pixelgl.KeyDown: 3,
+func (lcd *LCD) SetHotkeys(hotkeys map[string]func()) {
+	lcd.hotkeys = map[string]func(){}
+	for name, action := range hotkeys {
+		if _, ok := windowKeys[name]; ok {
+			lcd.hotkeys[name] = action
+		} else {
+			log.Printf("[Display] Unknown hotkey %s\n", name)
+		}
 	}
-	var requestInterrupt bool
-	var statusCopy byte
-	statusCopy = *lcd.inputStatus
-	for key, offset := range keyMap {
+}
+
+/*
+Queue the keys pressed and released since the last update of the
+window, hotkeys are run instead.
+*/
+func (lcd *LCD) pollKeys() {
+	for name, key := range windowKeys {
 		if lcd.window.JustPressed(key) {
-			statusCopy = util.ClearBit(statusCopy, uint(offset))
-			requestInterrupt = true
+			if action, ok := lcd.hotkeys[name]; ok {
+				action()
+			} else if button, ok := lcd.Keymap.Button(name); ok {
+				lcd.Press(button)
+			}
 		}
 		if lcd.window.JustReleased(key) {
-			statusCopy = util.SetBit(statusCopy, uint(offset))
-			requestInterrupt = false
+			if button, ok := lcd.Keymap.Button(name); ok {
+				lcd.Release(button)
+			}
 		}
 	}
-
-	*lcd.inputStatus = statusCopy
-	return requestInterrupt
-}
-
-func (lcd *LCD) NewInput(b []byte) {
-
 }
 
 func (lcd *LCD) Run(drawSignal chan bool, onQuit func()) {
@@ -84,9 +99,13 @@ func (lcd *LCD) Run(drawSignal chan bool, onQuit func()) {
 }
 
 func (lcd *LCD) run(drawSignal chan bool, onQuit func()) {
+	width, height := 160, 144
+	if lcd.sgbPixels != nil {
+		width, height = 256, 224
+	}
 	cfg := pixelgl.WindowConfig{
 		Title:  lcd.title,
-		Bounds: pixel.R(0, 0, 160*3, 144*3),
+		Bounds: pixel.R(0, 0, float64(width*3), float64(height*3)),
 		VSync:  false,
 	}
 	win, err := pixelgl.NewWindow(cfg)
@@ -105,19 +124,24 @@ func (lcd *LCD) run(drawSignal chan bool, onQuit func()) {
 	for {
 		// drawSignal was sent by the emulator
 		<-drawSignal
-		for y := 0; y < 144; y++ {
-			for x := 0; x < 160; x++ {
-				colour := color.RGBA{R: lcd.pixels[x][y][0], G: lcd.pixels[x][y][1], B: lcd.pixels[x][y][2], A: 0xFF}
-				lcd.pixelMap.Pix[(143-y)*160+x] = colour
-			}
+		var frame filter.Frame
+		if lcd.sgbPixels != nil {
+			frame = filter.FromSGBScreen(lcd.sgbPixels)
+		} else {
+			frame = filter.FromScreen(lcd.pixels)
 		}
+		frame = lcd.Filters.Apply(frame)
 
-		graph := pixel.NewSprite(pixel.Picture(lcd.pixelMap), pixel.R(0, 0, 160, 144))
+		// The window is 3 times the size of the screen, whatever the filters scaled it to
+		picture := pixel.PictureDataFromImage(frame.RGBA)
+		graph := pixel.NewSprite(picture, picture.Bounds())
+		scale := 3 / float64(frame.Scale)
 		mat := pixel.IM
 		mat = mat.Moved(win.Bounds().Center())
-		mat = mat.ScaledXY(win.Bounds().Center(), pixel.V(3, 3))
+		mat = mat.ScaledXY(win.Bounds().Center(), pixel.V(scale, scale))
 		graph.Draw(lcd.window, mat)
 		win.Update()
+		lcd.pollKeys()
 	}
 
 }
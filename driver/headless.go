@@ -0,0 +1,21 @@
+package driver
+
+/*
+Headless driver for running the emulator without any frontend.
+It displays nothing and never presses a button.
+*/
+type Headless struct{}
+
+func (h *Headless) Init(pixels *[160][144][3]uint8, title string) {
+}
+
+func (h *Headless) Run(drawSignal chan bool, onQuit func()) {
+	// Keep consuming draw signals so the emulator is never blocked
+	for range drawSignal {
+	}
+	onQuit()
+}
+
+func (h *Headless) PollEvents() []InputEvent {
+	return nil
+}
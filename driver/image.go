@@ -0,0 +1,155 @@
+package driver
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"strings"
+	"sync/atomic"
+
+	"github.com/HFO4/gbc-in-cloud/filter"
+)
+
+// Graphics protocol used by the TerminalImage driver
+type ImageProtocol int
+
+const (
+	// DEC Sixel, supported by xterm -ti vt340, mlterm, foot, WezTerm...
+	SixelProtocol ImageProtocol = iota
+	// Kitty graphics protocol, supported by kitty, WezTerm, Konsole...
+	KittyProtocol
+)
+
+/*
+ParseImageProtocol parses the name of a graphics protocol: sixel or
+kitty.
+*/
+func ParseImageProtocol(name string) (ImageProtocol, error) {
+	switch strings.ToLower(name) {
+	case "sixel":
+		return SixelProtocol, nil
+	case "kitty":
+		return KittyProtocol, nil
+	}
+	return SixelProtocol, fmt.Errorf("unknown graphics protocol %q", name)
+}
+
+/*
+TerminalImage draws every frame as an image in terminals supporting a
+graphics protocol, so the game is shown with its true pixels. The
+image is drawn at the top left corner of the terminal, frames which
+didn't change are not sent again.
+*/
+type TerminalImage struct {
+	// Origin pixel data generated by the emulator
+	pixels *[160][144][3]uint8
+	// Super Game Boy screen with the border, if the game uses it
+	sgbPixels *[256][224][3]uint8
+	Conn      io.Writer
+	Protocol  ImageProtocol
+	// Filters applied to every frame before it's encoded, e.g. to scale it
+	Filters filter.Chain
+	// How many frames have been sent by the emulator
+	FrameCount int
+	// Last sent image, used for comparing with the next frame
+	last []uint8
+	// Set by Redraw, from another goroutine
+	redraw int32
+	title  string
+}
+
+func (stream *TerminalImage) Init(pixels *[160][144][3]uint8, title string) {
+	stream.title = title
+	stream.pixels = pixels
+}
+
+func (stream *TerminalImage) InitSGB(pixels *[256][224][3]uint8) {
+	stream.sgbPixels = pixels
+}
+
+func (stream *TerminalImage) Run(drawSignal chan bool, onQuit func()) {
+	for {
+		if !<-drawSignal {
+			log.Println("chan closed")
+			break
+		}
+		stream.FrameCount++
+
+		var frame filter.Frame
+		if stream.sgbPixels != nil {
+			frame = filter.FromSGBScreen(stream.sgbPixels)
+		} else {
+			frame = filter.FromScreen(stream.pixels)
+		}
+		frame = stream.Filters.Apply(frame)
+		redraw := atomic.SwapInt32(&stream.redraw, 0) == 1 || stream.FrameCount == 1
+		if !redraw && bytes.Equal(frame.Pix, stream.last) {
+			continue
+		}
+		stream.last = frame.Pix
+
+		var out bytes.Buffer
+		if redraw {
+			out.WriteString("\033[2J")
+		}
+		out.WriteString("\033[H")
+		if stream.Protocol == KittyProtocol {
+			encodeKitty(&out, frame.RGBA)
+		} else {
+			encodeSixel(&out, frame.RGBA)
+		}
+		_, err := stream.Conn.Write(out.Bytes())
+		if err != nil {
+			log.Println("Failed to send frame to player")
+		}
+	}
+}
+
+// Redraw the whole screen on the next frame, e.g. after the window was resized
+func (stream *TerminalImage) Redraw() {
+	atomic.StoreInt32(&stream.redraw, 1)
+}
+
+/*
+Indexed copy of the image with at most 256 colours. Images with more
+colours, like blended frames, are reduced to the 6x6x6 colour cube.
+*/
+func indexImage(img *image.RGBA) (palette [][3]uint8, indices []uint8) {
+	palette, indices, ok := indexColours(img, false)
+	if !ok {
+		palette, indices, _ = indexColours(img, true)
+	}
+	return palette, indices
+}
+
+// Index the colours of the image, fails if there are more than 256
+func indexColours(img *image.RGBA, reduce bool) ([][3]uint8, []uint8, bool) {
+	bounds := img.Bounds()
+	indices := make([]uint8, bounds.Dx()*bounds.Dy())
+	colours := map[[3]uint8]uint8{}
+	var palette [][3]uint8
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			i := img.PixOffset(bounds.Min.X+x, bounds.Min.Y+y)
+			colour := [3]uint8{img.Pix[i], img.Pix[i+1], img.Pix[i+2]}
+			if reduce {
+				for c := range colour {
+					colour[c] = uint8((int(colour[c]) + 25) / 51 * 51)
+				}
+			}
+			index, ok := colours[colour]
+			if !ok {
+				if len(palette) == 256 {
+					return nil, nil, false
+				}
+				index = uint8(len(palette))
+				colours[colour] = index
+				palette = append(palette, colour)
+			}
+			indices[y*bounds.Dx()+x] = index
+		}
+	}
+	return palette, indices, true
+}
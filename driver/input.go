@@ -0,0 +1,145 @@
+package driver
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Button of the Game Boy, its value is its bit in the joypad status. The
+buttons of the players 2-4 of the Super Game Boy multiplayer follow the
+ones of the first player, see PlayerButton.
+*/
+type Button byte
+
+const (
+	ButtonRight Button = iota
+	ButtonLeft
+	ButtonUp
+	ButtonDown
+	ButtonA
+	ButtonB
+	ButtonSelect
+	ButtonStart
+)
+
+// LastButton The START button of the fourth player
+const LastButton = ButtonStart + 3*8
+
+// PlayerButton The button of a player of the Super Game Boy multiplayer, from 1 to 4
+func PlayerButton(player int, button Button) Button {
+	return Button(player-1)*8 + button
+}
+
+// Player The player pressing the button, from 1 to 4
+func (button Button) Player() int {
+	return int(button/8) + 1
+}
+
+// Bit The bit of the button in the joypad status of its player
+func (button Button) Bit() uint {
+	return uint(button % 8)
+}
+
+// InputEvent A button pressed or released
+type InputEvent struct {
+	Button  Button
+	Pressed bool
+	// When it was pressed or released, events are applied in this order
+	Time time.Time
+}
+
+/*
+EventQueue Input events waiting for the emulator, in time order. Events
+may be queued in advance, e.g. the release of a button tapped by a
+player who can't hold it, they are only polled once their time comes.
+It is safe to use from several goroutines.
+*/
+type EventQueue struct {
+	lock   sync.Mutex
+	events []InputEvent
+}
+
+// Push an event, after the events queued for the same time
+func (queue *EventQueue) Push(event InputEvent) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	i := len(queue.events)
+	for i > 0 && queue.events[i-1].Time.After(event.Time) {
+		i--
+	}
+	queue.events = append(queue.events, InputEvent{})
+	copy(queue.events[i+1:], queue.events[i:])
+	queue.events[i] = event
+}
+
+// Press the button now
+func (queue *EventQueue) Press(button Button) {
+	queue.Push(InputEvent{Button: button, Pressed: true, Time: time.Now()})
+}
+
+// Release the button now
+func (queue *EventQueue) Release(button Button) {
+	queue.Push(InputEvent{Button: button, Pressed: false, Time: time.Now()})
+}
+
+/*
+Tap Press the button now and release it after the duration. If the
+button is already held by a tap, it is held longer instead.
+*/
+func (queue *EventQueue) Tap(button Button, duration time.Duration) {
+	now := time.Now()
+	queue.lock.Lock()
+	held := false
+	for i := 0; i < len(queue.events); i++ {
+		event := queue.events[i]
+		if event.Button == button && !event.Pressed && event.Time.After(now) {
+			queue.events = append(queue.events[:i], queue.events[i+1:]...)
+			held = true
+			break
+		}
+	}
+	queue.lock.Unlock()
+
+	if !held {
+		queue.Push(InputEvent{Button: button, Pressed: true, Time: now})
+	}
+	queue.Push(InputEvent{Button: button, Pressed: false, Time: now.Add(duration)})
+}
+
+// PollEvents Remove and return the events whose time has come, oldest first
+func (queue *EventQueue) PollEvents() []InputEvent {
+	now := time.Now()
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	due := 0
+	for due < len(queue.events) && !queue.events[due].Time.After(now) {
+		due++
+	}
+	if due == 0 {
+		return nil
+	}
+	events := make([]InputEvent, due)
+	copy(events, queue.events)
+	queue.events = queue.events[due:]
+	return events
+}
+
+// Keymap Buttons of the keys, by the key names of ParseKeys ("Up", "Enter", "z"), see KeyBindings
+type Keymap map[string]Button
+
+// DefaultKeymap Buttons of DefaultKeyBindings
+var DefaultKeymap = DefaultKeyBindings.Keymap()
+
+// Button of the key, letters are mapped whatever their case is
+func (keymap Keymap) Button(key string) (Button, bool) {
+	if keymap == nil {
+		keymap = DefaultKeymap
+	}
+	button, ok := keymap[key]
+	if !ok {
+		button, ok = keymap[strings.ToLower(key)]
+	}
+	return button, ok
+}
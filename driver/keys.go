@@ -0,0 +1,115 @@
+package driver
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// Keys of "CSI n ~" sequences, by n
+var tildeKeys = map[int]string{
+	1: "Home", 2: "Insert", 3: "Delete", 4: "End", 5: "PageUp", 6: "PageDown", 7: "Home", 8: "End",
+	11: "F1", 12: "F2", 13: "F3", 14: "F4", 15: "F5",
+	17: "F6", 18: "F7", 19: "F8", 20: "F9", 21: "F10", 23: "F11", 24: "F12",
+}
+
+// Keys of "CSI x" and "SS3 x" sequences, by x
+var letterKeys = map[byte]string{
+	'A': "Up", 'B': "Down", 'C': "Right", 'D': "Left", 'H': "Home", 'F': "End",
+	'P': "F1", 'Q': "F2", 'R': "F3", 'S': "F4",
+}
+
+/*
+ParseKeys splits the input of a terminal into the keys pressed, as
+several keys may come in one read. Printable characters are named by
+themselves ("a", "Z", " "), other keys by their name: "Up", "Down",
+"Left", "Right", "Enter", "Backspace", "Tab", "Escape", "F1"-"F12",
+"Home", "End", "Insert", "Delete", "PageUp", "PageDown" and "Ctrl+A"
+to "Ctrl+Z". Modifiers of the special keys are ignored, unknown and
+incomplete escape sequences are dropped.
+*/
+func ParseKeys(data []byte) []string {
+	var keys []string
+	for i := 0; i < len(data); {
+		b := data[i]
+		i++
+		switch {
+		case b == '\r':
+			// Terminals send CR, CR LF or CR NUL for Enter
+			if i < len(data) && (data[i] == '\n' || data[i] == 0) {
+				i++
+			}
+			keys = append(keys, "Enter")
+		case b == '\n':
+			keys = append(keys, "Enter")
+		case b == '\t':
+			keys = append(keys, "Tab")
+		case b == 8 || b == 127:
+			keys = append(keys, "Backspace")
+		case b == 27:
+			key, length := parseEscape(data[i:])
+			i += length
+			if key != "" {
+				keys = append(keys, key)
+			}
+		case b >= 1 && b <= 26:
+			keys = append(keys, fmt.Sprintf("Ctrl+%c", 'A'+b-1))
+		case b >= ' ':
+			r, size := utf8.DecodeRune(data[i-1:])
+			if r != utf8.RuneError {
+				keys = append(keys, string(r))
+				i += size - 1
+			}
+		}
+	}
+	return keys
+}
+
+/*
+Parse the escape sequence following an ESC, returns the key and the
+length of the sequence. A lone ESC is the Escape key.
+*/
+func parseEscape(data []byte) (string, int) {
+	if len(data) == 0 || (data[0] != '[' && data[0] != 'O') {
+		return "Escape", 0
+	}
+	if data[0] == 'O' {
+		// SS3, sent by the keypad and arrows in application mode
+		if len(data) < 2 {
+			return "", len(data)
+		}
+		return letterKeys[data[1]], 2
+	}
+
+	// Linux console F1-F5: CSI [ A-E
+	if len(data) >= 3 && data[1] == '[' {
+		if data[2] >= 'A' && data[2] <= 'E' {
+			return fmt.Sprintf("F%d", data[2]-'A'+1), 3
+		}
+		return "", 3
+	}
+
+	// CSI: parameters, intermediate bytes, then the final byte
+	param := 0
+	firstParam := true
+	for i := 1; i < len(data); i++ {
+		b := data[i]
+		switch {
+		case b >= '0' && b <= '9':
+			if firstParam {
+				param = param*10 + int(b-'0')
+			}
+		case b == ';':
+			firstParam = false
+		case b >= 0x20 && b <= 0x3F:
+		case b >= 0x40 && b <= 0x7E:
+			if b == '~' {
+				return tildeKeys[param], i + 1
+			}
+			return letterKeys[b], i + 1
+		default:
+			// Not a CSI sequence after all
+			return "", i
+		}
+	}
+	return "", len(data)
+}
@@ -0,0 +1,58 @@
+package driver
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Keys sent by terminals, several keys may come in one read
+func TestParseKeys(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		input string
+		keys  []string
+	}{
+		{"printable characters", "aZ é", []string{"a", "Z", " ", "é"}},
+		{"CR", "\r", []string{"Enter"}},
+		{"CR LF", "\r\n", []string{"Enter"}},
+		{"CR NUL", "\r\x00", []string{"Enter"}},
+		{"LF", "\n", []string{"Enter"}},
+		{"tab and backspaces", "\t\x08\x7f", []string{"Tab", "Backspace", "Backspace"}},
+		{"control characters", "\x01\x1a", []string{"Ctrl+A", "Ctrl+Z"}},
+		{"CSI arrows", "\x1b[A\x1b[B\x1b[C\x1b[D", []string{"Up", "Down", "Right", "Left"}},
+		{"SS3 arrows", "\x1bOA\x1bOB\x1bOC\x1bOD", []string{"Up", "Down", "Right", "Left"}},
+		{"modified arrow", "\x1b[1;5A", []string{"Up"}},
+		{"CSI Home and End", "\x1b[H\x1b[F", []string{"Home", "End"}},
+		{"SS3 Home and End", "\x1bOH\x1bOF", []string{"Home", "End"}},
+		{"tilde Home and End", "\x1b[1~\x1b[4~\x1b[7~\x1b[8~", []string{"Home", "End", "Home", "End"}},
+		{"tilde keys", "\x1b[2~\x1b[3~\x1b[5~\x1b[6~", []string{"Insert", "Delete", "PageUp", "PageDown"}},
+		{"modified tilde key", "\x1b[3;2~", []string{"Delete"}},
+		{"SS3 function keys", "\x1bOP\x1bOS", []string{"F1", "F4"}},
+		{"tilde function keys", "\x1b[15~\x1b[24~", []string{"F5", "F12"}},
+		{"Linux console function keys", "\x1b[[A\x1b[[E", []string{"F1", "F5"}},
+		{"lone ESC", "\x1b", []string{"Escape"}},
+		{"ESC before a key", "\x1bx", []string{"Escape", "x"}},
+		{"two ESC", "\x1b\x1b", []string{"Escape", "Escape"}},
+		{"unknown tilde key", "\x1b[200~a", []string{"a"}},
+		{"unknown SS3 key", "\x1bOzb", []string{"b"}},
+		{"incomplete CSI", "a\x1b[1;5", []string{"a"}},
+		{"incomplete SS3", "a\x1bO", []string{"a"}},
+		{"incomplete Linux console key", "a\x1b[[", []string{"a"}},
+		{"sequence broken by a control character", "\x1b[1\rb", []string{"Enter", "b"}},
+		{"keys around a sequence", "x\x1b[Ay", []string{"x", "Up", "y"}},
+	} {
+		if keys := ParseKeys([]byte(test.input)); !reflect.DeepEqual(keys, test.keys) {
+			t.Errorf("%s: %q parsed as %q, want %q", test.name, test.input, keys, test.keys)
+		}
+	}
+}
+
+// A sequence split between two reads loses its first part only, the rest is read as keys
+func TestParseKeysSplit(t *testing.T) {
+	if keys := ParseKeys([]byte("\x1b[")); len(keys) != 0 {
+		t.Errorf("incomplete CSI parsed as %q", keys)
+	}
+	if keys := ParseKeys([]byte("A")); !reflect.DeepEqual(keys, []string{"A"}) {
+		t.Errorf("end of a split sequence parsed as %q, want [\"A\"]", keys)
+	}
+}
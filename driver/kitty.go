@@ -0,0 +1,53 @@
+package driver
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"fmt"
+	"image"
+)
+
+// Size of the base64 payload of an escape, the protocol limit
+const kittyChunkSize = 4096
+
+/*
+Encode the image as kitty graphics protocol escapes. The RGB pixels are
+compressed with zlib and sent in chunks. The image and its placement
+always have the same id, so every frame replaces the previous one
+instead of stacking images in the terminal.
+Reference: https://sw.kovidgoyal.net/kitty/graphics-protocol/
+*/
+func encodeKitty(out *bytes.Buffer, img *image.RGBA) {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+
+	var data bytes.Buffer
+	compressor := zlib.NewWriter(&data)
+	row := make([]byte, width*3)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := img.PixOffset(img.Bounds().Min.X+x, img.Bounds().Min.Y+y)
+			copy(row[x*3:x*3+3], img.Pix[i:i+3])
+		}
+		compressor.Write(row)
+	}
+	compressor.Close()
+	payload := base64.StdEncoding.EncodeToString(data.Bytes())
+
+	for start := 0; start < len(payload) || start == 0; start += kittyChunkSize {
+		end := start + kittyChunkSize
+		more := 1
+		if end >= len(payload) {
+			end = len(payload)
+			more = 0
+		}
+		if start == 0 {
+			// Transmit and display, quietly, without moving the cursor
+			fmt.Fprintf(out, "\033_Ga=T,f=24,o=z,s=%d,v=%d,i=1,p=1,q=2,C=1,m=%d;", width, height, more)
+		} else {
+			fmt.Fprintf(out, "\033_Gm=%d;", more)
+		}
+		out.WriteString(payload[start:end])
+		out.WriteString("\033\\")
+	}
+}
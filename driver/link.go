@@ -0,0 +1,375 @@
+package driver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Link cable protocol
+const (
+	linkMagic   = "GBLINK"
+	linkVersion = 2
+
+	// A master started a transfer: sequence number, byte of its SB
+	linkMaster = 'M'
+	// Answer of the slave: sequence number of the transfer, byte of its SB
+	linkReply = 'R'
+	// Round trip measured by both sides during the handshake
+	linkPing = 'P'
+	linkPong = 'p'
+	// Pings of the handshake, the shortest round trip is kept
+	linkPings = 3
+
+	// A master transfer without answer is over after this, as if nothing was plugged
+	linkTimeout = 2 * time.Second
+	// Time for the other emulator to say hello
+	linkHandshakeTimeout = 10 * time.Second
+	// Messages waiting to be read by the emulator or sent
+	linkQueueLength = 64
+	// Emulated cycles per second, to turn the round trip into cycles
+	linkClock = 4194304
+)
+
+// A message of the link protocol, 3 bytes on the wire
+type linkMessage struct {
+	kind byte
+	seq  byte
+	data byte
+}
+
+/*
+TCPLink Link cable to an emulator of another process, over TCP.
+
+The game of each side decides which one is the master, by the clock it
+selects in SC. Transfers of the master don't stop its emulation while
+the byte goes through the network: they last the round trip measured
+when connecting, converted to emulated cycles, which games see as a
+slower clock. The answer of the slave is usually back by then, the
+transfer only waits for it past that. The slave answers with the byte
+in its SB once its game started the transfer: like on hardware, a byte
+clocked in before that waits for it, and is dropped after linkTimeout.
+*/
+type TCPLink struct {
+	// Title of the game of the other side
+	PeerTitle string
+	// Round trip to the other side, measured when connecting
+	Latency time.Duration
+	// Cycles added to the master transfers for the round trip
+	latencyCycles int
+
+	conn     net.Conn
+	incoming chan linkMessage
+	outgoing chan linkMessage
+	closed   int32
+	done     chan struct{}
+
+	// SC and SB as last written by the game, transfer is cleared once it's over
+	master   bool
+	transfer bool
+	data     byte
+	// Byte of the master waiting for our game to start the transfer, nil if none
+	waiting      *linkMessage
+	waitingSince time.Time
+
+	// Master transfer in progress
+	pending  bool
+	seq      byte
+	cycles   int
+	started  time.Time
+	answered bool
+	received byte
+}
+
+/*
+ListenLink Wait for another emulator to connect on the address, e.g.
+":1990". Connections which aren't emulators are turned down, and the
+next one is awaited.
+*/
+func ListenLink(address string, title string) (*TCPLink, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+	log.Println("[Link] Waiting for the other player on", listener.Addr())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		link, err := newTCPLink(conn, title, false)
+		if err != nil {
+			log.Printf("[Link] Turned %s down, %s\n", conn.RemoteAddr(), err)
+			conn.Close()
+			continue
+		}
+		return link, nil
+	}
+}
+
+// DialLink Connect to another emulator waiting with ListenLink, e.g. at "192.168.1.2:1990"
+func DialLink(address string, title string) (*TCPLink, error) {
+	conn, err := net.DialTimeout("tcp", address, linkHandshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	link, err := newTCPLink(conn, title, true)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return link, nil
+}
+
+/*
+ConnectLink Wait for the other emulator on the listen address, or
+connect to it at the join address. nil without any address.
+*/
+func ConnectLink(listen string, join string, title string) (*TCPLink, error) {
+	if listen != "" {
+		return ListenLink(listen, title)
+	}
+	if join != "" {
+		return DialLink(join, title)
+	}
+	return nil, nil
+}
+
+/*
+Say hello to the other side: the protocol version and the title of the
+game, then measure the round trip, from the dialing side first.
+*/
+func newTCPLink(conn net.Conn, title string, dialed bool) (*TCPLink, error) {
+	conn.SetDeadline(time.Now().Add(linkHandshakeTimeout))
+	title = strings.TrimRight(title, "\x00 ")
+	if len(title) > 255 {
+		title = title[:255]
+	}
+	hello := append([]byte(linkMagic), linkVersion, byte(len(title)))
+	if _, err := conn.Write(append(hello, title...)); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, len(linkMagic)+2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(linkMagic)], []byte(linkMagic)) {
+		return nil, errors.New("not a link cable")
+	}
+	if version := header[len(linkMagic)]; version != linkVersion {
+		return nil, fmt.Errorf("link cable version %d, %d is expected", version, linkVersion)
+	}
+	peerTitle := make([]byte, header[len(linkMagic)+1])
+	if _, err := io.ReadFull(conn, peerTitle); err != nil {
+		return nil, err
+	}
+
+	link := &TCPLink{
+		PeerTitle: string(peerTitle),
+		conn:      conn,
+		incoming:  make(chan linkMessage, linkQueueLength),
+		outgoing:  make(chan linkMessage, linkQueueLength),
+		done:      make(chan struct{}),
+	}
+	for _, pinging := range []bool{dialed, !dialed} {
+		if pinging {
+			latency, err := pingLink(conn)
+			if err != nil {
+				return nil, err
+			}
+			link.Latency = latency
+		} else if err := pongLink(conn); err != nil {
+			return nil, err
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	link.latencyCycles = int(link.Latency.Seconds() * linkClock)
+
+	if link.PeerTitle != title {
+		log.Printf("[Link] The other player plays %q, not %q\n", link.PeerTitle, title)
+	}
+	if dialed {
+		log.Printf("[Link] Connected to %s, %v round trip\n", conn.RemoteAddr(), link.Latency)
+	} else {
+		log.Printf("[Link] %s connected, %v round trip\n", conn.RemoteAddr(), link.Latency)
+	}
+	go link.read()
+	go link.write()
+	return link, nil
+}
+
+// Measure the round trip to the other side, the shortest of a few pings
+func pingLink(conn net.Conn) (time.Duration, error) {
+	var latency time.Duration
+	pong := make([]byte, 3)
+	for i := 0; i < linkPings; i++ {
+		start := time.Now()
+		if _, err := conn.Write([]byte{linkPing, byte(i), 0}); err != nil {
+			return 0, err
+		}
+		if _, err := io.ReadFull(conn, pong); err != nil {
+			return 0, err
+		}
+		if pong[0] != linkPong || pong[1] != byte(i) {
+			return 0, errors.New("unexpected answer to a ping")
+		}
+		if elapsed := time.Since(start); i == 0 || elapsed < latency {
+			latency = elapsed
+		}
+	}
+	return latency, nil
+}
+
+// Answer the pings of pingLink
+func pongLink(conn net.Conn) error {
+	ping := make([]byte, 3)
+	for i := 0; i < linkPings; i++ {
+		if _, err := io.ReadFull(conn, ping); err != nil {
+			return err
+		}
+		if ping[0] != linkPing {
+			return errors.New("unexpected message instead of a ping")
+		}
+		if _, err := conn.Write([]byte{linkPong, ping[1], 0}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (link *TCPLink) read() {
+	buf := make([]byte, 3)
+	for {
+		if _, err := io.ReadFull(link.conn, buf); err != nil {
+			if atomic.LoadInt32(&link.closed) == 0 {
+				log.Println("[Link] Disconnected,", err)
+				link.Close()
+			}
+			return
+		}
+		select {
+		case link.incoming <- linkMessage{kind: buf[0], seq: buf[1], data: buf[2]}:
+		case <-link.done:
+			return
+		}
+	}
+}
+
+func (link *TCPLink) write() {
+	for {
+		select {
+		case message := <-link.outgoing:
+			if _, err := link.conn.Write([]byte{message.kind, message.seq, message.data}); err != nil {
+				link.Close()
+				return
+			}
+		case <-link.done:
+			return
+		}
+	}
+}
+
+// Queue a message, the emulation never waits for the network
+func (link *TCPLink) send(message linkMessage) {
+	if atomic.LoadInt32(&link.closed) == 1 {
+		return
+	}
+	select {
+	case link.outgoing <- message:
+	default:
+		log.Println("[Link] Too many messages waiting, dropped one")
+	}
+}
+
+// Close Unplug the cable, the transfers then end as if nothing was plugged
+func (link *TCPLink) Close() error {
+	if atomic.SwapInt32(&link.closed, 1) == 1 {
+		return nil
+	}
+	close(link.done)
+	return link.conn.Close()
+}
+
+func (link *TCPLink) SetChannelStatus(master bool, status bool) {
+	link.master = master
+	link.transfer = status
+}
+
+func (link *TCPLink) SendByte(data byte) bool {
+	link.data = data
+	if link.master {
+		link.seq++
+		link.pending = true
+		// The answer of the slave comes back after a round trip
+		link.cycles = serialTransferCycles + link.latencyCycles
+		link.started = time.Now()
+		link.answered = false
+		link.send(linkMessage{kind: linkMaster, seq: link.seq, data: data})
+	}
+	return false
+}
+
+func (link *TCPLink) FetchByte(cycles int) (byte, bool) {
+	// Only the emulation reads the messages, they can't be taken meanwhile
+	for len(link.incoming) > 0 {
+		message := <-link.incoming
+		switch message.kind {
+		case linkMaster:
+			// Only the last byte clocked in waits, the master gave up on the others
+			link.waiting = &message
+			link.waitingSince = time.Now()
+		case linkReply:
+			// Answers to older transfers are late, they are dropped
+			if link.pending && message.seq == link.seq {
+				link.answered = true
+				link.received = message.data
+			}
+		}
+	}
+
+	if link.waiting != nil {
+		if time.Since(link.waitingSince) > linkTimeout {
+			link.waiting = nil
+		} else if link.transfer {
+			/*
+				The other side clocked a byte in, ours goes out. If both
+				games wanted to be the master, they both get the byte
+				of the other one.
+			*/
+			message := *link.waiting
+			link.waiting = nil
+			link.send(linkMessage{kind: linkReply, seq: message.seq, data: link.data})
+			link.pending = false
+			link.transfer = false
+			return message.data, true
+		}
+	}
+
+	if !link.pending {
+		return 0xFF, false
+	}
+	link.cycles -= cycles
+	if link.cycles > 0 {
+		return 0xFF, false
+	}
+	if link.answered {
+		link.pending = false
+		link.transfer = false
+		return link.received, true
+	}
+	if atomic.LoadInt32(&link.closed) == 1 || time.Since(link.started) > linkTimeout {
+		link.pending = false
+		link.transfer = false
+		return 0xFF, true
+	}
+	return 0xFF, false
+}
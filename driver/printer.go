@@ -0,0 +1,380 @@
+package driver
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Game Boy Printer protocol
+const (
+	printerMagic1 = 0x88
+	printerMagic2 = 0x33
+	// Answered to the byte after the checksum, the printer is plugged
+	printerAlive = 0x81
+
+	printerInit   = 0x01
+	printerPrint  = 0x02
+	printerData   = 0x04
+	printerBreak  = 0x08
+	printerStatus = 0x0F
+
+	// Bits of the status answered to the last byte of every packet
+	printerChecksumError = 1 << 0
+	printerPrinting      = 1 << 1
+	printerImageFull     = 1 << 2
+	printerUnprocessed   = 1 << 3
+	printerPacketError   = 1 << 4
+
+	// Bytes of a band of 16 lines: 2 rows of 20 tiles of 16 bytes
+	printerBandSize = 0x280
+	// The printer memory holds 9 bands, a screen
+	printerMemorySize = 9 * printerBandSize
+	// Emulated cycles spent printing a band
+	printerBandCycles = 4194304 / 8
+	// Pages kept in memory for Pages, older ones are dropped
+	maxPrinterPages = 32
+)
+
+// Shades of the 4 colours of the thermal paper, from white to black
+var printerShades = [4]uint8{0xFF, 0xAA, 0x55, 0x00}
+
+/*
+Printer Game Boy Printer plugged in the link port, in place of a
+ChannelIO. The game sends it packets of image data and print commands:
+the strips printed one after the other without margin between them
+make a page, which is kept for Pages and saved in Directory.
+*/
+type Printer struct {
+	// Directory the pages are saved to as PNG, not saved if empty
+	Directory string
+
+	mutex sync.Mutex
+	pages []*image.Gray
+	page  *image.Gray
+	count int
+	// Pages being saved
+	saving sync.WaitGroup
+
+	// Packet being received, position is the one of the next byte
+	position    int
+	command     byte
+	compression byte
+	length      int
+	packet      []byte
+	sum         uint16
+	checksum    uint16
+
+	status byte
+	// Image data waiting for a print command
+	data []byte
+	// Cycles left until the strip is printed
+	busy int
+
+	// Transfer clocked by the game
+	master   bool
+	transfer bool
+	cycles   int
+	reply    byte
+}
+
+// NewPrinter Printer saving the pages in the directory, none if empty
+func NewPrinter(directory string) *Printer {
+	return &Printer{Directory: directory}
+}
+
+func (printer *Printer) SetChannelStatus(master bool, status bool) {
+	printer.master = master
+}
+
+// The printer has no clock, it only answers the transfers of the game
+func (printer *Printer) SendByte(data byte) bool {
+	if printer.master {
+		printer.transfer = true
+		printer.cycles = serialTransferCycles
+		printer.reply = printer.receive(data)
+	}
+	return false
+}
+
+func (printer *Printer) FetchByte(cycles int) (byte, bool) {
+	if printer.busy > 0 {
+		printer.busy -= cycles
+		if printer.busy <= 0 {
+			printer.status &^= printerPrinting
+		}
+	}
+	if !printer.transfer {
+		return 0xFF, false
+	}
+	printer.cycles -= cycles
+	if printer.cycles > 0 {
+		return 0xFF, false
+	}
+	printer.transfer = false
+	return printer.reply, true
+}
+
+/*
+Take the next byte of a packet: the magic bytes, the command, the
+compression flag, the length of the data, the data and the checksum of
+it all. The printer answers 0 to them, then tells it is there and its
+status during the two bytes after.
+*/
+func (printer *Printer) receive(data byte) byte {
+	position := printer.position
+	printer.position++
+	switch {
+	case position == 0:
+		if data != printerMagic1 {
+			printer.position = 0
+		}
+	case position == 1:
+		if data != printerMagic2 {
+			printer.position = 0
+		}
+	case position == 2:
+		printer.command = data
+		printer.sum = uint16(data)
+	case position == 3:
+		printer.compression = data
+		printer.sum += uint16(data)
+	case position == 4:
+		printer.length = int(data)
+		printer.sum += uint16(data)
+	case position == 5:
+		printer.length |= int(data) << 8
+		printer.sum += uint16(data)
+		printer.packet = printer.packet[:0]
+		if printer.length > printerBandSize {
+			printer.status |= printerPacketError
+			printer.position = 0
+		}
+	case position < 6+printer.length:
+		printer.packet = append(printer.packet, data)
+		printer.sum += uint16(data)
+	case position == 6+printer.length:
+		printer.checksum = uint16(data)
+	case position == 7+printer.length:
+		printer.checksum |= uint16(data) << 8
+		printer.run()
+	case position == 8+printer.length:
+		return printerAlive
+	default:
+		printer.position = 0
+		return printer.status
+	}
+	return 0
+}
+
+// Run the command of the packet received
+func (printer *Printer) run() {
+	if printer.sum != printer.checksum {
+		printer.status |= printerChecksumError
+		return
+	}
+	printer.status &^= printerChecksumError | printerPacketError
+
+	switch printer.command {
+	case printerInit:
+		printer.data = printer.data[:0]
+		printer.busy = 0
+		printer.status = 0
+	case printerData:
+		// Data without length ends the image
+		if len(printer.packet) == 0 {
+			printer.status |= printerImageFull
+			return
+		}
+		data := printer.packet
+		if printer.compression != 0 {
+			data = decompressPrinterData(data)
+		}
+		if len(printer.data)+len(data) > printerMemorySize {
+			data = data[:printerMemorySize-len(printer.data)]
+		}
+		printer.data = append(printer.data, data...)
+		printer.status |= printerUnprocessed
+		if len(printer.data) == printerMemorySize {
+			printer.status |= printerImageFull
+		}
+	case printerPrint:
+		if len(printer.packet) < 4 {
+			printer.status |= printerPacketError
+			return
+		}
+		// Sheets, margins, palette and exposure: the darkness isn't emulated
+		printer.print(printer.packet[0], printer.packet[1], printer.packet[2])
+	case printerBreak:
+		printer.data = printer.data[:0]
+		printer.busy = 0
+		printer.status &^= printerPrinting | printerImageFull | printerUnprocessed
+	case printerStatus:
+	default:
+		printer.status |= printerPacketError
+	}
+}
+
+/*
+Data compressed with runs: a control byte with the high bit set repeats
+the next byte (control & 0x7F) + 2 times, without it the (control + 1)
+next bytes are copied.
+*/
+func decompressPrinterData(data []byte) []byte {
+	var out []byte
+	for i := 0; i < len(data); {
+		control := data[i]
+		i++
+		if control&0x80 != 0 {
+			if i >= len(data) {
+				break
+			}
+			for n := 0; n < int(control&0x7F)+2; n++ {
+				out = append(out, data[i])
+			}
+			i++
+		} else {
+			end := i + int(control) + 1
+			if end > len(data) {
+				end = len(data)
+			}
+			out = append(out, data[i:end]...)
+			i = end
+		}
+	}
+	return out
+}
+
+/*
+Print the image data as a strip of the page, with the palette mapping
+the colours of the tiles to shades like BGP. The high nibble of the
+margins is the paper fed before the strip, the low one after it: the
+page is over when paper is fed after it, or before the next strip.
+*/
+func (printer *Printer) print(sheets byte, margins byte, palette byte) {
+	if palette == 0 {
+		palette = 0xE4
+	}
+	rows := len(printer.data) / (printerBandSize / 2)
+	printer.mutex.Lock()
+	if margins>>4 != 0 {
+		printer.finishPage()
+	}
+	if sheets != 0 && rows > 0 {
+		printer.appendStrip(renderPrinterStrip(printer.data[:rows*printerBandSize/2], palette))
+	}
+	if margins&0x0F != 0 {
+		printer.finishPage()
+	}
+	printer.mutex.Unlock()
+
+	printer.data = printer.data[:0]
+	printer.status &^= printerImageFull | printerUnprocessed
+	printer.status |= printerPrinting
+	printer.busy = (rows + 1) / 2 * printerBandCycles
+	if printer.busy == 0 {
+		printer.busy = printerBandCycles
+	}
+}
+
+// Draw rows of 20 tiles of 2 bits per pixel, 160 pixels wide
+func renderPrinterStrip(data []byte, palette byte) *image.Gray {
+	rows := len(data) / (printerBandSize / 2)
+	strip := image.NewGray(image.Rect(0, 0, 160, rows*8))
+	for tile := 0; tile < rows*20; tile++ {
+		tileX, tileY := tile%20*8, tile/20*8
+		for y := 0; y < 8; y++ {
+			low, high := data[tile*16+y*2], data[tile*16+y*2+1]
+			for x := 0; x < 8; x++ {
+				bit := uint(7 - x)
+				colour := (high>>bit&1)<<1 | low>>bit&1
+				shade := palette >> (colour * 2) & 3
+				strip.SetGray(tileX+x, tileY+y, color.Gray{Y: printerShades[shade]})
+			}
+		}
+	}
+	return strip
+}
+
+// Add the strip under the page being printed, with the mutex held
+func (printer *Printer) appendStrip(strip *image.Gray) {
+	if printer.page == nil {
+		printer.page = strip
+		return
+	}
+	bounds := printer.page.Bounds()
+	page := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()+strip.Bounds().Dy()))
+	draw.Draw(page, bounds, printer.page, image.ZP, draw.Src)
+	draw.Draw(page, strip.Bounds().Add(image.Pt(0, bounds.Dy())), strip, image.ZP, draw.Src)
+	printer.page = page
+}
+
+// Keep and save the page being printed, with the mutex held
+func (printer *Printer) finishPage() {
+	page := printer.page
+	if page == nil {
+		return
+	}
+	printer.page = nil
+	printer.count++
+	if len(printer.pages) >= maxPrinterPages {
+		printer.pages = append(printer.pages[:0], printer.pages[1:]...)
+	}
+	printer.pages = append(printer.pages, page)
+
+	if printer.Directory == "" {
+		log.Printf("[Printer] Printed a %dx%d page\n", page.Bounds().Dx(), page.Bounds().Dy())
+		return
+	}
+	// Encoding takes a while, the emulation goes on meanwhile
+	path := filepath.Join(printer.Directory, fmt.Sprintf("gbdotlive-print-%d-%d.png", time.Now().Unix(), printer.count))
+	printer.saving.Add(1)
+	go func() {
+		savePrinterPage(path, page)
+		printer.saving.Done()
+	}()
+}
+
+func savePrinterPage(path string, page *image.Gray) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Println("[Error] Failed to save the printed page,", err)
+		return
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		log.Println("[Error] Failed to save the printed page,", err)
+		return
+	}
+	defer file.Close()
+	if err := png.Encode(file, page); err != nil {
+		log.Println("[Error] Failed to save the printed page,", err)
+		return
+	}
+	log.Printf("[Printer] Printed %s\n", path)
+}
+
+/*
+Flush Tear the page being printed off, e.g. when quitting: games which
+don't feed paper after their last strip leave it in the printer. It
+returns once the pages are saved.
+*/
+func (printer *Printer) Flush() {
+	printer.mutex.Lock()
+	printer.finishPage()
+	printer.mutex.Unlock()
+	printer.saving.Wait()
+}
+
+// Pages The pages printed, the oldest first, they must not be modified
+func (printer *Printer) Pages() []*image.Gray {
+	printer.mutex.Lock()
+	defer printer.mutex.Unlock()
+	return append([]*image.Gray(nil), printer.pages...)
+}
@@ -1,18 +1,65 @@
 package driver
 
+import "sync"
+
+/*
+SerialIO Device plugged in the link port: another Game Boy, a printer...
+The emulator tells it about the transfers started by the game, and
+polls it with the cycles run after every instruction.
+*/
+type SerialIO interface {
+	// SC was written: internal clock (master) and transfer start flag
+	SetChannelStatus(master bool, status bool)
+	// A transfer of the byte of SB was started
+	SendByte(data byte) bool
+	// The byte received and true once a transfer is over
+	FetchByte(cycles int) (byte, bool)
+}
+
+// Cycles of a transfer at 8192 Hz, clocked by the master
+const serialTransferCycles = 8 * 512
+
+// ChannelIO Link cable between two emulators of the same process
 type ChannelIO struct {
-	Data   byte
+	Data byte
+	// The other end of the cable, set with SetTarget from any goroutine
 	Target *ChannelIO
-	Open   bool
-	Master bool
+	target sync.Mutex
+	// Closed when the other end is unplugged, a transfer waiting for it then ends
+	unplugged chan struct{}
+	Open      bool
+	Master    bool
 
 	SendDelay int
 
 	Receive chan byte
 }
 
+func NewChannelIO() *ChannelIO {
+	return &ChannelIO{Receive: make(chan byte), unplugged: make(chan struct{})}
+}
+
 func (io *ChannelIO) SetTarget(p *ChannelIO) {
+	io.target.Lock()
+	if io.Target != p {
+		close(io.unplugged)
+		io.unplugged = make(chan struct{})
+	}
 	io.Target = p
+	io.target.Unlock()
+}
+
+// GetTarget The other end of the cable, nil if unplugged
+func (io *ChannelIO) GetTarget() *ChannelIO {
+	target, _ := io.getTarget()
+	return target
+}
+
+// The other end of the cable, and the channel closed once it's unplugged
+func (io *ChannelIO) getTarget() (*ChannelIO, chan struct{}) {
+	io.target.Lock()
+	defer io.target.Unlock()
+	return io.Target, io.unplugged
 }
 
 func (io *ChannelIO) SetChannelStatus(master bool, status bool) {
@@ -36,10 +83,14 @@ func (io *ChannelIO) FetchByte(cycles int) (byte, bool) {
 	if io.SendDelay == 0 {
 		select {
 		case data := <-io.Receive:
-			if io.Target != nil {
-				io.Target.Receive <- io.Data
+			target, unplugged := io.getTarget()
+			if target == nil {
+				return 0xff, false
+			}
+			select {
+			case target.Receive <- io.Data:
 				return data, true
-			} else {
+			case <-unplugged:
 				return 0xff, false
 			}
 
@@ -53,15 +104,25 @@ func (io *ChannelIO) FetchByte(cycles int) (byte, bool) {
 
 	if io.SendDelay <= 0 {
 
-		if io.Target == nil {
+		io.SendDelay = 0
+		target, unplugged := io.getTarget()
+		if target == nil {
 
 			return 0xff, true
 		}
 
-		io.Target.Receive <- io.Data
-		received := <-io.Receive
-		io.SendDelay = 0
-		return received, true
+		// The other player may leave meanwhile, its emulator then stops answering
+		select {
+		case target.Receive <- io.Data:
+		case <-unplugged:
+			return 0xff, true
+		}
+		select {
+		case received := <-io.Receive:
+			return received, true
+		case <-unplugged:
+			return 0xff, true
+		}
 	}
 
 	return 0xff, false
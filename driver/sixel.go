@@ -0,0 +1,85 @@
+package driver
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+)
+
+/*
+Encode the image as Sixel. Every band of 6 rows is sent once per colour
+used in it, a sixel character holding the 6 pixels of a column which
+have the colour. Repeated characters are run-length encoded.
+Reference: https://vt100.net/docs/vt3xx-gp/chapter14.html
+*/
+func encodeSixel(out *bytes.Buffer, img *image.RGBA) {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	palette, indices := indexImage(img)
+
+	// Pixels aspect ratio 1:1, background left as it is
+	fmt.Fprintf(out, "\033P0;1;0q\"1;1;%d;%d", width, height)
+	for i, colour := range palette {
+		// Colours are given in percents
+		fmt.Fprintf(out, "#%d;2;%d;%d;%d", i,
+			(int(colour[0])*100+127)/255, (int(colour[1])*100+127)/255, (int(colour[2])*100+127)/255)
+	}
+
+	sixels := make([]byte, width)
+	for band := 0; band < height; band += 6 {
+		// Colours used in the band
+		used := make([]bool, len(palette))
+		for y := band; y < band+6 && y < height; y++ {
+			for x := 0; x < width; x++ {
+				used[indices[y*width+x]] = true
+			}
+		}
+
+		first := true
+		for index := range palette {
+			if !used[index] {
+				continue
+			}
+			for x := 0; x < width; x++ {
+				bits := byte(0)
+				for row := 0; row < 6 && band+row < height; row++ {
+					if int(indices[(band+row)*width+x]) == index {
+						bits |= 1 << uint(row)
+					}
+				}
+				sixels[x] = '?' + bits
+			}
+
+			// Go back to the start of the band for every colour but the first
+			if !first {
+				out.WriteByte('$')
+			}
+			first = false
+			fmt.Fprintf(out, "#%d", index)
+			writeSixelRuns(out, sixels)
+		}
+		out.WriteByte('-')
+	}
+	out.WriteString("\033\\")
+}
+
+// Write the sixel characters with runs compressed, empty ones at the end are dropped
+func writeSixelRuns(out *bytes.Buffer, sixels []byte) {
+	end := len(sixels)
+	for end > 0 && sixels[end-1] == '?' {
+		end--
+	}
+	for x := 0; x < end; {
+		run := 1
+		for x+run < end && sixels[x+run] == sixels[x] {
+			run++
+		}
+		if run > 3 {
+			fmt.Fprintf(out, "!%d%c", run, sixels[x])
+		} else {
+			for i := 0; i < run; i++ {
+				out.WriteByte(sixels[x])
+			}
+		}
+		x += run
+	}
+}
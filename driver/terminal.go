@@ -0,0 +1,206 @@
+package driver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Colour escapes used by the Terminal driver
+type TerminalColours int
+
+const (
+	// 24-bit "\033[38;2;r;g;bm" escapes
+	TrueColour TerminalColours = iota
+	// xterm 256 colours "\033[38;5;nm" escapes
+	Colours256
+)
+
+/*
+ParseTerminalColours parses the name of a colour mode: truecolor
+(or 24bit) and 256.
+*/
+func ParseTerminalColours(name string) (TerminalColours, error) {
+	switch strings.ToLower(name) {
+	case "", "truecolor", "truecolour", "24bit":
+		return TrueColour, nil
+	case "256":
+		return Colours256, nil
+	}
+	return TrueColour, fmt.Errorf("unknown colour mode %q", name)
+}
+
+// Two pixels drawn as one character, the top one as foreground of '▀'
+type terminalCell struct {
+	top, bottom [3]uint8
+}
+
+/*
+Terminal draws the screen in a colour terminal with "▀" half-blocks,
+two pixels per character, so the 160x144 screen takes 160x72
+characters. Only the cells which changed since the last frame are
+sent, the cursor is moved to them.
+*/
+type Terminal struct {
+	// Origin pixel data generated by the emulator
+	pixels *[160][144][3]uint8
+	Conn   io.Writer
+	// Colour escapes understood by the terminal
+	Colours TerminalColours
+	// How many frames have been sent by the emulator
+	FrameCount int
+	// Last sent cells, used for comparing with the next frame
+	last [160][72]terminalCell
+	// Set by Redraw, from another goroutine
+	redraw int32
+	title  string
+}
+
+func (stream *Terminal) Init(pixels *[160][144][3]uint8, title string) {
+	stream.title = title
+	stream.pixels = pixels
+}
+
+func (stream *Terminal) Run(drawSignal chan bool, onQuit func()) {
+	for {
+		if !<-drawSignal {
+			log.Println("chan closed")
+			break
+		}
+		stream.FrameCount++
+
+		frame := stream.render()
+		if len(frame) == 0 {
+			continue
+		}
+		_, err := stream.Conn.Write(frame)
+		if err != nil {
+			log.Println("Failed to send frame to player")
+		}
+	}
+}
+
+// Redraw the whole screen on the next frame, e.g. after the window was resized
+func (stream *Terminal) Redraw() {
+	atomic.StoreInt32(&stream.redraw, 1)
+}
+
+/*
+Render the escapes updating the terminal from the last frame to the
+current one. The first frame, and the one after Redraw, clears the
+screen and is sent whole.
+*/
+func (stream *Terminal) render() []byte {
+	var out bytes.Buffer
+	first := atomic.SwapInt32(&stream.redraw, 0) == 1 || stream.FrameCount == 1
+	if first {
+		out.WriteString("\033[2J")
+	}
+
+	// Cursor position and colours of the terminal, -1 when unknown
+	cursorX, cursorY := -1, -1
+	var fg, bg string
+	for y := 0; y < 72; y++ {
+		for x := 0; x < 160; x++ {
+			cell := terminalCell{
+				top:    stream.pixels[x][y*2],
+				bottom: stream.pixels[x][y*2+1],
+			}
+			if !first && cell == stream.last[x][y] {
+				continue
+			}
+			stream.last[x][y] = cell
+
+			if cursorX != x || cursorY != y {
+				fmt.Fprintf(&out, "\033[%d;%dH", y+1, x+1)
+				cursorX, cursorY = x, y
+			}
+			if cellBg := stream.colour(cell.bottom, false); cellBg != bg {
+				out.WriteString(cellBg)
+				bg = cellBg
+			}
+			// A cell of one colour is a space, whatever the foreground is
+			if cell.top == cell.bottom {
+				out.WriteByte(' ')
+			} else {
+				if cellFg := stream.colour(cell.top, true); cellFg != fg {
+					out.WriteString(cellFg)
+					fg = cellFg
+				}
+				out.WriteString("▀")
+			}
+			cursorX++
+		}
+	}
+
+	if out.Len() == 0 {
+		return nil
+	}
+	// Leave the terminal with its own colours, below the screen
+	out.WriteString("\033[0m\033[73;1H")
+	return out.Bytes()
+}
+
+// Escape setting the foreground or background colour
+func (stream *Terminal) colour(pixel [3]uint8, foreground bool) string {
+	layer := 48
+	if foreground {
+		layer = 38
+	}
+	if stream.Colours == Colours256 {
+		return fmt.Sprintf("\033[%d;5;%dm", layer, xterm256(pixel))
+	}
+	return fmt.Sprintf("\033[%d;2;%d;%d;%dm", layer, pixel[0], pixel[1], pixel[2])
+}
+
+// Levels of the 6x6x6 colour cube of xterm
+var xtermLevels = [6]int{0, 95, 135, 175, 215, 255}
+
+/*
+Nearest colour of the xterm 256 colour palette, from the 6x6x6 cube
+(16-231) or the grey ramp (232-255).
+*/
+func xterm256(pixel [3]uint8) int {
+	var cube [3]int
+	cubeDistance := 0
+	for i, value := range pixel {
+		nearest := 0
+		for level := range xtermLevels {
+			if absInt(int(value)-xtermLevels[level]) < absInt(int(value)-xtermLevels[nearest]) {
+				nearest = level
+			}
+		}
+		cube[i] = nearest
+		diff := int(value) - xtermLevels[nearest]
+		cubeDistance += diff * diff
+	}
+
+	// Grey ramp goes from 8 to 238 by steps of 10
+	average := (int(pixel[0]) + int(pixel[1]) + int(pixel[2])) / 3
+	grey := (average - 3) / 10
+	if grey < 0 {
+		grey = 0
+	} else if grey > 23 {
+		grey = 23
+	}
+	greyDistance := 0
+	for _, value := range pixel {
+		diff := int(value) - (8 + grey*10)
+		greyDistance += diff * diff
+	}
+
+	if greyDistance < cubeDistance {
+		return 232 + grey
+	}
+	return 16 + cube[0]*36 + cube[1]*6 + cube[2]
+}
+
+func absInt(value int) int {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
@@ -0,0 +1,79 @@
+package filter
+
+import "image"
+
+/*
+LCD grid, the last row and column of every Game Boy pixel are darkened
+to show the gaps between the LCD cells. Needs a scaler before it.
+*/
+type LCDGrid struct {
+	// Brightness kept in the gaps, 0-1
+	Darken float64
+}
+
+func (grid LCDGrid) Apply(frame Frame) Frame {
+	if frame.Scale < 2 {
+		return frame
+	}
+	bounds := frame.Bounds()
+	factor := int(grid.Darken * 256)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if x%frame.Scale != frame.Scale-1 && y%frame.Scale != frame.Scale-1 {
+				continue
+			}
+			i := frame.PixOffset(x, y)
+			for c := 0; c < 3; c++ {
+				frame.Pix[i+c] = uint8(int(frame.Pix[i+c]) * factor / 256)
+			}
+		}
+	}
+	return frame
+}
+
+/*
+Ghosting of the DMG LCD: the pixels are slow to change, so the previous
+frames stay visible for a while. Every frame is blended with the last
+output, the filter keeps state and a chain using it should only be fed
+the frames of one game.
+*/
+type Ghosting struct {
+	// Part of the previous output kept, 0-1
+	Persistence float64
+	previous    *image.RGBA
+}
+
+func (ghosting *Ghosting) Apply(frame Frame) Frame {
+	if ghosting.previous == nil || ghosting.previous.Rect != frame.Rect {
+		ghosting.previous = image.NewRGBA(frame.Rect)
+		copy(ghosting.previous.Pix, frame.Pix)
+		return frame
+	}
+	keep := int(ghosting.Persistence * 256)
+	for i := range frame.Pix {
+		if i%4 == 3 {
+			continue
+		}
+		current, previous := int(frame.Pix[i]), int(ghosting.previous.Pix[i])
+		frame.Pix[i] = uint8(current + (previous-current)*keep/256)
+	}
+	copy(ghosting.previous.Pix, frame.Pix)
+	return frame
+}
+
+/*
+Colour correction. The colours games pick are meant for the washed out
+LCD of the handhelds, on a modern screen they look too saturated. The
+channels are mixed the way the GBC LCD does (the formula byuu uses).
+*/
+type ColourCorrection struct{}
+
+func (ColourCorrection) Apply(frame Frame) Frame {
+	for i := 0; i+3 < len(frame.Pix); i += 4 {
+		r, g, b := int(frame.Pix[i]), int(frame.Pix[i+1]), int(frame.Pix[i+2])
+		frame.Pix[i] = uint8((r*26 + g*4 + b*2) / 32)
+		frame.Pix[i+1] = uint8((g*24 + b*8) / 32)
+		frame.Pix[i+2] = uint8((r*6 + g*4 + b*22) / 32)
+	}
+	return frame
+}
@@ -0,0 +1,151 @@
+package filter
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+)
+
+/*
+A frame going through the filter pipeline.
+*/
+type Frame struct {
+	*image.RGBA
+	// Size of a Game Boy pixel in the image, after the scalers applied
+	Scale int
+}
+
+/*
+A step of the pipeline. Scalers return a new, larger frame, effects may
+modify the frame in place.
+*/
+type Filter interface {
+	Apply(frame Frame) Frame
+}
+
+/*
+Filters applied one after another. Scalers are usually put first and
+effects after them, except for ghosting and colour correction which
+are cheaper before scaling.
+*/
+type Chain []Filter
+
+func (chain Chain) Apply(frame Frame) Frame {
+	for _, filter := range chain {
+		frame = filter.Apply(frame)
+	}
+	return frame
+}
+
+/*
+Filters available by name, see Parse.
+*/
+var filters = map[string]func() Filter{
+	"nearest2": func() Filter { return Nearest{Factor: 2} },
+	"nearest3": func() Filter { return Nearest{Factor: 3} },
+	"nearest4": func() Filter { return Nearest{Factor: 4} },
+	"scale2x":  func() Filter { return Scale2x{} },
+	"scale3x":  func() Filter { return Scale3x{} },
+	"hq2x":     func() Filter { return HQ2x{} },
+	"xbr":      func() Filter { return XBR{} },
+	"lcdgrid":  func() Filter { return LCDGrid{Darken: 0.75} },
+	"ghosting": func() Filter { return &Ghosting{Persistence: 0.45} },
+	"colour":   func() Filter { return ColourCorrection{} },
+	"color":    func() Filter { return ColourCorrection{} },
+}
+
+/*
+Build a chain from a comma separated list of filter names, e.g.
+"ghosting,scale2x,lcdgrid". An empty list gives an empty chain.
+
+	nearest2, nearest3, nearest4 - nearest neighbour scaling
+	scale2x, scale3x             - EPX/AdvMAME pixel art scalers
+	hq2x                         - hq2x-style smoothing of edges
+	xbr                          - xBR-lite (level 1) 2x scaler
+	lcdgrid                      - darken the gaps between the pixels
+	ghosting                     - blend with the previous frames, like the slow DMG LCD
+	colour                       - colour correction of a GBC-like LCD
+*/
+func Parse(list string) (Chain, error) {
+	chain := Chain{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		newFilter, ok := filters[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown filter %q", name)
+		}
+		chain = append(chain, newFilter())
+	}
+	return chain, nil
+}
+
+/*
+Copy the screen buffer of the emulator to a new frame.
+*/
+func FromScreen(pixels *[160][144][3]uint8) Frame {
+	img := image.NewRGBA(image.Rect(0, 0, 160, 144))
+	for y := 0; y < 144; y++ {
+		for x := 0; x < 160; x++ {
+			i := img.PixOffset(x, y)
+			copy(img.Pix[i:i+3], pixels[x][y][:])
+			img.Pix[i+3] = 0xFF
+		}
+	}
+	return Frame{RGBA: img, Scale: 1}
+}
+
+/*
+Copy the Super Game Boy screen with its border to a new frame.
+*/
+func FromSGBScreen(pixels *[256][224][3]uint8) Frame {
+	img := image.NewRGBA(image.Rect(0, 0, 256, 224))
+	for y := 0; y < 224; y++ {
+		for x := 0; x < 256; x++ {
+			i := img.PixOffset(x, y)
+			copy(img.Pix[i:i+3], pixels[x][y][:])
+			img.Pix[i+3] = 0xFF
+		}
+	}
+	return Frame{RGBA: img, Scale: 1}
+}
+
+// Get a pixel, coordinates out of the image are clamped to its edges
+func pixelAt(img *image.RGBA, x int, y int) color.RGBA {
+	bounds := img.Bounds()
+	if x < bounds.Min.X {
+		x = bounds.Min.X
+	} else if x >= bounds.Max.X {
+		x = bounds.Max.X - 1
+	}
+	if y < bounds.Min.Y {
+		y = bounds.Min.Y
+	} else if y >= bounds.Max.Y {
+		y = bounds.Max.Y - 1
+	}
+	i := img.PixOffset(x, y)
+	return color.RGBA{R: img.Pix[i], G: img.Pix[i+1], B: img.Pix[i+2], A: img.Pix[i+3]}
+}
+
+func setPixel(img *image.RGBA, x int, y int, c color.RGBA) {
+	i := img.PixOffset(x, y)
+	img.Pix[i] = c.R
+	img.Pix[i+1] = c.G
+	img.Pix[i+2] = c.B
+	img.Pix[i+3] = c.A
+}
+
+// Weighted average of colours
+func mix(colours []color.RGBA, weights []int) color.RGBA {
+	var r, g, b, total int
+	for i, c := range colours {
+		r += int(c.R) * weights[i]
+		g += int(c.G) * weights[i]
+		b += int(c.B) * weights[i]
+		total += weights[i]
+	}
+	return color.RGBA{R: uint8(r / total), G: uint8(g / total), B: uint8(b / total), A: 0xFF}
+}
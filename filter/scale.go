@@ -0,0 +1,132 @@
+package filter
+
+import (
+	"image"
+	"image/color"
+)
+
+/*
+Nearest neighbour scaling, every pixel becomes a Factor x Factor block.
+*/
+type Nearest struct {
+	Factor int
+}
+
+func (nearest Nearest) Apply(frame Frame) Frame {
+	bounds := frame.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, bounds.Dx()*nearest.Factor, bounds.Dy()*nearest.Factor))
+	for y := 0; y < out.Rect.Max.Y; y++ {
+		src := frame.PixOffset(0, y/nearest.Factor)
+		dst := out.PixOffset(0, y)
+		for x := 0; x < out.Rect.Max.X; x++ {
+			copy(out.Pix[dst+x*4:dst+x*4+4], frame.Pix[src+x/nearest.Factor*4:])
+		}
+	}
+	return Frame{RGBA: out, Scale: frame.Scale * nearest.Factor}
+}
+
+/*
+Scale2x (EPX). Every pixel P becomes 4 pixels, a corner takes the
+colour of its two neighbours when they are equal:
+
+	  A          E0 E1
+	C P B  ->    E2 E3
+	  D
+*/
+type Scale2x struct{}
+
+func (Scale2x) Apply(frame Frame) Frame {
+	bounds := frame.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, bounds.Dx()*2, bounds.Dy()*2))
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			p := pixelAt(frame.RGBA, x, y)
+			a := pixelAt(frame.RGBA, x, y-1)
+			b := pixelAt(frame.RGBA, x+1, y)
+			c := pixelAt(frame.RGBA, x-1, y)
+			d := pixelAt(frame.RGBA, x, y+1)
+
+			e0, e1, e2, e3 := p, p, p, p
+			if c == a && c != d && a != b {
+				e0 = a
+			}
+			if a == b && a != c && b != d {
+				e1 = b
+			}
+			if d == c && d != b && c != a {
+				e2 = c
+			}
+			if b == d && b != a && d != c {
+				e3 = d
+			}
+
+			ox, oy := (x-bounds.Min.X)*2, (y-bounds.Min.Y)*2
+			setPixel(out, ox, oy, e0)
+			setPixel(out, ox+1, oy, e1)
+			setPixel(out, ox, oy+1, e2)
+			setPixel(out, ox+1, oy+1, e3)
+		}
+	}
+	return Frame{RGBA: out, Scale: frame.Scale * 2}
+}
+
+/*
+Scale3x (AdvMAME3x), the same idea as Scale2x with 9 output pixels:
+
+	A B C        E0 E1 E2
+	D E F  ->    E3 E4 E5
+	G H I        E6 E7 E8
+*/
+type Scale3x struct{}
+
+func (Scale3x) Apply(frame Frame) Frame {
+	bounds := frame.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, bounds.Dx()*3, bounds.Dy()*3))
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			a := pixelAt(frame.RGBA, x-1, y-1)
+			b := pixelAt(frame.RGBA, x, y-1)
+			c := pixelAt(frame.RGBA, x+1, y-1)
+			d := pixelAt(frame.RGBA, x-1, y)
+			e := pixelAt(frame.RGBA, x, y)
+			f := pixelAt(frame.RGBA, x+1, y)
+			g := pixelAt(frame.RGBA, x-1, y+1)
+			h := pixelAt(frame.RGBA, x, y+1)
+			i := pixelAt(frame.RGBA, x+1, y+1)
+
+			block := [9]color.RGBA{e, e, e, e, e, e, e, e, e}
+			if b != h && d != f {
+				if d == b {
+					block[0] = d
+				}
+				if (d == b && e != c) || (b == f && e != a) {
+					block[1] = b
+				}
+				if b == f {
+					block[2] = f
+				}
+				if (d == b && e != g) || (d == h && e != a) {
+					block[3] = d
+				}
+				if (b == f && e != i) || (h == f && e != c) {
+					block[5] = f
+				}
+				if d == h {
+					block[6] = d
+				}
+				if (d == h && e != i) || (h == f && e != g) {
+					block[7] = h
+				}
+				if h == f {
+					block[8] = f
+				}
+			}
+
+			ox, oy := (x-bounds.Min.X)*3, (y-bounds.Min.Y)*3
+			for n, colour := range block {
+				setPixel(out, ox+n%3, oy+n/3, colour)
+			}
+		}
+	}
+	return Frame{RGBA: out, Scale: frame.Scale * 3}
+}
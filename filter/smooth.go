@@ -0,0 +1,135 @@
+package filter
+
+import (
+	"image"
+	"image/color"
+)
+
+// Convert to YUV, like the hqx and xBR scalers compare colours
+func yuv(c color.RGBA) (y int, u int, v int) {
+	r, g, b := int(c.R), int(c.G), int(c.B)
+	y = (299*r + 587*g + 114*b) / 1000
+	u = (-169*r - 331*g + 500*b) / 1000
+	v = (500*r - 419*g - 81*b) / 1000
+	return
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// Colours close enough to be part of the same shape, with the hqx thresholds
+func similar(a color.RGBA, b color.RGBA) bool {
+	ya, ua, va := yuv(a)
+	yb, ub, vb := yuv(b)
+	return abs(ya-yb) <= 48 && abs(ua-ub) <= 7 && abs(va-vb) <= 6
+}
+
+// Weighted distance of two colours, used to find the edges by xBR
+func distance(a color.RGBA, b color.RGBA) int {
+	ya, ua, va := yuv(a)
+	yb, ub, vb := yuv(b)
+	return 48*abs(ya-yb) + 7*abs(ua-ub) + 6*abs(va-vb)
+}
+
+/*
+The four corners of a pixel, as the direction of the neighbours to
+look at. Mirroring the neighbourhood lets every corner be handled by
+the rules written for the bottom right one.
+*/
+var corners = [4][2]int{{-1, -1}, {1, -1}, {-1, 1}, {1, 1}}
+
+/*
+hq2x-style 2x scaler. Each corner of a pixel is blended with its two
+neighbours when they are alike and differ from the pixel, which
+smooths diagonal edges without blurring flat areas. This is a small
+subset of the hq2x rules, without its lookup table.
+*/
+type HQ2x struct{}
+
+func (HQ2x) Apply(frame Frame) Frame {
+	bounds := frame.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, bounds.Dx()*2, bounds.Dy()*2))
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			p := pixelAt(frame.RGBA, x, y)
+			for _, corner := range corners {
+				dx, dy := corner[0], corner[1]
+				horizontal := pixelAt(frame.RGBA, x+dx, y)
+				vertical := pixelAt(frame.RGBA, x, y+dy)
+				diagonal := pixelAt(frame.RGBA, x+dx, y+dy)
+
+				colour := p
+				if similar(horizontal, vertical) && !similar(p, horizontal) {
+					if similar(diagonal, p) {
+						// Thin diagonal line going through the corner
+						colour = mix([]color.RGBA{p, horizontal, vertical}, []int{2, 1, 1})
+					} else {
+						colour = mix([]color.RGBA{p, horizontal, vertical}, []int{6, 5, 5})
+					}
+				} else if !similar(p, diagonal) && similar(p, horizontal) && similar(p, vertical) {
+					// Soften the corner of a shape
+					colour = mix([]color.RGBA{p, diagonal}, []int{7, 1})
+				}
+
+				ox, oy := (x-bounds.Min.X)*2+(dx+1)/2, (y-bounds.Min.Y)*2+(dy+1)/2
+				setPixel(out, ox, oy, colour)
+			}
+		}
+	}
+	return Frame{RGBA: out, Scale: frame.Scale * 2}
+}
+
+/*
+xBR-lite, the level 1 rules of the xBR 2x scaler. For every corner of
+a pixel E the edge detection compares the weights of the two diagonal
+directions in its 5x5 neighbourhood (bottom right corner shown):
+
+	   A1 B1 C1
+	A0 A  B  C  C4
+	D0 D  E  F  F4
+	G0 G  H  I  I4
+	   G5 H5 I5
+
+When the edge goes along F-H, the corner is blended with the closer
+of F and H.
+*/
+type XBR struct{}
+
+func (XBR) Apply(frame Frame) Frame {
+	bounds := frame.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, bounds.Dx()*2, bounds.Dy()*2))
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			e := pixelAt(frame.RGBA, x, y)
+			for _, corner := range corners {
+				dx, dy := corner[0], corner[1]
+				at := func(cx, cy int) color.RGBA {
+					return pixelAt(frame.RGBA, x+cx*dx, y+cy*dy)
+				}
+				c, f, g, h, i := at(1, -1), at(1, 0), at(-1, 1), at(0, 1), at(1, 1)
+				b, d := at(0, -1), at(-1, 0)
+				f4, h5, i4, i5 := at(2, 0), at(0, 2), at(2, 1), at(1, 2)
+
+				weightFH := distance(e, c) + distance(e, g) + distance(i, f4) + distance(i, h5) + 4*distance(h, f)
+				weightEI := distance(h, d) + distance(h, i5) + distance(f, i4) + distance(f, b) + 4*distance(e, i)
+
+				colour := e
+				if weightFH < weightEI {
+					closer := h
+					if distance(e, f) <= distance(e, h) {
+						closer = f
+					}
+					colour = mix([]color.RGBA{e, closer}, []int{1, 1})
+				}
+
+				ox, oy := (x-bounds.Min.X)*2+(dx+1)/2, (y-bounds.Min.Y)*2+(dy+1)/2
+				setPixel(out, ox, oy, colour)
+			}
+		}
+	}
+	return Frame{RGBA: out, Scale: frame.Scale * 2}
+}
@@ -6,24 +6,36 @@ import (
 	"fmt"
 	"image"
 	"log"
+	"strings"
+	"sync"
 
 	"fyne.io/fyne"
 	"fyne.io/fyne/app"
 	"fyne.io/fyne/canvas"
 	"fyne.io/fyne/driver/desktop"
 
-	"github.com/HFO4/gbc-in-cloud/util"
+	"github.com/HFO4/gbc-in-cloud/driver"
+	"github.com/HFO4/gbc-in-cloud/filter"
 )
 
 type LCD struct {
 	pixels *[160][144][3]uint8
-	screen *image.RGBA
 
 	frame, output fyne.CanvasObject
 
-	inputStatus *byte
-	interrupt   bool
-	title       string
+	// Buttons pressed and released in the window
+	driver.EventQueue
+	// Buttons of the keys, driver.DefaultKeymap if nil
+	Keymap driver.Keymap
+
+	title   string
+	hotkeys map[string]func()
+
+	// Filters applied to every frame, the canvas scales the result to the window
+	Filters filter.Chain
+	// Last frame filtered, drawn by the canvas whenever it refreshes
+	mutex sync.Mutex
+	image *image.RGBA
 }
 
 func (lcd *LCD) Init(pixels *[160][144][3]uint8, title string) {
@@ -32,98 +44,58 @@ func (lcd *LCD) Init(pixels *[160][144][3]uint8, title string) {
 	log.Println("[Display] Initialize Fyne GUI display")
 }
 
-func (lcd *LCD) InitStatus(statusPointer *byte) {
-	lcd.inputStatus = statusPointer
+func (lcd *LCD) SetHotkeys(hotkeys map[string]func()) {
+	lcd.hotkeys = hotkeys
 }
 
-func (lcd *LCD) UpdateInput() bool {
-	if lcd.interrupt {
-		lcd.interrupt = false
-
-		return true
+/*
+The last frame of the emulator, the canvas may draw it more than once
+e.g. when the window is resized: the filters run once per frame, so
+that the ghosting fades with the frames of the game.
+*/
+func (lcd *LCD) draw(w, h int) image.Image {
+	lcd.mutex.Lock()
+	defer lcd.mutex.Unlock()
+	if lcd.image == nil {
+		return image.NewRGBA(image.Rect(0, 0, 160, 144))
 	}
-
-	return false
+	return lcd.image
 }
 
-func (lcd *LCD) NewInput(b []byte) {
+// Fyne key names which aren't the key names of driver.ParseKeys
+var keyNames = map[fyne.KeyName]string{
+	fyne.KeyReturn:    "Enter",
+	fyne.KeyEnter:     "Enter",
+	fyne.KeyBackspace: "Backspace",
 }
 
-func (lcd *LCD) draw(w, h int) image.Image {
-	i := 0
-	for y := 0; y < 144; y++ {
-		for x := 0; x < 160; x++ {
-			r, g, b := lcd.pixels[x][y][0], lcd.pixels[x][y][1], lcd.pixels[x][y][2]
-
-			if r == 0xFF && g == 0xFF && b == 0xFF {
-				lcd.screen.Pix[i] = 0x9b
-				lcd.screen.Pix[i+1] = 0xbc
-				lcd.screen.Pix[i+2] = 0x0f
-			} else if r == 0xCC && g == 0xCC && b == 0xCC {
-				lcd.screen.Pix[i] = 0x8b
-				lcd.screen.Pix[i+1] = 0xac
-				lcd.screen.Pix[i+2] = 0x0f
-			} else if r == 0x77 && g == 0x77 && b == 0x77 {
-				lcd.screen.Pix[i] = 0x30
-				lcd.screen.Pix[i+1] = 0x62
-				lcd.screen.Pix[i+2] = 0x30
-			} else {
-				lcd.screen.Pix[i] = 0x0f
-				lcd.screen.Pix[i+1] = 0x38
-				lcd.screen.Pix[i+2] = 0x0f
-			}
-			lcd.screen.Pix[i+3] = 0xff
-
-			i += 4
-		}
+// Name of the key as given by driver.ParseKeys, letters in lower case
+func keyName(key fyne.KeyName) string {
+	if name, ok := keyNames[key]; ok {
+		return name
 	}
-
-	return lcd.screen
-}
-
-// Mapping from keys to GB index.
-// Reference :https://github.com/Humpheh/goboy/blob/master/pkg/gbio/iopixel/pixels.go
-var keyMap = map[fyne.KeyName]byte{
-	// A button
-	fyne.KeyZ: 5,
-	// B button
-	fyne.KeyX: 4,
-	// SELECT button
-	fyne.KeyBackspace: 6,
-	// START button
-	fyne.KeyReturn: 7,
-	// RIGHT button
-	fyne.KeyRight: 0,
-	// LEFT button
-	fyne.KeyLeft: 1,
-	// UP button
-	fyne.KeyUp: 2,
-	// DOWN button
-	fyne.KeyDown: 3,
+	if len(key) == 1 {
+		return strings.ToLower(string(key))
+	}
+	return string(key)
 }
 
 func (lcd *LCD) buttonDown(ev *fyne.KeyEvent) {
-
-	var statusCopy byte
-	statusCopy = *lcd.inputStatus
-	if offset, ok := keyMap[ev.Name]; ok {
-		statusCopy = util.ClearBit(statusCopy, uint(offset))
-		lcd.interrupt = true
+	name := keyName(ev.Name)
+	if action, ok := lcd.hotkeys[name]; ok {
+		action()
+		return
 	}
 
-	*lcd.inputStatus = statusCopy
+	if button, ok := lcd.Keymap.Button(name); ok {
+		lcd.Press(button)
+	}
 }
 
 func (lcd *LCD) buttonUp(ev *fyne.KeyEvent) {
-
-	var statusCopy byte
-	statusCopy = *lcd.inputStatus
-	if offset, ok := keyMap[ev.Name]; ok {
-		statusCopy = util.SetBit(statusCopy, uint(offset))
-		lcd.interrupt = true
+	if button, ok := lcd.Keymap.Button(keyName(ev.Name)); ok {
+		lcd.Release(button)
 	}
-
-	*lcd.inputStatus = statusCopy
 }
 
 func (lcd *LCD) MinSize([]fyne.CanvasObject) fyne.Size {
@@ -144,12 +116,17 @@ func (lcd *LCD) Run(drawSignal chan bool, onQuit func()) {
 	a := app.New()
 	win := a.NewWindow(fmt.Sprintf("GameBoy - %s", lcd.title))
 
-	lcd.screen = image.NewRGBA(image.Rect(0, 0, 160, 144))
 	lcd.output = canvas.NewRaster(lcd.draw)
 	go func() {
 		for {
 			// drawSignal was sent by the emulator
-			<-drawSignal
+			if !<-drawSignal {
+				return
+			}
+			frame := lcd.Filters.Apply(filter.FromScreen(lcd.pixels))
+			lcd.mutex.Lock()
+			lcd.image = frame.RGBA
+			lcd.mutex.Unlock()
 
 			canvas.Refresh(lcd.output)
 		}
@@ -0,0 +1,89 @@
+package gb
+
+import "math"
+
+/*
+Band-limited synthesis of the APU output.
+
+The channels output levels which only change at discrete cycles, the
+output is a sum of steps. Sampling it at 44100 Hz directly aliases the
+high harmonics of the square waves, so every step is instead added to
+the buffer as a band-limited impulse (a windowed sinc) and the samples
+are the running sum of the buffer, like blip_buf does.
+*/
+
+const (
+	// Taps of the impulse, the output is delayed by half of it
+	blipWidth = 16
+	// Fractional positions the impulse is computed for
+	blipPhases = 64
+	// Cutoff of the low-pass filter, relative to the Nyquist frequency
+	blipCutoff = 0.9
+)
+
+var blipKernel = func() (kernel [blipPhases][blipWidth]float64) {
+	for phase := range kernel {
+		frac := float64(phase) / blipPhases
+		sum := 0.0
+		for tap := range kernel[phase] {
+			d := float64(tap-blipWidth/2) - frac
+			value := blipCutoff
+			if d != 0 {
+				value = math.Sin(math.Pi*blipCutoff*d) / (math.Pi * d)
+			}
+			// Blackman window over the width of the impulse
+			w := 2 * math.Pi * (d + blipWidth/2) / blipWidth
+			value *= 0.42 - 0.5*math.Cos(w) + 0.08*math.Cos(2*w)
+			kernel[phase][tap] = value
+			sum += value
+		}
+		// Every step must add up to its exact height
+		for tap := range kernel[phase] {
+			kernel[phase][tap] /= sum
+		}
+	}
+	return
+}()
+
+type blipBuffer struct {
+	// Impulses added, deltas[0] is the next sample to read
+	deltas []float64
+	// Sum of the deltas read so far, the output level
+	integrator float64
+	// High-pass filter of the output capacitor
+	capacitor float64
+}
+
+// Add a step of height delta at the sample position (not yet read)
+func (buffer *blipBuffer) addDelta(position float64, delta float64) {
+	index := int(position)
+	phase := int((position - float64(index)) * blipPhases)
+	for len(buffer.deltas) < index+blipWidth {
+		buffer.deltas = append(buffer.deltas, 0)
+	}
+	for tap, value := range blipKernel[phase] {
+		buffer.deltas[index+tap] += delta * value
+	}
+}
+
+/*
+Read up to `available` samples into `out`, returns the samples read.
+The DC offset is removed like the capacitor of the real output does.
+*/
+func (buffer *blipBuffer) read(out []float64, available int) int {
+	n := len(out)
+	if n > available {
+		n = available
+	}
+	for len(buffer.deltas) < n {
+		buffer.deltas = append(buffer.deltas, 0)
+	}
+	for i := 0; i < n; i++ {
+		buffer.integrator += buffer.deltas[i]
+		out[i] = buffer.integrator - buffer.capacitor
+		buffer.capacitor = buffer.integrator - out[i]*0.996
+	}
+	remaining := copy(buffer.deltas, buffer.deltas[n:])
+	buffer.deltas = buffer.deltas[:remaining]
+	return n
+}
@@ -104,6 +104,10 @@ type CartridgeProps struct {
 	ROMLength int
 	ROMBank   uint8
 	RAMBank   uint8
+	// Palette the CGB boot ROM would colorize the game with
+	Colorization Palette
+	// Game supports the Super Game Boy functions
+	SGB bool
 }
 
 type MBC interface {
@@ -0,0 +1,289 @@
+package gb
+
+/*
+The four sound channels. Each one has a frequency timer counting CPU
+cycles, which moves the waveform forward, and parts clocked by the
+frame sequencer: the length counter, the volume envelope and, for the
+channel 1, the frequency sweep.
+*/
+
+/*
+Length counter, silences the channel once it reaches zero if enabled
+with bit 6 of NRx4. Loaded from NRx1 as `max - value`.
+*/
+type lengthCounter struct {
+	enabled bool
+	counter int
+}
+
+// Returns false when the channel must be turned off
+func (length *lengthCounter) clock() bool {
+	if length.enabled && length.counter > 0 {
+		length.counter--
+		return length.counter > 0
+	}
+	return true
+}
+
+/*
+Volume envelope of NRx2:
+
+	Bit 7-4 - Initial Volume of envelope (0-0Fh) (0=No Sound)
+	Bit 3   - Envelope Direction (0=Decrease, 1=Increase)
+	Bit 2-0 - Number of envelope sweep (n: 0-7)
+	          (If zero, stop envelope operation.)
+	Length of 1 step = n*(1/64) seconds
+*/
+type envelope struct {
+	register byte
+	volume   byte
+	timer    byte
+}
+
+func (env *envelope) trigger() {
+	env.volume = env.register >> 4
+	env.timer = env.register & 0x7
+}
+
+func (env *envelope) clock() {
+	period := env.register & 0x7
+	if period == 0 {
+		return
+	}
+	if env.timer > 0 {
+		env.timer--
+	}
+	if env.timer == 0 {
+		env.timer = period
+		if env.register&0x08 != 0 && env.volume < 15 {
+			env.volume++
+		} else if env.register&0x08 == 0 && env.volume > 0 {
+			env.volume--
+		}
+	}
+}
+
+// The DAC of channels 1, 2 and 4 is off when NRx2 is 00h or 08h
+func (env *envelope) dacEnabled() bool {
+	return env.register&0xF8 != 0
+}
+
+/*
+Duty cycles of the square channels, NRx1 bit 7-6:
+
+	00: 12.5% ( _-------_-------_------- )
+	01: 25%   ( __------__------__------ )
+	10: 50%   ( ____----____----____---- ) (normal)
+	11: 75%   ( ______--______--______-- )
+*/
+var dutyWaveforms = [4]byte{0x01, 0x81, 0x87, 0x7E}
+
+// Channel 1 and 2, square waves. Only channel 1 has the sweep.
+type SquareChannel struct {
+	enabled   bool
+	duty      byte
+	dutyStep  uint
+	frequency int
+	timer     int
+	length    lengthCounter
+	envelope  envelope
+
+	// Frequency sweep of NR10
+	hasSweep        bool
+	sweepRegister   byte
+	sweepEnabled    bool
+	sweepTimer      byte
+	shadowFrequency int
+	// A negative sweep was calculated since the trigger
+	sweepNegated bool
+}
+
+func (square *SquareChannel) period() int {
+	return (2048 - square.frequency) * 4
+}
+
+func (square *SquareChannel) trigger() {
+	square.enabled = square.envelope.dacEnabled()
+	if square.length.counter == 0 {
+		square.length.counter = 64
+	}
+	square.timer = square.period()
+	square.envelope.trigger()
+
+	if square.hasSweep {
+		square.shadowFrequency = square.frequency
+		square.sweepTimer = square.sweepPeriod()
+		shift := square.sweepRegister & 0x7
+		square.sweepEnabled = square.sweepRegister&0x70 != 0 || shift != 0
+		square.sweepNegated = false
+		if shift != 0 {
+			square.sweepFrequency()
+		}
+	}
+}
+
+func (square *SquareChannel) clockTimer() {
+	square.timer += square.period()
+	square.dutyStep = (square.dutyStep + 1) & 7
+}
+
+// Digital output, 0-15
+func (square *SquareChannel) output() byte {
+	if !square.enabled || (dutyWaveforms[square.duty]>>square.dutyStep)&1 == 0 {
+		return 0
+	}
+	return square.envelope.volume
+}
+
+/*
+Sweep of NR10:
+
+	Bit 6-4 - Sweep Time, in 1/128 seconds (0 - sweep off)
+	Bit 3   - Sweep Increase/Decrease (0=Addition, 1=Subtraction)
+	Bit 2-0 - Number of sweep shift (n: 0-7)
+*/
+func (square *SquareChannel) sweepPeriod() byte {
+	period := square.sweepRegister >> 4 & 0x7
+	if period == 0 {
+		// The timer treats 0 as 8
+		period = 8
+	}
+	return period
+}
+
+// Next frequency of the sweep, turns the channel off when it overflows
+func (square *SquareChannel) sweepFrequency() int {
+	change := square.shadowFrequency >> (square.sweepRegister & 0x7)
+	frequency := square.shadowFrequency + change
+	if square.sweepRegister&0x08 != 0 {
+		frequency = square.shadowFrequency - change
+		square.sweepNegated = true
+	}
+	if frequency > 2047 {
+		square.enabled = false
+	}
+	return frequency
+}
+
+func (square *SquareChannel) clockSweep() {
+	if square.sweepTimer > 0 {
+		square.sweepTimer--
+	}
+	if square.sweepTimer > 0 {
+		return
+	}
+	square.sweepTimer = square.sweepPeriod()
+	if !square.sweepEnabled || square.sweepRegister&0x70 == 0 {
+		return
+	}
+	frequency := square.sweepFrequency()
+	if frequency <= 2047 && square.sweepRegister&0x7 != 0 {
+		square.frequency = frequency
+		square.shadowFrequency = frequency
+		// Checked again with the new frequency
+		square.sweepFrequency()
+	}
+}
+
+// Channel 3, plays the 32 4-bit samples of the wave RAM (FF30-FF3F)
+type WaveChannel struct {
+	enabled    bool
+	dacEnabled bool
+	// Output level of NR32, bit 6-5
+	level     byte
+	frequency int
+	timer     int
+	position  int
+	sample    byte
+	length    lengthCounter
+	ram       [16]byte
+}
+
+func (wave *WaveChannel) period() int {
+	return (2048 - wave.frequency) * 2
+}
+
+func (wave *WaveChannel) trigger() {
+	wave.enabled = wave.dacEnabled
+	if wave.length.counter == 0 {
+		wave.length.counter = 256
+	}
+	// The first sample played is the second one, after a full period
+	wave.timer = wave.period()
+	wave.position = 0
+}
+
+func (wave *WaveChannel) clockTimer() {
+	wave.timer += wave.period()
+	wave.position = (wave.position + 1) & 31
+	wave.sample = wave.ram[wave.position/2]
+	if wave.position%2 == 0 {
+		wave.sample >>= 4
+	}
+	wave.sample &= 0xF
+}
+
+/*
+Digital output, 0-15. The output level shifts the samples:
+0 - mute, 1 - 100%, 2 - 50%, 3 - 25%.
+*/
+func (wave *WaveChannel) output() byte {
+	if !wave.enabled || wave.level == 0 {
+		return 0
+	}
+	return wave.sample >> (wave.level - 1)
+}
+
+/*
+Channel 4, noise from a linear feedback shift register, NR43:
+
+	Bit 7-4 - Shift Clock Frequency (s)
+	Bit 3   - Counter Step/Width (0=15 bits, 1=7 bits)
+	Bit 2-0 - Dividing Ratio of Frequencies (r)
+	Frequency = 524288 Hz / r / 2^(s+1) ;For r=0 assume r=0.5 instead
+*/
+type NoiseChannel struct {
+	enabled    bool
+	polynomial byte
+	lfsr       uint16
+	timer      int
+	length     lengthCounter
+	envelope   envelope
+}
+
+var noiseDivisors = [8]int{8, 16, 32, 48, 64, 80, 96, 112}
+
+func (noise *NoiseChannel) period() int {
+	return noiseDivisors[noise.polynomial&0x7] << (noise.polynomial >> 4)
+}
+
+func (noise *NoiseChannel) trigger() {
+	noise.enabled = noise.envelope.dacEnabled()
+	if noise.length.counter == 0 {
+		noise.length.counter = 64
+	}
+	noise.timer = noise.period()
+	noise.envelope.trigger()
+	noise.lfsr = 0x7FFF
+}
+
+func (noise *NoiseChannel) clockTimer() {
+	noise.timer += noise.period()
+	// Shift clock frequencies 14 and 15 stop the generator
+	if noise.polynomial>>4 >= 14 {
+		return
+	}
+	bit := (noise.lfsr ^ noise.lfsr>>1) & 1
+	noise.lfsr = noise.lfsr>>1 | bit<<14
+	if noise.polynomial&0x08 != 0 {
+		noise.lfsr = noise.lfsr&^(1<<6) | bit<<6
+	}
+}
+
+// Digital output, 0-15
+func (noise *NoiseChannel) output() byte {
+	if !noise.enabled || noise.lfsr&1 != 0 {
+		return 0
+	}
+	return noise.envelope.volume
+}
@@ -5,14 +5,20 @@ import (
 	"time"
 
 	"github.com/HFO4/gbc-in-cloud/driver"
+	"github.com/HFO4/gbc-in-cloud/record"
 	"github.com/HFO4/gbc-in-cloud/util"
 )
 
+// Requests waiting for the emulation loop, more are dropped
+const maxRequests = 16
+
 type Core struct {
 	Cartridge Cartridge
 	CPU       CPU
 	Memory    Memory
+	PPU       PPU
 	Sound     Sound
+	SGB       SGB
 	cbMap     [0x100](func())
 
 	/*
@@ -20,7 +26,8 @@ type Core struct {
 	   +     Serial Port     +
 	   +++++++++++++++++++++++
 	*/
-	Serial         driver.ChannelIO
+	// Device plugged in the link port, nothing (a ChannelIO without target) if nil
+	Serial         driver.SerialIO
 	SerialByte     byte
 	InterruptCount int
 
@@ -29,8 +36,11 @@ type Core struct {
 	   +        Joypad       +
 	   +++++++++++++++++++++++
 	*/
-	Controller   driver.ControllerDriver
+	Controller driver.ControllerDriver
+	// Buttons, a bit is 0 when the button is pressed, see driver.Button
 	JoypadStatus byte
+	// Input events waiting for the next frame, see pollInput
+	pendingInput []driver.InputEvent
 
 	/*
 	   +++++++++++++++++++++++
@@ -41,6 +51,20 @@ type Core struct {
 	//Screen pixel data
 	Screen     [160][144][3]uint8
 	ScanLineBG [160]bool
+	// Colours the shades are displayed with
+	Palette Palette
+	// Palette option selected, see SetPalette
+	PaletteName string
+	// Shade (0-3) of every pixel, before the palette is applied
+	Shades [160][144]uint8
+	// Game screen surrounded by the Super Game Boy border
+	SGBScreen [256][224][3]uint8
+	// Layers not drawn, whatever LCDC says
+	DisabledLayers Layers
+	// Recorder of the last frames, if set
+	Clip *record.Clip
+	// Recording of the video and sound to disk, if set
+	Recording *record.Recording
 	//Display driver
 	DisplayDriver driver.DisplayDriver
 	// Signal to tell display driver to draw
@@ -57,6 +81,22 @@ type Core struct {
 	Clock int
 	//in CBG mode, clock might change to twice as original
 	SpeedMultiple int
+	// Several updates are emulated per tick when set, see ToggleFastForward
+	fastForward int32
+
+	/*
+	  ++++++++++++++++++++++++++
+	  +  Save states & rewind  +
+	  ++++++++++++++++++++++++++
+	*/
+	// Seconds of play kept to rewind, nothing is kept if 0
+	RewindSeconds int
+	rewindStates  []*State
+	rewindTimer   int
+	// State of the save state hotkeys
+	savedState *State
+	// Actions to run between two frames, see Schedule
+	requests chan func(core *Core)
 
 	/*
 	  ++++++++++++++++++++++++++
@@ -76,19 +116,25 @@ type Core struct {
 	  ++++++++++++++++++++++++++
 	*/
 	ToggleSound bool
+	// Emulate the Super Game Boy for games supporting it
+	SuperGameBoy bool
+	// Song played when a GBS file is loaded (1-based, 0 for the first song)
+	GBSTrack int
+	// Header of the GBS file loaded, nil for a game
+	GBS *GBSHeader
 	/*
 		Timer
 	*/
 	Timer     Timer
 	Exit      bool
 	GameTitle string
-	RamPath   string
+	// Save file of the cartridge RAM, the ROM path with ".sav" if empty
+	RamPath string
 }
 
 type Timer struct {
 	TimerCounter    int
 	DividerRegister int
-	ScanlineCounter int
 }
 
 // Initialize emulator
@@ -97,15 +143,30 @@ func (core *Core) Init(romPath string) {
 	core.Timer.TimerCounter = 0
 	core.Timer.DividerRegister = 0
 	core.JoypadStatus = 0xFF
+	core.pendingInput = nil
+	core.rewindStates = nil
+	core.savedState = nil
+	core.requests = make(chan func(core *Core), maxRequests)
 	core.SerialByte = 0xFF
-	core.Serial.Receive = make(chan byte)
+	if core.Serial == nil {
+		core.Serial = driver.NewChannelIO()
+	}
 
 	core.initRom(romPath)
 	core.initMemory()
 	core.initCPU()
 	core.initCB()
-	core.Controller.InitStatus(&core.JoypadStatus)
+	if err := core.SetPalette(core.PaletteName); err != nil {
+		log.Printf("[Display] %s, using the %s palette\n", err, DefaultPalette)
+		core.SetPalette(DefaultPalette)
+	}
+	// The PPU starts from the first line once the LCD is found enabled
+	core.PPU.off = true
 	core.DisplayDriver.Init(&core.Screen, core.GameTitle)
+	core.SGB.Enabled = core.SuperGameBoy && core.Cartridge.Props.SGB
+	if core.SGB.Enabled {
+		core.initSGB()
+	}
 
 	/*
 		If debug mode is ON, we set the DebugControl to 0x0100,
@@ -115,8 +176,16 @@ func (core *Core) Init(romPath string) {
 		core.DebugControl = 0x0100
 	}
 
-	if core.ToggleSound {
+	core.Sound.Reset()
+	if core.Recording != nil {
+		// Both would consume the samples, the recording gets them and passes them on
 		core.Sound.Init()
+		if core.ToggleSound {
+			core.Sound.PlayRecorded()
+		}
+	} else if core.ToggleSound {
+		core.Sound.Init()
+		core.Sound.Play()
 	}
 }
 
@@ -125,10 +194,15 @@ func (core *Core) Run() {
 	// Execution interval depends on the FPS
 	ticker := time.NewTicker(time.Second / time.Duration(core.FPS))
 	for range ticker.C {
+		core.runRequests()
+		for i := 1; i < core.speed(); i++ {
+			core.emulate()
+		}
 		core.Update()
-		// Check controller input interrupt
-		if core.Controller.UpdateInput() {
-			core.RequestInterrupt(4)
+		core.recordRewind()
+		// Inputs are applied at VBlank, which doesn't come while the LCD is off
+		if core.PPU.off {
+			core.pollInput()
 		}
 		// Check exit signal
 		if core.Exit {
@@ -138,10 +212,41 @@ func (core *Core) Run() {
 	}
 }
 
+/*
+Schedule Run the action in the emulation loop, before the next frame.
+It is safe to call from any goroutine, e.g. by the hotkeys of the
+display drivers.
+*/
+func (core *Core) Schedule(action func(core *Core)) {
+	select {
+	case core.requests <- action:
+	default:
+		log.Println("[Core] Too many requests, dropped one")
+	}
+}
+
+// Run the scheduled actions
+func (core *Core) runRequests() {
+	for {
+		select {
+		case action := <-core.requests:
+			action(core)
+		default:
+			return
+		}
+	}
+}
+
 /*
 Render a frame.
 */
 func (core *Core) Update() {
+	core.emulate()
+	core.RenderScreen()
+}
+
+// Emulate the cycles of an update, without drawing the screen
+func (core *Core) emulate() {
 	cyclesThisUpdate := 0
 
 	/*
@@ -150,23 +255,31 @@ func (core *Core) Update() {
 		use double speed mode, under these, `SpeedMultiple` will be set to `1`.
 	*/
 	for cyclesThisUpdate < ((core.SpeedMultiple+1)*core.Clock)/core.FPS {
-		cycles := 4
+		cyclesThisUpdate += core.Step()
+	}
+}
 
-		/*
-			Check whether CPU is halted, when this happen, only an interrupt
-			can stop halting.
-		*/
-		if !core.CPU.Halt {
-			cycles = core.ExecuteNextOPCode()
-		}
-		cyclesThisUpdate += cycles
-		core.UpdateTimers(cycles)
-		core.UpdateGraphics(cycles)
-		cyclesThisUpdate += core.Interrupt()
-		core.UpdateIO(cycles)
+/*
+Execute a single instruction and update the rest of the hardware
+accordingly, return used CPU clock.
+*/
+func (core *Core) Step() int {
+	cycles := 4
 
+	/*
+		Check whether CPU is halted, when this happen, only an interrupt
+		can stop halting.
+	*/
+	if !core.CPU.Halt {
+		cycles = core.ExecuteNextOPCode()
 	}
-	core.RenderScreen()
+	core.UpdateTimers(cycles)
+	core.UpdateGraphics(cycles)
+	core.Sound.Update(cycles)
+	interruptCycles := core.Interrupt()
+	core.UpdateIO(cycles)
+
+	return cycles + interruptCycles
 }
 
 func (core *Core) UpdateIO(cycles int) {
@@ -384,12 +497,18 @@ func (core *Core) GetClockFreqCount() int {
 Initialize Cartridge, load rom file and decode rom props
 */
 func (core *Core) initRom(romPath string) {
-	core.RamPath = romPath + ".sav"
+	if core.RamPath == "" {
+		core.RamPath = romPath + ".sav"
+	}
 	romData := core.readRomFile(romPath)
 	ramData := core.readRamFile(core.RamPath)
 	if ramData == nil {
 		ramData = make([]byte, 0x8000)
 	}
+	if IsGBS(romData) {
+		core.initGBS(romData)
+		return
+	}
 
 	/*
 		0134-0143 - Title
@@ -511,6 +630,17 @@ func (core *Core) initRom(romPath string) {
 	if _, ok := RomBankMap[romData[0x148]]; !ok {
 		log.Fatalf("[Cartridge] Unknown ROM size byte : %x\n", romData[0x148])
 	}
+	core.Cartridge.Props.Colorization = colorizationPalette(romData)
+
+	/*
+		0146 - SGB Flag
+
+		03h - Game supports SGB functions, only valid with the old
+		licensee code (014B) set to 33h.
+	*/
+	core.Cartridge.Props.SGB = romData[0x146] == 0x03 && romData[0x14B] == 0x33
+	log.Printf("[Cartridge] SGB functions: %t\n", core.Cartridge.Props.SGB)
+
 	core.Cartridge.Props.ROMBank = RomBankMap[romData[0x148]]
 	log.Printf("[Cartridge] ROM bank number: %d (%dKBytes)\n", core.Cartridge.Props.ROMBank, core.Cartridge.Props.ROMBank*16)
 
@@ -0,0 +1,250 @@
+package gb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+)
+
+/*
+GBS (Game Boy Sound System) rips: the music code and data of a game,
+with a header telling where to load it and which routines to call.
+
+	Offset Size Description
+	====== ==== ==========================
+	  00     3  Identifier string ("GBS")
+	  03     1  Version (1)
+	  04     1  Number of songs (1-255)
+	  05     1  First song (usually 1)
+	  06     2  Load address ($400-$7fff)
+	  08     2  Init address ($400-$7fff)
+	  0a     2  Play address ($400-$7fff)
+	  0c     2  Stack pointer
+	  0e     1  Timer modulo  (see TIMING)
+	  0f     1  Timer control (see TIMING)
+	  10    32  Title string
+	  30    32  Author string
+	  50    32  Copyright string
+	  70  nnnn  Code and Data (see RST VECTORS)
+
+The play routine is called at the timer rate when bit 2 of the timer
+control is set, at VBlank otherwise.
+*/
+type GBSHeader struct {
+	Songs     int
+	FirstSong int
+	Load      uint16
+	Init      uint16
+	Play      uint16
+	Stack     uint16
+	TMA       byte
+	TAC       byte
+	Title     string
+	Author    string
+	Copyright string
+}
+
+const gbsHeaderSize = 0x70
+
+// Whether the data is a GBS file
+func IsGBS(data []byte) bool {
+	return len(data) >= gbsHeaderSize && bytes.Equal(data[0:3], []byte("GBS"))
+}
+
+func ParseGBS(data []byte) (*GBSHeader, error) {
+	if !IsGBS(data) {
+		return nil, errors.New("not a GBS file")
+	}
+	text := func(field []byte) string {
+		return string(bytes.TrimRight(field, "\x00"))
+	}
+	header := &GBSHeader{
+		Songs:     int(data[0x04]),
+		FirstSong: int(data[0x05]),
+		Load:      binary.LittleEndian.Uint16(data[0x06:]),
+		Init:      binary.LittleEndian.Uint16(data[0x08:]),
+		Play:      binary.LittleEndian.Uint16(data[0x0A:]),
+		Stack:     binary.LittleEndian.Uint16(data[0x0C:]),
+		TMA:       data[0x0E],
+		TAC:       data[0x0F],
+		Title:     text(data[0x10:0x30]),
+		Author:    text(data[0x30:0x50]),
+		Copyright: text(data[0x50:0x70]),
+	}
+	if header.Load < 0x400 || header.Load >= 0x8000 {
+		return nil, fmt.Errorf("unsupported load address %04Xh", header.Load)
+	}
+	if header.Songs == 0 {
+		return nil, errors.New("no song in the GBS file")
+	}
+	if header.FirstSong < 1 || header.FirstSong > header.Songs {
+		header.FirstSong = 1
+	}
+	return header, nil
+}
+
+// Offset of the song number in the player code
+const gbsTrackOffset = 0x155
+
+/*
+Build a cartridge running the rip: the code and data go to the load
+address, and the space below it gets a small player:
+
+	0000-0038  RST vectors, jump to the load address + vector
+	0040/0050  VBlank/timer interrupt: CALL play, RETI
+	0100       Entry point, jump to 0150
+	0150       DI, set SP, CALL init with A = song (0-based),
+	           set the timer and IE, EI, then HALT forever
+*/
+func gbsRom(data []byte, header *GBSHeader, track int) ([]byte, error) {
+	code := data[gbsHeaderSize:]
+	size := 0x8000
+	sizeCode := byte(0)
+	for size < int(header.Load)+len(code) {
+		size <<= 1
+		sizeCode++
+	}
+	if _, ok := RomBankMap[sizeCode]; !ok {
+		return nil, errors.New("GBS file too large")
+	}
+	rom := make([]byte, size)
+	copy(rom[header.Load:], code)
+
+	word := func(value uint16) []byte {
+		return []byte{byte(value), byte(value >> 8)}
+	}
+	for vector := uint16(0); vector <= 0x38; vector += 8 {
+		copy(rom[vector:], append([]byte{0xC3}, word(header.Load+vector)...))
+	}
+	for _, vector := range []int{0x48, 0x58, 0x60} {
+		rom[vector] = 0xD9
+	}
+	interrupt := byte(0x01)
+	vector := 0x40
+	if header.TAC&0x04 != 0 {
+		interrupt = 0x04
+		vector = 0x50
+	}
+	copy(rom[vector:], append(append([]byte{0xCD}, word(header.Play)...), 0xD9))
+
+	copy(rom[0x100:], []byte{0x00, 0xC3, 0x50, 0x01})
+	title := []byte(header.Title)
+	if len(title) > 15 {
+		title = title[:15]
+	}
+	copy(rom[0x134:], title)
+	rom[0x148] = sizeCode
+
+	player := []byte{0xF3, 0x31}
+	player = append(player, word(header.Stack)...)
+	player = append(player, 0x3E, byte(track-1), 0xCD)
+	player = append(player, word(header.Init)...)
+	player = append(player,
+		0x3E, header.TMA, 0xE0, 0x06,
+		0x3E, header.TAC&0x07, 0xE0, 0x07,
+		0x3E, interrupt, 0xE0, 0xFF,
+		0xAF, 0xE0, 0x0F,
+		0xFB,
+		0x76, 0x00, 0x18, 0xFC,
+	)
+	copy(rom[0x150:], player)
+	return rom, nil
+}
+
+/*
+Cartridge of a GBS rip. Writes to 2000-3FFF select the ROM bank at
+4000-7FFF, and the 8KB of RAM at A000-BFFF are always enabled.
+*/
+type MBCGBS struct {
+	rom            []byte
+	CurrentROMBank int
+	RAMBank        [0x2000]byte
+}
+
+func (mbc *MBCGBS) ReadRom(address uint16) byte {
+	return mbc.rom[address]
+}
+
+func (mbc *MBCGBS) ReadRomBank(address uint16) byte {
+	offset := mbc.CurrentROMBank*0x4000 + int(address-0x4000)
+	if offset >= len(mbc.rom) {
+		return 0xFF
+	}
+	return mbc.rom[offset]
+}
+
+func (mbc *MBCGBS) ReadRamBank(address uint16) byte {
+	return mbc.RAMBank[address-0xA000]
+}
+
+func (mbc *MBCGBS) WriteRamBank(address uint16, data byte) {
+	mbc.RAMBank[address-0xA000] = data
+}
+
+func (mbc *MBCGBS) HandleBanking(address uint16, val byte) {
+	if address >= 0x2000 && address < 0x4000 {
+		mbc.CurrentROMBank = int(val)
+		if mbc.CurrentROMBank == 0 {
+			mbc.CurrentROMBank = 1
+		}
+	}
+}
+
+// Nothing is saved for a rip
+func (mbc *MBCGBS) SaveRam(path string) {
+}
+
+// Load a GBS rip as the cartridge, playing the song core.GBSTrack
+func (core *Core) initGBS(data []byte) {
+	header, err := ParseGBS(data)
+	if err != nil {
+		log.Fatal("[Cartridge] ", err)
+	}
+	if core.GBSTrack < 1 || core.GBSTrack > header.Songs {
+		core.GBSTrack = header.FirstSong
+	}
+	rom, err := gbsRom(data, header, core.GBSTrack)
+	if err != nil {
+		log.Fatal("[Cartridge] ", err)
+	}
+	log.Printf("[Cartridge] GBS: %s - %s (%s), %d songs\n", header.Title, header.Author, header.Copyright, header.Songs)
+
+	core.GBS = header
+	core.GameTitle = header.Title
+	core.Cartridge.MBC = &MBCGBS{rom: rom, CurrentROMBank: 1}
+	core.Cartridge.Props = &CartridgeProps{
+		MBCType:      "GBS",
+		ROMLength:    len(rom),
+		ROMBank:      RomBankMap[rom[0x148]],
+		Colorization: Palettes[DefaultPalette],
+	}
+}
+
+/*
+Restart the GBS player with another song (1-based). The memory, CPU,
+timer and APU are reset like at power on, the sound output is kept.
+*/
+func (core *Core) SelectGBSTrack(track int) error {
+	if core.GBS == nil {
+		return errors.New("no GBS file loaded")
+	}
+	if track < 1 || track > core.GBS.Songs {
+		return fmt.Errorf("song %d out of 1-%d", track, core.GBS.Songs)
+	}
+	core.GBSTrack = track
+	mbc := core.Cartridge.MBC.(*MBCGBS)
+	mbc.rom[gbsTrackOffset] = byte(track - 1)
+	mbc.CurrentROMBank = 1
+	mbc.RAMBank = [0x2000]byte{}
+
+	core.resetMemory()
+	core.initCPU()
+	core.CPU.Halt = false
+	core.Timer.TimerCounter = 0
+	core.Timer.DividerRegister = 0
+	core.Sound.Reset()
+	log.Printf("[GBS] Song %d/%d\n", track, core.GBS.Songs)
+	return nil
+}
@@ -2,13 +2,19 @@ package gb
 
 import (
 	"github.com/HFO4/gbc-in-cloud/util"
-	"log"
 )
 
 /*
-	Draw the current scan line
+	Draw the current scan line, one dot of the pixel transfer (mode 3) at a time
 */
 func (core *Core) DrawScanLine() {
+	ppu := &core.PPU
+
+	// The pixel transfer is stalled by tile fetches which don't output pixels
+	if ppu.stall > 0 {
+		ppu.stall--
+		return
+	}
 
 	//	FF40 - LCDC - LCD Control (R/W)
 	//  	Bit 7 - LCD Display Enable             (0=Off, 1=On)
@@ -19,143 +25,301 @@ func (core *Core) DrawScanLine() {
 	//  	Bit 2 - OBJ (Sprite) Size              (0=8x8, 1=8x16)
 	//  	Bit 1 - OBJ (Sprite) Display Enable    (0=Off, 1=On)
 	//  	Bit 0 - BG Display (for CGB see below) (0=Off, 1=On)
-	control := core.ReadMemory(0xFF40)
+	control := core.Memory.MainMemory[0xFF40]
+
+	// Once the window is reached the fetcher restarts from the window tile map
+	if !ppu.windowActive && ppu.discard == 0 && core.windowStartsHere(control) {
+		core.startWindow()
+	}
+
+	core.RenderTiles()
+
+	if ppu.bgFIFO.size == 0 {
+		return
+	}
+
+	/*
+		A sprite starting at this position stalls the transfer while it
+		is fetched. It's checked once the fetcher had its dot, the FIFO
+		is refilled at the first pixel of every tile.
+	*/
+	if util.TestBit(control, 1) && ppu.discard == 0 {
+		if core.RenderSprites() {
+			return
+		}
+	}
+	pixel := ppu.bgFIFO.pop()
+
+	// SCX fine scroll, the first SCX%8 pixels of the line are not displayed
+	if ppu.discard > 0 {
+		ppu.discard--
+		return
+	}
+	core.mixPixel(pixel, control)
+}
+
+/*
+	Check whether the window starts at the current pixel of the line.
+
+	FF4A - WY - Window Y Position (R/W)
+	FF4B - WX - Window X Position minus 7 (R/W)
+		The window becomes visible (if enabled) when positions are set
+		in range WX=0..166, WY=0..143. A postion of WX=7, WY=0 locates
+		the window at upper left, it is then completly covering normal
+		background.
+
+	The window is only drawn on lines after WY matched LY at the start
+	of a line in the current frame. Changing WY afterwards doesn't hide
+	it again until the next frame.
+
+	WX values 0-6 start the window at the first pixel, with its leftmost
+	7-WX pixels cut off. WX=166 starts it at the last pixel, and on the
+	DMG the window then covers the whole next line as well.
+*/
+func (core *Core) windowStartsHere(control byte) bool {
+	if !util.TestBit(control, 5) || !core.PPU.windowYTriggered {
+		return false
+	}
+	windowX := int(core.Memory.MainMemory[0xFF4B]) - 7
+	if windowX < 0 {
+		windowX = 0
+	}
+	return core.PPU.LX == windowX
+}
+
+/*
+	Switch the fetcher to the window for the rest of the line
+*/
+func (core *Core) startWindow() {
+	ppu := &core.PPU
+	ppu.windowActive = true
+	ppu.bgFIFO.clear()
+	ppu.fetcher.reset(true)
+
+	windowX := core.Memory.MainMemory[0xFF4B]
+	if windowX < 7 {
+		ppu.discard = int(7 - windowX)
+	}
+	if windowX == 166 {
+		ppu.windowWrap = true
+	}
+}
+
+/*
+	Mix the background pixel with the sprite FIFO and send it to the LCD
+*/
+func (core *Core) mixPixel(bg fifoPixel, control byte) {
+	ppu := &core.PPU
+	x := ppu.LX
+	y := int(core.Memory.MainMemory[0xFF44])
 
 	//	LCDC.0 - 1) Monochrome Gameboy and SGB: BG Display
 	//	When Bit 0 is cleared, the background becomes blank (white).
 	//	Window and Sprites may still be displayed (if enabled in Bit 1 and/or Bit 5).
-	if util.TestBit(control, 0) {
-		core.RenderTiles()
+	colourNum := bg.colour
+	if !util.TestBit(control, 0) {
+		colourNum = 0
+	}
+	// A disabled layer is drawn as colour 0, so no sprite hides behind it
+	if (ppu.windowActive && core.DisabledLayers.Window) || (!ppu.windowActive && core.DisabledLayers.Background) {
+		colourNum = 0
+	}
+	palette := bg.palette
+	shade := core.GetColour(colourNum, palette)
+
+	// Store whether the background uses colour number 0. The BG-over-OBJ
+	// attribute only hides sprites behind colours 1-3, whatever BGP maps
+	// them to.
+	core.ScanLineBG[x] = colourNum == 0
+
+	if ppu.objFIFO.size > 0 {
+		sprite := ppu.objFIFO.pop()
+		// colour number 0 is transparent for sprites.
+		if sprite.colour != 0 && util.TestBit(control, 1) && !core.DisabledLayers.Sprites {
+			if core.ScanLineBG[x] || !sprite.bgPriority {
+				palette = sprite.palette
+				shade = core.GetColour(sprite.colour, palette)
+			}
+		}
+	}
+
+	core.setPixel(x, y, palette, shade)
+	ppu.LX++
+}
+
+/*
+	Write a pixel to the screen buffer
+*/
+func (core *Core) setPixel(x int, y int, palette uint16, shade int) {
+	// safety check to make sure what im about
+	// to set is int the 160x144 bounds
+	if x < 0 || x > 159 || y < 0 || y > 143 {
+		return
 	}
+	core.Shades[x][y] = uint8(shade)
 
-	if util.TestBit(control, 1) {
-		core.RenderSprites()
+	// The Super Game Boy colours the screen by 8x8 cells, MASK_EN can freeze it
+	if core.SGB.Enabled {
+		if core.SGB.mask != 1 {
+			core.Screen[x][y] = core.SGB.colour(x, y, byte(shade))
+		}
+		return
 	}
+	core.Screen[x][y] = core.Palette.Colour(palette, shade)
 }
 
 /*
-	Render Sprites
+	Search the OAM for sprites on the current line (mode 2).
+
+	Only the Y coordinate is checked, the first 10 sprites in OAM order
+	which intersect the line are selected, even the ones hidden by an
+	X coordinate of 0 or >=168. The rest of the sprites on the line are
+	not displayed.
+
+	The selected sprites are sorted by X coordinate, then by OAM index.
+	The sprites are fetched into the sprite FIFO in this order and
+	opaque pixels already in the FIFO are never replaced, which gives
+	the DMG priority: the sprite with the smaller X coordinate is drawn
+	above, and the first one in OAM wins if X is equal.
 */
-func (core *Core) RenderSprites() {
-	use8x16 := false
-	lcdControl := core.ReadMemory(0xFF40)
+func (core *Core) searchOAM() {
+	ppu := &core.PPU
+	ppu.spriteCount = 0
 
-	if util.TestBit(lcdControl, 2) {
-		use8x16 = true
+	ysize := 8
+	if util.TestBit(core.Memory.MainMemory[0xFF40], 2) {
+		ysize = 16
 	}
-	for sprite := 0; sprite < 40; sprite++ {
+	scanline := int(core.Memory.MainMemory[0xFF44])
+
+	for sprite := 0; sprite < 40 && ppu.spriteCount < 10; sprite++ {
 		// sprite occupies 4 bytes in the sprite attributes table
-		index := sprite * 4
-		yPos := core.ReadMemory(0xFE00+uint16(index)) - 16
-		xPos := core.ReadMemory(0xFE00+uint16(index)+1) - 8
-		tileLocation := core.ReadMemory(uint16(0xFE00 + index + 2))
-		attributes := core.ReadMemory(0xFE00 + uint16(index) + 3)
+		index := 0xFE00 + sprite*4
+		yPos := int(core.Memory.MainMemory[index]) - 16
 
-		yFlip := util.TestBit(attributes, 6)
-		xFlip := util.TestBit(attributes, 5)
-		priority := !util.TestBit(attributes, 7)
-		scanline := core.ReadMemory(0xFF44)
+		// does this sprite intercept with the scanline?
+		if scanline >= yPos && scanline < yPos+ysize {
+			ppu.lineSprites[ppu.spriteCount] = spriteEntry{
+				y:     core.Memory.MainMemory[index],
+				x:     core.Memory.MainMemory[index+1],
+				index: sprite,
+			}
+			ppu.spriteCount++
+		}
+	}
+
+	// Stable insertion sort by X, the OAM order is kept for equal X
+	for i := 1; i < ppu.spriteCount; i++ {
+		for j := i; j > 0 && ppu.lineSprites[j].x < ppu.lineSprites[j-1].x; j-- {
+			ppu.lineSprites[j], ppu.lineSprites[j-1] = ppu.lineSprites[j-1], ppu.lineSprites[j]
+		}
+	}
+}
+
+/*
+	Fetch the next sprite which starts at the current pixel into the sprite FIFO.
+	Returns whether a sprite was fetched.
+*/
+func (core *Core) RenderSprites() bool {
+	ppu := &core.PPU
+
+	for i := 0; i < ppu.spriteCount; i++ {
+		sprite := &ppu.lineSprites[i]
+		xPos := int(sprite.x) - 8
+		if sprite.fetched || xPos > ppu.LX {
+			continue
+		}
+		sprite.fetched = true
 
 		ysize := 8
-		if use8x16 {
+		if util.TestBit(core.Memory.MainMemory[0xFF40], 2) {
 			ysize = 16
 		}
+		index := 0xFE00 + sprite.index*4
+		tileLocation := core.Memory.MainMemory[index+2]
+		attributes := core.Memory.MainMemory[index+3]
+
+		// In 8x16 mode the lower bit of the tile number is ignored,
+		// the upper 8x8 tile is "NN AND FEh", the lower one "NN OR 01h".
+		if ysize == 16 {
+			tileLocation &= 0xFE
+		}
 
-		// does this sprite intercept with the scanline?
-		if (scanline >= yPos) && (scanline < (yPos + byte(ysize))) {
-			line := int(scanline - yPos)
-			// read the sprite in backwards in the y axis
-			if yFlip {
-				line -= ysize
-				line *= -1
+		yFlip := util.TestBit(attributes, 6)
+		xFlip := util.TestBit(attributes, 5)
+		colourAddress := uint16(0xFF48)
+		if util.TestBit(attributes, 4) {
+			colourAddress = 0xFF49
+		}
+
+		line := int(core.Memory.MainMemory[0xFF44]) - (int(sprite.y) - 16)
+		// read the sprite in backwards in the y axis
+		if yFlip {
+			line = ysize - 1 - line
+		}
+		dataAddress := 0x8000 + int(tileLocation)*16 + line*2
+		data1 := core.Memory.MainMemory[dataAddress]
+		data2 := core.Memory.MainMemory[dataAddress+1]
+
+		for tilePixel := 0; tilePixel < 8; tilePixel++ {
+			// Pixels left of the current position are already gone
+			slot := xPos + tilePixel - ppu.LX
+			if slot < 0 {
+				continue
 			}
-			line *= 2 // same as for tiles
-			dataAddress := (uint16(int(tileLocation)*16 + line))
-			data1 := core.ReadMemory(0x8000 + dataAddress)
-			data2 := core.ReadMemory(0x8000 + dataAddress + 1)
-
-			// its easier to read in from right to left as pixel 0 is
-			// bit 7 in the colour data, pixel 1 is bit 6 etc...
-			for tilePixel := 7; tilePixel >= 0; tilePixel-- {
-				colourbit := tilePixel
-
-				// read the sprite in backwards for the x axis
-				if xFlip {
-					colourbit -= 7
-					colourbit *= -1
-				}
-
-				colourNum := util.GetVal(data2, uint(colourbit))
-				colourNum <<= 1
-				colourNum |= util.GetVal(data1, uint(colourbit))
-				colourAddress := uint16(0xFF48)
-				if util.TestBit(attributes, 4) {
-					colourAddress = 0xFF49
-				}
-				// now we have the colour id get the actual
-				// colour from palette 0xFF47
-				colour := core.GetColour(colourNum, colourAddress)
-
-				// white is transparent for sprites.
-				if colourNum == 0 {
-					continue
-				}
-
-				red := uint8(0)
-				green := uint8(0)
-				blue := uint8(0)
-
-				switch colour {
-				case 0:
-					red = 255
-					green = 255
-					blue = 255
-				case 1:
-					red = 0xCC
-					green = 0xCC
-					blue = 0xCC
-				case 2:
-					red = 0x77
-					green = 0x77
-					blue = 0x77
-				default:
-					red = 0
-					green = 0
-					blue = 0
-				}
-
-				xPix := 0 - tilePixel
-				xPix += 7
-
-				pixel := int(xPos) + xPix
-
-				// sanity check
-				if (scanline < 0) || (scanline > 143) || (pixel < 0) || (pixel > 159) {
-					continue
-				}
-
-				if core.ScanLineBG[pixel] || priority {
-					core.Screen[pixel][scanline][0] = red
-					core.Screen[pixel][scanline][1] = green
-					core.Screen[pixel][scanline][2] = blue
-				}
 
+			// pixel 0 is bit 7 in the colour data, pixel 1 is bit 6 etc...
+			colourBit := uint(7 - tilePixel)
+			// read the sprite in backwards for the x axis
+			if xFlip {
+				colourBit = uint(tilePixel)
+			}
+			pixel := fifoPixel{
+				colour:     util.GetVal(data2, colourBit)<<1 | util.GetVal(data1, colourBit),
+				palette:    colourAddress,
+				bgPriority: util.TestBit(attributes, 7),
+			}
+
+			// Sprites already in the FIFO keep their opaque pixels
+			for ppu.objFIFO.size <= slot {
+				ppu.objFIFO.push(fifoPixel{})
+			}
+			if ppu.objFIFO.at(slot).colour == 0 {
+				*ppu.objFIFO.at(slot) = pixel
 			}
 		}
 
+		/*
+			Sprite fetch penalty: 6 dots, plus the dots waiting for the
+			background fetcher to finish the tile it is working on. The
+			wait is only paid once per background tile.
+		*/
+		ppu.stall = 5
+		tile := (ppu.LX + int(core.Memory.MainMemory[0xFF43])) / 8
+		if tile != ppu.penaltyTile {
+			ppu.penaltyTile = tile
+			if wait := 5 - (ppu.LX+int(core.Memory.MainMemory[0xFF43]))%8; wait > 0 {
+				ppu.stall += wait
+			}
+		}
+		return true
 	}
+	return false
 }
 
-var last uint16
-
 /*
-	Render Tiles for the current scan line
+	Advance the background/window tile fetcher by one dot
 */
 func (core *Core) RenderTiles() {
-	var tileData uint16 = 0
-	var backgroundMemory uint16 = 0
-	var unsig bool = true
-	lcdControl := core.ReadMemory(0xFF40)
+	ppu := &core.PPU
+	fetcher := &ppu.fetcher
+	lcdControl := core.Memory.MainMemory[0xFF40]
+
+	fetcher.dots++
+	if fetcher.step != fetchPush && fetcher.dots < 2 {
+		return
+	}
+	fetcher.dots = 0
 
 	//	FF42 - SCY - Scroll Y (R/W)
 	//	FF43 - SCX - Scroll X (R/W)
@@ -165,179 +329,72 @@ func (core *Core) RenderTiles() {
 	//		controller automatically wraps back to the upper (left) position
 	//		in BG map when drawing exceeds the lower (right) border of the BG
 	//		map area.
-	scrollY := core.ReadMemory(0xFF42)
-	scrollX := core.ReadMemory(0xFF43)
-
-	//	FF4A - WY - Window Y Position (R/W)
-	//	FF4B - WX - Window X Position minus 7 (R/W)
-	//		Specifies the upper/left positions of the Window area.
-	//		(The window is an alternate background area which can be
-	//		displayed above of the normal background. OBJs (sprites)
-	//		may be still displayed above or behinf the window, just as
-	//		for normal BG.)
-	//
-	//		The window becomes visible (if enabled) when positions are set
-	//		in range WX=0..166, WY=0..143. A postion of WX=7, WY=0 locates
-	//		the window at upper left, it is then completly covering normal
-	//		background.
-	windowY := core.ReadMemory(0xFF4A)
-	windowX := core.ReadMemory(0xFF4B) - 7
-
-	usingWindow := false
-
-	// is the window enabled?
-	if util.TestBit(lcdControl, 5) {
-
-		// is the current scan line we're drawing
-		// within the windows Y pos?,
-		if windowY <= core.ReadMemory(0xFF44) {
-			usingWindow = true
-		}
-	}
-
-	// which tile data are we using?
-	if util.TestBit(lcdControl, 4) {
-		tileData = 0x8000
-	} else {
-		// IMPORTANT: This memory region uses signed
-		// bytes as tile identifiers
-		tileData = 0x8800
-		unsig = false
-	}
-
-	// which background mem?
-	if !usingWindow {
-		if util.TestBit(lcdControl, 3) {
-			backgroundMemory = 0x9C00
-		} else {
-			backgroundMemory = 0x9800
-		}
-	} else {
-		if util.TestBit(lcdControl, 6) {
-			backgroundMemory = 0x9C00
-		} else {
-			backgroundMemory = 0x9800
-		}
-	}
+	scanline := core.Memory.MainMemory[0xFF44]
 
-	// yPos is used to calculate which of 32 vertical tiles the
-	// current scanline is drawing
-	var yPos byte = 0
-	if !usingWindow {
-		yPos = scrollY + core.ReadMemory(0xFF44)
+	// yPos is the line inside the 256x256 map being drawn
+	var yPos byte
+	if fetcher.window {
+		yPos = byte(ppu.WindowLine)
 	} else {
-		yPos = core.ReadMemory(0xFF44) - windowY
+		yPos = core.Memory.MainMemory[0xFF42] + scanline
 	}
 
-	// which of the 8 vertical pixels of the current
-	// tile is the scanline on?
-	var tileRow = ((uint16(yPos / 8)) * 32)
-
-	// time to start drawing the 160 horizontal pixels
-	// for this scanline
-	for pixel := byte(0); pixel < 160; pixel++ {
-
-		xPos := byte(pixel) + scrollX
-
-		// translate the current x pos to window space if necessary
-		if usingWindow {
-			if pixel >= windowX {
-				xPos = pixel - windowX
+	switch fetcher.step {
+	case fetchTileNumber:
+		// which background mem?
+		var backgroundMemory uint16 = 0x9800
+		var tileCol byte
+		if fetcher.window {
+			if util.TestBit(lcdControl, 6) {
+				backgroundMemory = 0x9C00
 			}
-		}
-
-		// which of the 32 horizontal tiles does this xPos fall within?
-		tileCol := uint16(xPos / 8)
-		var tileNum int16
-
-		// get the tile identity number. Remember it can be signed
-		// or unsigned
-		tileAddress := backgroundMemory + tileRow + tileCol
-		if unsig {
-			tileNum = int16(core.ReadMemory(tileAddress))
+			tileCol = fetcher.tileX
 		} else {
-			tileNum = int16(int8(core.ReadMemory(tileAddress)))
+			if util.TestBit(lcdControl, 3) {
+				backgroundMemory = 0x9C00
+			}
+			tileCol = core.Memory.MainMemory[0xFF43]/8 + fetcher.tileX
 		}
-
-		// deduce where this tile identifier is in memory.
-		tileLocation := tileData
-		if unsig {
-			tileLocation += uint16(tileNum * 16)
-		} else {
-			tileLocation = uint16(int32(tileLocation) + int32((tileNum+128)*16))
+		tileAddress := backgroundMemory + uint16(yPos/8)*32 + uint16(tileCol&31)
+		fetcher.tileNumber = core.Memory.MainMemory[tileAddress]
+		fetcher.step = fetchTileDataLow
+	case fetchTileDataLow:
+		fetcher.dataLow = core.Memory.MainMemory[core.tileDataAddress(fetcher.tileNumber, yPos)]
+		fetcher.step = fetchTileDataHigh
+	case fetchTileDataHigh:
+		fetcher.dataHigh = core.Memory.MainMemory[core.tileDataAddress(fetcher.tileNumber, yPos)+1]
+		fetcher.step = fetchPush
+	case fetchPush:
+		if ppu.bgFIFO.size > 0 {
+			return
 		}
-
-		// find the correct vertical line we're on of the
-		// tile to get the tile data
-		//	from in memory
-		line := yPos % 8
-		// each vertical line takes up two bytes of memory
-		line *= 2
-		data1 := core.ReadMemory(tileLocation + uint16(line))
-		data2 := core.ReadMemory(tileLocation + uint16(line) + 1)
-		if last == 0x86F0 && (tileLocation+uint16(line) == 0x8000) {
-			log.Printf("%X\n", tileNum)
-
-		}
-		last = tileLocation + uint16(line)
-
-		// pixel 0 in the tile is it 7 of data 1 and data2.
+		// pixel 0 in the tile is bit 7 of data 1 and data2.
 		// Pixel 1 is bit 6 etc..
-		var colourBit int = int(xPos % 8)
-		colourBit -= 7
-		colourBit *= -1
-
-		// combine data 2 and data 1 to get the colour id for this pixel
-		// in the tile
-		colourNum := util.GetVal(data2, uint(colourBit))
-		colourNum <<= 1
-		colourNum |= util.GetVal(data1, uint(colourBit))
-
-		// now we have the colour id get the actual
-		// colour from palette 0xFF47
-		colour := core.GetColour(colourNum, 0xFF47)
-
-		red := uint8(0)
-		green := uint8(0)
-		blue := uint8(0)
-
-		switch colour {
-		case 0:
-			red = 255
-			green = 255
-			blue = 255
-		case 1:
-			red = 0xCC
-			green = 0xCC
-			blue = 0xCC
-		case 2:
-			red = 0x77
-			green = 0x77
-			blue = 0x77
-		default:
-			red = 0
-			green = 0
-			blue = 0
-		}
-		finally := int(core.ReadMemory(0xFF44))
-		// safety check to make sure what im about
-		// to set is int the 160x144 bounds
-		if (finally < 0) || (finally > 143) || (pixel < 0) || (pixel > 159) {
-			continue
+		for colourBit := 7; colourBit >= 0; colourBit-- {
+			ppu.bgFIFO.push(fifoPixel{
+				colour:  util.GetVal(fetcher.dataHigh, uint(colourBit))<<1 | util.GetVal(fetcher.dataLow, uint(colourBit)),
+				palette: 0xFF47,
+			})
 		}
+		fetcher.tileX++
+		fetcher.step = fetchTileNumber
+	}
+}
 
-		// Store whether the background is white
-		if colour == 0 {
-			core.ScanLineBG[pixel] = true
-		} else {
-			core.ScanLineBG[pixel] = false
-		}
+/*
+	Get the address of the row of a background/window tile
+*/
+func (core *Core) tileDataAddress(tileNum byte, yPos byte) uint16 {
+	// each vertical line takes up two bytes of memory
+	line := uint16(yPos%8) * 2
 
-		core.Screen[pixel][finally][0] = red
-		core.Screen[pixel][finally][1] = green
-		core.Screen[pixel][finally][2] = blue
+	// which tile data are we using?
+	if util.TestBit(core.Memory.MainMemory[0xFF40], 4) {
+		return 0x8000 + uint16(tileNum)*16 + line
 	}
-
+	// IMPORTANT: This memory region uses signed
+	// bytes as tile identifiers
+	return uint16(0x9000+int(int8(tileNum))*16) + line
 }
 
 /*
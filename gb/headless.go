@@ -0,0 +1,17 @@
+package gb
+
+/*
+Emulate the given number of frames as fast as possible, without
+real-time pacing and without signalling the display driver.
+Used to render games headlessly, e.g. for regression fixtures.
+
+If the LCD stays disabled no frame is ever completed, the emulation
+then stops after the CPU time of the requested frames has passed.
+*/
+func (core *Core) RunFrames(frames int) {
+	target := core.PPU.Frames + frames
+	cyclesLeft := frames * 70224 * 2
+	for core.PPU.Frames < target && cyclesLeft > 0 {
+		cyclesLeft -= core.Step()
+	}
+}
@@ -0,0 +1,158 @@
+package gb
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+
+	"github.com/HFO4/gbc-in-cloud/util"
+)
+
+/*
+Inspection of the video memory, for debugging games. VRAM and OAM are
+read directly, whatever the PPU is doing.
+*/
+
+// Colour number (0-3) of a pixel of a tile, addressed from the start of its line
+func (core *Core) tilePixel(lineAddress uint16, x int) byte {
+	low := core.Memory.MainMemory[lineAddress]
+	high := core.Memory.MainMemory[lineAddress+1]
+	bit := uint(7 - x)
+	return (high>>bit&1)<<1 | low>>bit&1
+}
+
+// Colour of a colour number drawn with BGP
+func (core *Core) backgroundColour(colourNum byte) color.RGBA {
+	colour := core.Palette.BG[core.GetColour(colourNum, 0xFF47)]
+	return color.RGBA{R: colour[0], G: colour[1], B: colour[2], A: 0xFF}
+}
+
+/*
+Render the 384 tiles of 8000h-97FFh, 16 tiles per row, with the
+background palette.
+*/
+func (core *Core) TileSheet() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 16*8, 24*8))
+	for tile := 0; tile < 384; tile++ {
+		for y := 0; y < 8; y++ {
+			address := uint16(0x8000 + tile*16 + y*2)
+			for x := 0; x < 8; x++ {
+				img.SetRGBA(tile%16*8+x, tile/16*8+y, core.backgroundColour(core.tilePixel(address, x)))
+			}
+		}
+	}
+	return img
+}
+
+/*
+Render one of the two 32x32 tile maps (0 - 9800h, 1 - 9C00h) with the
+tile data selected in LCDC. The 160x144 area shown by SCX/SCY is
+outlined in red, wrapping around the edges of the map.
+*/
+func (core *Core) TileMap(index int) *image.RGBA {
+	base := uint16(0x9800)
+	if index == 1 {
+		base = 0x9C00
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for y := 0; y < 256; y++ {
+		for x := 0; x < 256; x++ {
+			tileNum := core.Memory.MainMemory[base+uint16(y/8*32+x/8)]
+			address := core.tileDataAddress(tileNum, byte(y))
+			img.SetRGBA(x, y, core.backgroundColour(core.tilePixel(address, x%8)))
+		}
+	}
+
+	outline := color.RGBA{R: 0xFF, A: 0xFF}
+	scrollX := int(core.Memory.MainMemory[0xFF43])
+	scrollY := int(core.Memory.MainMemory[0xFF42])
+	for x := 0; x < 160; x++ {
+		img.SetRGBA((scrollX+x)%256, scrollY, outline)
+		img.SetRGBA((scrollX+x)%256, (scrollY+143)%256, outline)
+	}
+	for y := 0; y < 144; y++ {
+		img.SetRGBA(scrollX, (scrollY+y)%256, outline)
+		img.SetRGBA((scrollX+159)%256, (scrollY+y)%256, outline)
+	}
+	return img
+}
+
+/*
+A decoded OAM entry. X and Y are screen coordinates, the OAM stores
+them offset by 8 and 16.
+*/
+type OAMEntry struct {
+	Index int
+	X     int
+	Y     int
+	Tile  byte
+	// OBJ-to-BG priority, the sprite is behind BG colours 1-3
+	BehindBG bool
+	YFlip    bool
+	XFlip    bool
+	// Palette register, OBP0 or OBP1
+	Palette string
+	// The sprite intersects the visible screen
+	Visible bool
+}
+
+/*
+Decode the 40 entries of the sprite attribute table (FE00h-FE9Fh).
+*/
+func (core *Core) OAMEntries() []OAMEntry {
+	ysize := 8
+	if util.TestBit(core.Memory.MainMemory[0xFF40], 2) {
+		ysize = 16
+	}
+
+	entries := make([]OAMEntry, 40)
+	for i := range entries {
+		address := 0xFE00 + i*4
+		attributes := core.Memory.MainMemory[address+3]
+		entry := OAMEntry{
+			Index:    i,
+			Y:        int(core.Memory.MainMemory[address]) - 16,
+			X:        int(core.Memory.MainMemory[address+1]) - 8,
+			Tile:     core.Memory.MainMemory[address+2],
+			BehindBG: util.TestBit(attributes, 7),
+			YFlip:    util.TestBit(attributes, 6),
+			XFlip:    util.TestBit(attributes, 5),
+			Palette:  "OBP0",
+		}
+		if util.TestBit(attributes, 4) {
+			entry.Palette = "OBP1"
+		}
+		entry.Visible = entry.X > -8 && entry.X < 160 && entry.Y > -ysize && entry.Y < 144
+		entries[i] = entry
+	}
+	return entries
+}
+
+/*
+A DMG palette register: the shade each colour number is mapped to and
+the colour the shade is displayed with.
+*/
+type PaletteRegister struct {
+	Value   byte
+	Shades  [4]int
+	Colours [4]string
+}
+
+/*
+The current BGP, OBP0 and OBP1 palettes.
+*/
+func (core *Core) PaletteRegisters() map[string]PaletteRegister {
+	registers := map[string]PaletteRegister{}
+	for name, address := range map[string]uint16{"BGP": 0xFF47, "OBP0": 0xFF48, "OBP1": 0xFF49} {
+		register := PaletteRegister{Value: core.Memory.MainMemory[address]}
+		for colourNum := range register.Shades {
+			shade := core.GetColour(byte(colourNum), address)
+			colour := core.Palette.Colour(address, shade)
+			register.Shades[colourNum] = shade
+			register.Colours[colourNum] = fmt.Sprintf("#%02x%02x%02x", colour[0], colour[1], colour[2])
+		}
+		registers[name] = register
+	}
+	return registers
+}
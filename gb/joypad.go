@@ -1,21 +1,92 @@
 package gb
 
-import "github.com/HFO4/gbc-in-cloud/util"
+import (
+	"github.com/HFO4/gbc-in-cloud/driver"
+	"github.com/HFO4/gbc-in-cloud/util"
+)
 
 func (core *Core) GetJoypadStatus() byte {
 	res := core.Memory.MainMemory[0xFF00]
+	buttons := core.JoypadStatus
+
+	// SGB multiplayer, see MLT_REQ
+	if core.SGB.Enabled && core.SGB.players > 1 {
+		var id int
+		buttons, id = core.SGB.selectedJoypad(buttons)
+		if res&0x30 == 0x30 {
+			return res&0xF0 | byte(0x0F-id)
+		}
+	}
+
 	// flip all the bits
 	res ^= 0xFF
 
 	// are we interested in the standard buttons?
 	if !util.TestBit(res, 4) {
-		topJoypad := core.JoypadStatus >> 4
+		topJoypad := buttons >> 4
 		topJoypad |= 0xF0 // turn the top 4 bits on
 		res &= topJoypad  // show what buttons are pressed
 	} else if !util.TestBit(res, 5) {
-		bottomJoypad := core.JoypadStatus & 0xF
+		bottomJoypad := buttons & 0xF
 		bottomJoypad |= 0xF0
 		res &= bottomJoypad
 	}
 	return res
 }
+
+/*
+Apply the input events of the controller, once a frame. A button
+pressed and released within a frame is released at the next one, so
+the game sees even the shortest taps.
+*/
+func (core *Core) pollInput() {
+	core.pendingInput = append(core.pendingInput, core.Controller.PollEvents()...)
+	// Buttons of all the players, see driver.PlayerButton
+	var pressed uint32
+	for i, event := range core.pendingInput {
+		bit := uint32(1) << uint(event.Button)
+		if !event.Pressed && pressed&bit != 0 {
+			core.pendingInput = append(core.pendingInput[:0], core.pendingInput[i:]...)
+			return
+		}
+		core.setButton(event.Button, event.Pressed)
+		if event.Pressed {
+			pressed |= bit
+		}
+	}
+	core.pendingInput = core.pendingInput[:0]
+}
+
+// Press or release a button of the joypad, or of the joypad of another SGB player
+func (core *Core) setButton(button driver.Button, pressed bool) {
+	lines := core.joypadLines()
+	status := &core.JoypadStatus
+	if player := button.Player(); player > 1 {
+		status = &core.SGB.Joypads[player-2]
+	}
+	if pressed {
+		*status = util.ClearBit(*status, button.Bit())
+	} else {
+		*status = util.SetBit(*status, button.Bit())
+	}
+	core.joypadEdge(lines)
+}
+
+// Input lines P10-P13, as read in the low bits of FF00, high when no row is selected
+func (core *Core) joypadLines() byte {
+	// The SGB puts the joypad ID there, it's no input
+	if core.Memory.MainMemory[0xFF00]&0x30 == 0x30 {
+		return 0x0F
+	}
+	return core.GetJoypadStatus() & 0x0F
+}
+
+/*
+The joypad interrupt is requested when an input line goes from high to
+low, only for the buttons of the selected rows.
+*/
+func (core *Core) joypadEdge(lines byte) {
+	if lines&^core.joypadLines() != 0 {
+		core.RequestInterrupt(4)
+	}
+}
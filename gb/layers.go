@@ -0,0 +1,58 @@
+package gb
+
+import (
+	"fmt"
+	"log"
+)
+
+/*
+Layers of the picture, used to turn them off for debugging. This is
+independent from LCDC: a layer the game enables is still hidden when
+it's turned off here, and the pixel transfer keeps its timing.
+*/
+type Layers struct {
+	Background bool
+	Window     bool
+	Sprites    bool
+}
+
+// The switch of a layer by name: bg, window or sprites
+func (layers *Layers) byName(name string) (*bool, error) {
+	switch name {
+	case "bg", "background":
+		return &layers.Background, nil
+	case "window":
+		return &layers.Window, nil
+	case "sprites", "obj":
+		return &layers.Sprites, nil
+	}
+	return nil, fmt.Errorf("unknown layer %q", name)
+}
+
+/*
+Switch one of the layers (bg, window or sprites) on or off, returns
+whether the layer is now drawn. Like SetLayer, it's called from the
+goroutine of the emulation, see Schedule.
+*/
+func (core *Core) ToggleLayer(name string) (bool, error) {
+	layer, err := core.DisabledLayers.byName(name)
+	if err != nil {
+		return false, err
+	}
+	return !*layer, core.SetLayer(name, !*layer)
+}
+
+// Turn one of the layers (bg, window or sprites) off, or back on
+func (core *Core) SetLayer(name string, disabled bool) error {
+	layer, err := core.DisabledLayers.byName(name)
+	if err != nil {
+		return err
+	}
+	*layer = disabled
+	if disabled {
+		log.Printf("[Display] Layer %s turned off\n", name)
+	} else {
+		log.Printf("[Display] Layer %s turned on\n", name)
+	}
+	return nil
+}
@@ -45,69 +45,32 @@ The Mode Flag goes through the values 0, 2, and 3 at a cycle of about 109uS. 0 i
 Mode 0 is present between 201-207 clks, 2 about 77-83 clks, and 3 about 169-175 clks. A complete cycle through these states takes 456 clks. VBlank lasts 4560 clks. A complete screen refresh occurs every 70224 clks.)
 */
 func (core *Core) SetLCDStatus() {
-	status := core.ReadMemory(0xFF41)
-	if !core.IsLCDEnabled() {
-		// set the mode to 1 during lcd disabled and reset scanline
-		core.Timer.ScanlineCounter = 456
-		core.Memory.MainMemory[0xFF44] = 0
-		status &= 252
-		status = util.ClearBit(status, 0)
-		status = util.ClearBit(status, 1)
-		core.WriteMemory(0xFF41, status)
-		return
-	}
-
-	currentLine := core.ReadMemory(0xFF44)
-	currentMode := status & 0x3
-	mode := byte(0)
-	reqInt := false
-
-	// in vblank so set mode to 1
-	if currentLine >= 144 {
-		mode = 1
-		status = util.SetBit(status, 0)
-		status = util.ClearBit(status, 1)
-		reqInt = util.TestBit(status, 4)
-	} else {
-		mode2bounds := 456 - 80
-		mode3bounds := mode2bounds - 172
-
-		// mode 2
-		if core.Timer.ScanlineCounter >= mode2bounds {
-			mode = 2
-			status = util.SetBit(status, 1)
-			status = util.ClearBit(status, 0)
-			reqInt = util.TestBit(status, 5)
-		} else if core.Timer.ScanlineCounter >= mode3bounds {
-			mode = 3
-			// mode 3
-			status = util.SetBit(status, 1)
-			status = util.SetBit(status, 0)
-		} else {
-			// mode 0
-			mode = 0
-			status = util.ClearBit(status, 1)
-			status = util.ClearBit(status, 0)
-			reqInt = util.TestBit(status, 3)
-		}
-	}
-
-	// just entered a new mode so request interupt
-	if reqInt && (mode != currentMode) {
-		core.RequestInterrupt(1)
-	}
+	status := core.Memory.MainMemory[0xFF41]
+	status = status&0xF8 | core.PPU.Mode
 
 	// check the conincidence flag
-	if currentLine == core.ReadMemory(0xFF45) {
+	coincidence := core.Memory.MainMemory[0xFF44] == core.Memory.MainMemory[0xFF45]
+	if coincidence {
 		status = util.SetBit(status, 2)
-		if util.TestBit(status, 6) {
-			core.RequestInterrupt(1)
-		}
 	} else {
 		status = util.ClearBit(status, 2)
 	}
-	core.WriteMemory(0xFF41, status)
-
+	core.Memory.MainMemory[0xFF41] = status
+
+	/*
+		All STAT interrupt sources are ORed into a single interrupt line,
+		the interrupt is only requested when the line goes from low to high.
+		So entering H-Blank right after a LYC match on the same line will
+		not request a second interrupt.
+	*/
+	line := (coincidence && util.TestBit(status, 6)) ||
+		(core.PPU.Mode == 0 && util.TestBit(status, 3)) ||
+		(core.PPU.Mode == 1 && util.TestBit(status, 4)) ||
+		(core.PPU.Mode == 2 && util.TestBit(status, 5))
+	if line && !core.PPU.statLine {
+		core.RequestInterrupt(1)
+	}
+	core.PPU.statLine = line
 }
 
 /*
@@ -118,42 +81,144 @@ func (core *Core) IsLCDEnabled() bool {
 }
 
 /*
-	Scan line and draw line
+	Check whether the CPU can access the display RAM (8000h-9FFFh)
 */
-func (core *Core) UpdateGraphics(cycles int) {
-	//Set the LCD status register
-	core.SetLCDStatus()
+func (core *Core) isVRAMAccessible() bool {
+	return core.PPU.off || core.PPU.Mode != 3
+}
 
-	//A complete cycle through Scan Line states takes 456 clks.
-	//We use a counter to mark this.
-	if core.IsLCDEnabled() {
-		core.Timer.ScanlineCounter -= cycles
-	} else {
+/*
+	Check whether the CPU can access OAM (FE00h-FE9Fh)
+*/
+func (core *Core) isOAMAccessible() bool {
+	return core.PPU.off || core.PPU.Mode < 2
+}
+
+/*
+	Advance the PPU by the given CPU clocks
+*/
+func (core *Core) UpdateGraphics(cycles int) {
+	if !core.IsLCDEnabled() {
+		// LY is reset and the mode is 0 while the lcd is disabled
+		if !core.PPU.off {
+			core.PPU.off = true
+			core.PPU.Dot = 0
+			core.PPU.Mode = 0
+			core.Memory.MainMemory[0xFF44] = 0
+			core.SetLCDStatus()
+		}
 		return
 	}
 
-	if core.Timer.ScanlineCounter <= 0 {
-		// time to move onto next scanline
-		core.Memory.MainMemory[0xFF44]++
+	// The display restarts from the beginning of the first line
+	if core.PPU.off {
+		core.PPU.off = false
+		core.setMode(2)
+	}
 
-		currentLine := core.ReadMemory(0xFF44)
+	for i := 0; i < cycles; i++ {
+		core.stepPPU()
+	}
+}
 
-		//Reset the counter
-		core.Timer.ScanlineCounter += 456
+/*
+	Advance the PPU by a single dot
+*/
+func (core *Core) stepPPU() {
+	ppu := &core.PPU
+	switch ppu.Mode {
+	case 2:
+		// OAM search is done in the last dot of mode 2
+		if ppu.Dot == 79 {
+			core.searchOAM()
+			core.setMode(3)
+		}
+	case 3:
+		core.DrawScanLine()
+		if ppu.LX == 160 {
+			core.setMode(0)
+		}
+	}
+
+	ppu.Dot++
+	if ppu.Dot == 456 {
+		// time to move onto next scanline
+		ppu.Dot = 0
+		currentLine := core.Memory.MainMemory[0xFF44] + 1
+		// if gone past scanline 153 reset to 0
+		if currentLine > 153 {
+			currentLine = 0
+		}
+		core.Memory.MainMemory[0xFF44] = currentLine
 
-		// we have entered vertical blank period
 		if currentLine == 144 {
-			core.DrawScanLine()
+			// we have entered vertical blank period
+			core.setMode(1)
 			core.RequestInterrupt(0)
-		} else if currentLine > 153 {
-			// if gone past scanline 153 reset to 0
-			core.Memory.MainMemory[0xFF44] = 0
-			core.DrawScanLine()
+			core.pollInput()
+			if core.SGB.Enabled {
+				core.sgbFrame()
+			}
+			if core.Clip != nil {
+				core.Clip.Add(core.screenshot())
+			}
+			if core.Recording != nil {
+				core.recordFrame()
+			}
+			ppu.Frames++
 		} else if currentLine < 144 {
-			//log.Println(currentLine)
-			core.DrawScanLine()
+			core.setMode(2)
 		}
-
 	}
+	core.SetLCDStatus()
+}
 
+/*
+	Switch the PPU mode and prepare the state of the new mode
+*/
+func (core *Core) setMode(mode byte) {
+	ppu := &core.PPU
+	control := core.Memory.MainMemory[0xFF40]
+	currentLine := core.Memory.MainMemory[0xFF44]
+
+	// Leaving the pixel transfer, the window line counter moves on if it was drawn
+	if ppu.Mode == 3 && ppu.windowActive {
+		ppu.WindowLine++
+	}
+	ppu.Mode = mode
+
+	switch mode {
+	case 2:
+		// The window state is reset at the beginning of every frame
+		if currentLine == 0 {
+			ppu.WindowLine = 0
+			ppu.windowYTriggered = false
+			ppu.windowWrap = false
+		}
+		if currentLine == core.Memory.MainMemory[0xFF4A] {
+			ppu.windowYTriggered = true
+		}
+	case 3:
+		ppu.LX = 0
+		ppu.bgFIFO.clear()
+		ppu.objFIFO.clear()
+		ppu.fetcher.reset(false)
+		ppu.windowActive = false
+		ppu.penaltyTile = -1
+		// The first tile fetch of every line is thrown away
+		ppu.stall = 6
+		ppu.discard = int(core.Memory.MainMemory[0xFF43] & 7)
+
+		// Window started at WX=166 on the previous line, it keeps wrapping
+		// around while WX stays at 166
+		if ppu.windowWrap {
+			ppu.windowWrap = false
+			if util.TestBit(control, 5) {
+				ppu.windowActive = true
+				ppu.fetcher.reset(true)
+				ppu.discard = 0
+				ppu.windowWrap = core.Memory.MainMemory[0xFF4B] == 166
+			}
+		}
+	}
 }
@@ -29,6 +29,13 @@ type Memory struct {
 
 func (core *Core) initMemory() {
 	log.Println("[Core] Start to initialize memory...")
+	core.resetMemory()
+	core.setupSaveLoop()
+}
+
+// Load the ROM and set the registers like after the boot ROM
+func (core *Core) resetMemory() {
+	core.Memory.MainMemory = [0x10000]byte{}
 
 	log.Println("[Memory] Load first 32KByte of rom data into memory")
 	//Load first 32KB of ROM into 0000-7FFF
@@ -41,24 +48,6 @@ func (core *Core) initMemory() {
 	core.Memory.MainMemory[0xFF06] = 0x00
 	core.Memory.MainMemory[0xFF07] = 0x00
 	core.Memory.MainMemory[0xFF0F] = 0xE1
-	core.Memory.MainMemory[0xFF10] = 0x80
-	core.Memory.MainMemory[0xFF11] = 0xBF
-	core.Memory.MainMemory[0xFF12] = 0xF3
-	core.Memory.MainMemory[0xFF14] = 0xBF
-	core.Memory.MainMemory[0xFF16] = 0x3F
-	core.Memory.MainMemory[0xFF17] = 0x00
-	core.Memory.MainMemory[0xFF19] = 0xBF
-	core.Memory.MainMemory[0xFF1A] = 0x7F
-	core.Memory.MainMemory[0xFF1B] = 0xFF
-	core.Memory.MainMemory[0xFF1C] = 0x9F
-	core.Memory.MainMemory[0xFF1E] = 0xBF
-	core.Memory.MainMemory[0xFF20] = 0xFF
-	core.Memory.MainMemory[0xFF21] = 0x00
-	core.Memory.MainMemory[0xFF22] = 0x00
-	core.Memory.MainMemory[0xFF23] = 0xBF
-	core.Memory.MainMemory[0xFF24] = 0x77
-	core.Memory.MainMemory[0xFF25] = 0xF3
-	core.Memory.MainMemory[0xFF26] = 0xF1
 	core.Memory.MainMemory[0xFF40] = 0x91
 	core.Memory.MainMemory[0xFF42] = 0x00
 	core.Memory.MainMemory[0xFF43] = 0x00
@@ -69,8 +58,6 @@ func (core *Core) initMemory() {
 	core.Memory.MainMemory[0xFF4A] = 0x00
 	core.Memory.MainMemory[0xFF4B] = 0x00
 	core.Memory.MainMemory[0xFFFF] = 0x00
-
-	core.setupSaveLoop()
 }
 
 func (core *Core) SaveRAM() {
@@ -113,6 +100,14 @@ func (core *Core) ReadMemory(address uint16) byte {
 		return core.GetJoypadStatus()
 	} else if address == 0xFF01 {
 		return core.SerialByte
+	} else if address >= 0xFF10 && address <= 0xFF3F {
+		return core.Sound.ReadRegister(address)
+	} else if (address >= 0x8000) && (address < 0xA000) && !core.isVRAMAccessible() {
+		// VRAM can't be accessed while the PPU is transferring pixels
+		return 0xFF
+	} else if (address >= 0xFE00) && (address < 0xFEA0) && !core.isOAMAccessible() {
+		// OAM can't be accessed during OAM search and pixel transfer
+		return 0xFF
 	}
 	return core.Memory.MainMemory[address]
 }
@@ -128,8 +123,20 @@ func (core *Core) WriteMemory(address uint16, data byte) {
 		// writing to ECHO ram also writes in RAM
 		core.Memory.MainMemory[address] = data
 		core.WriteMemory(address-0x2000, data)
+	} else if (address >= 0x8000) && (address < 0xA000) && !core.isVRAMAccessible() {
+		// writes to VRAM are ignored during pixel transfer
+	} else if (address >= 0xFE00) && (address < 0xFEA0) && !core.isOAMAccessible() {
+		// writes to OAM are ignored during OAM search and pixel transfer
 	} else if (address >= 0xFEA0) && (address < 0xFEFF) {
 		// this area is restricted
+	} else if 0xFF00 == address {
+		// Selecting a row of pressed buttons pulls input lines low too
+		lines := core.joypadLines()
+		core.Memory.MainMemory[0xFF00] = data
+		if core.SGB.Enabled {
+			core.sgbWriteJoypad(data)
+		}
+		core.joypadEdge(lines)
 	} else if 0xFF04 == address {
 		// This register is incremented at rate of 16384Hz (~16779Hz on SGB).
 		// In CGB Double Speed Mode it is incremented twice as fast, ie. at 32768Hz.
@@ -140,6 +147,9 @@ func (core *Core) WriteMemory(address uint16, data byte) {
 		// transferred to the LCD Driver. The LY can take on any value between 0 through 153.
 		// The values between 144 and 153 indicate the V-Blank period. Writing will reset the counter.
 		core.Memory.MainMemory[0xFF44] = 0
+	} else if address == 0xFF41 {
+		// The mode and coincidence bits of STAT are read only
+		core.Memory.MainMemory[0xFF41] = data&0x78 | core.Memory.MainMemory[0xFF41]&0x07
 	} else if address == 0xFF46 {
 		// FF46 - DMA - DMA Transfer and Start Address (W)
 		// Writing to this register launches a DMA transfer from ROM or RAM to
@@ -161,11 +171,7 @@ func (core *Core) WriteMemory(address uint16, data byte) {
 		}
 
 	} else if address >= 0xFF10 && address <= 0xFF3F {
-		//Trigger sound controller
-		core.Memory.MainMemory[address] = data
-		if core.ToggleSound {
-			core.Sound.Trigger(address, data, core.Memory.MainMemory[0xFF10:0xFF40])
-		}
+		core.Sound.WriteRegister(address, data)
 
 	} else if address == 0xFF02 {
 		/*
@@ -203,7 +209,13 @@ func (core *Core) DoDMA(data byte) {
 	// source address is data * 100
 	address := uint16(data) << 8
 	for i := 0; i < 0xA0; i++ {
-		core.WriteMemory(0xFE00+uint16(i), core.ReadMemory(address+uint16(i)))
+		// DMA is not affected by the PPU locking VRAM and OAM
+		source := address + uint16(i)
+		if source >= 0x8000 && source < 0xA000 {
+			core.Memory.MainMemory[0xFE00+i] = core.Memory.MainMemory[source]
+		} else {
+			core.Memory.MainMemory[0xFE00+i] = core.ReadMemory(source)
+		}
 	}
 }
 
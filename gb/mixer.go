@@ -0,0 +1,154 @@
+package gb
+
+import (
+	"fmt"
+	"log"
+)
+
+/*
+Muting and soloing channels, and the oscilloscope taps, to pick the
+soundtrack of a game apart. Channels are numbered 1-4 like in the
+register names.
+*/
+
+// Set the master volume, 0-1, e.g. to fade the music out
+func (sound *Sound) SetVolume(volume float64) {
+	sound.outputLock.Lock()
+	defer sound.outputLock.Unlock()
+	sound.attenuation = 1 - volume
+	sound.mix()
+}
+
+// A channel is heard when it's not muted, and soloed if any channel is
+func (sound *Sound) audible(index int) bool {
+	if sound.muted[index] {
+		return false
+	}
+	for _, soloed := range sound.soloed {
+		if soloed {
+			return sound.soloed[index]
+		}
+	}
+	return true
+}
+
+// Audible Whether a channel (1-4) is heard with the mute and solo switches
+func (sound *Sound) Audible(channel int) bool {
+	index, err := channelIndex(channel)
+	if err != nil {
+		return false
+	}
+	sound.outputLock.Lock()
+	defer sound.outputLock.Unlock()
+	return sound.audible(index)
+}
+
+// Switches The muted and the soloed channels, channel 1 first
+func (sound *Sound) Switches() (muted [4]bool, soloed [4]bool) {
+	sound.outputLock.Lock()
+	defer sound.outputLock.Unlock()
+	return sound.muted, sound.soloed
+}
+
+func channelIndex(channel int) (int, error) {
+	if channel < 1 || channel > 4 {
+		return 0, fmt.Errorf("unknown sound channel %d", channel)
+	}
+	return channel - 1, nil
+}
+
+// Mute or unmute a channel (1-4), returns whether it's now muted
+func (sound *Sound) ToggleMute(channel int) (bool, error) {
+	index, err := channelIndex(channel)
+	if err != nil {
+		return false, err
+	}
+	sound.outputLock.Lock()
+	defer sound.outputLock.Unlock()
+	sound.muted[index] = !sound.muted[index]
+	log.Printf("[Sound] Channel %d muted: %t\n", channel, sound.muted[index])
+	sound.mix()
+	return sound.muted[index], nil
+}
+
+/*
+Solo or unsolo a channel (1-4), returns whether it's now soloed. While
+some channels are soloed the others are not heard.
+*/
+func (sound *Sound) ToggleSolo(channel int) (bool, error) {
+	index, err := channelIndex(channel)
+	if err != nil {
+		return false, err
+	}
+	sound.outputLock.Lock()
+	defer sound.outputLock.Unlock()
+	sound.soloed[index] = !sound.soloed[index]
+	log.Printf("[Sound] Channel %d soloed: %t\n", channel, sound.soloed[index])
+	sound.mix()
+	return sound.soloed[index], nil
+}
+
+/*
+SoloNext Solo the channel after the soloed one alone, and none after
+the channel 4. Returns the soloed channel, 0 if none.
+*/
+func (sound *Sound) SoloNext() int {
+	sound.outputLock.Lock()
+	defer sound.outputLock.Unlock()
+	next := 1
+	for i, soloed := range sound.soloed {
+		if soloed {
+			next = i + 2
+		}
+	}
+	sound.soloed = [4]bool{}
+	if next > 4 {
+		next = 0
+	} else {
+		sound.soloed[next-1] = true
+	}
+	log.Printf("[Sound] Channel %d soloed\n", next)
+	sound.mix()
+	return next
+}
+
+/*
+Store the output of the channels for every sample period passed, at
+the sample rate of the sound. The scope doesn't depend on the speaker
+or the mute and solo switches.
+*/
+func (sound *Sound) tapScope(cycles int) {
+	sound.scopePhase += float64(cycles) * sampleStep
+	if sound.scopePhase < 1 {
+		return
+	}
+	outputs := sound.channelOutputs()
+	for ; sound.scopePhase >= 1; sound.scopePhase-- {
+		for i, output := range outputs {
+			sound.scope[i][sound.scopeNext] = output
+		}
+		sound.scopeNext = (sound.scopeNext + 1) % scopeLength
+	}
+}
+
+/*
+The last samples (up to 2048) of a channel (1-4) as the DAC outputs
+them, -1 to 1, oldest first. At 44100 Hz, 735 samples are a frame.
+*/
+func (sound *Sound) Scope(channel int, samples int) ([]float64, error) {
+	index, err := channelIndex(channel)
+	if err != nil {
+		return nil, err
+	}
+	if samples > scopeLength || samples <= 0 {
+		samples = scopeLength
+	}
+	sound.outputLock.Lock()
+	defer sound.outputLock.Unlock()
+	res := make([]float64, samples)
+	start := sound.scopeNext - samples + scopeLength
+	for i := range res {
+		res[i] = sound.scope[index][(start+i)%scopeLength]
+	}
+	return res, nil
+}
@@ -0,0 +1,411 @@
+package gb
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+/*
+A RGB colour as stored in the screen buffer.
+*/
+type Colour [3]uint8
+
+/*
+Colours the four shades (0-3, after BGP/OBP0/OBP1 are applied) are
+displayed with. Background and window share BG, sprites use OBJ0 or
+OBJ1 depending on the palette number in their attributes.
+*/
+type Palette struct {
+	BG   [4]Colour
+	OBJ0 [4]Colour
+	OBJ1 [4]Colour
+}
+
+/*
+Get the colour of a shade drawn with the given palette register
+(FF47 - BGP, FF48 - OBP0, FF49 - OBP1).
+*/
+func (palette *Palette) Colour(register uint16, shade int) Colour {
+	switch register {
+	case 0xFF48:
+		return palette.OBJ0[shade]
+	case 0xFF49:
+		return palette.OBJ1[shade]
+	default:
+		return palette.BG[shade]
+	}
+}
+
+// Palette using the same four colours for every layer
+func uniformPalette(colours [4]Colour) Palette {
+	return Palette{BG: colours, OBJ0: colours, OBJ1: colours}
+}
+
+var (
+	white = Colour{0xFF, 0xFF, 0xFF}
+	black = Colour{0x00, 0x00, 0x00}
+)
+
+/*
+Named palettes.
+
+	dmg     - the green LCD of the original Game Boy
+	pocket  - the gray LCD of the Game Boy Pocket
+	gray    - plain gray levels
+
+The rest are the palettes the CGB boot ROM lets the player choose for
+DMG games by holding a direction and A/B while the logo is shown.
+"cgb" is the palette used when the title is not in the colorization
+table. The special name "auto" picks the palette from the title, see
+colorizationTable.
+*/
+var Palettes = map[string]Palette{
+	"dmg":       uniformPalette([4]Colour{{0x9B, 0xBC, 0x0F}, {0x8B, 0xAC, 0x0F}, {0x30, 0x62, 0x30}, {0x0F, 0x38, 0x0F}}),
+	"pocket":    uniformPalette([4]Colour{{0xE0, 0xDB, 0xCD}, {0xA8, 0x9F, 0x94}, {0x70, 0x6B, 0x66}, {0x2B, 0x2B, 0x26}}),
+	"gray":      uniformPalette([4]Colour{white, {0xCC, 0xCC, 0xCC}, {0x77, 0x77, 0x77}, black}),
+	"brown":     cgbBootPalette(5),
+	"red":       cgbBootPalette(43),
+	"darkbrown": cgbBootPalette(28),
+	"blue":      cgbBootPalette(48),
+	"darkblue":  cgbBootPalette(40),
+	"grayscale": cgbBootPalette(7),
+	"pastel":    cgbBootPalette(8),
+	"orange":    cgbBootPalette(3),
+	"yellow":    cgbBootPalette(49),
+	"green":     cgbBootPalette(1),
+	"cgb":       cgbBootPalette(0),
+	"inverted":  cgbBootPalette(6),
+}
+
+// Palette used when none is specified
+const DefaultPalette = "dmg"
+
+// Order of the named palettes when switching to the next one
+var paletteOrder = []string{"dmg", "pocket", "gray", "auto", "brown", "red", "darkbrown", "blue", "darkblue", "grayscale", "pastel", "orange", "yellow", "green", "cgb", "inverted"}
+
+// NextPalette The named palette after the option, the first one after a custom palette
+func NextPalette(option string) string {
+	for i, name := range paletteOrder {
+		if strings.EqualFold(name, option) {
+			return paletteOrder[(i+1)%len(paletteOrder)]
+		}
+	}
+	return paletteOrder[0]
+}
+
+/*
+Colours of the palettes of the CGB boot ROM, 4 per palette in the RGB555
+format of the CGB palette memory.
+*/
+var cgbBootColours = [...]uint16{
+	0x7FFF, 0x32BF, 0x00D0, 0x0000,
+	0x639F, 0x4279, 0x15B0, 0x04CB,
+	0x7FFF, 0x6E31, 0x454A, 0x0000,
+	0x7FFF, 0x1BEF, 0x0200, 0x0000,
+	0x7FFF, 0x421F, 0x1CF2, 0x0000,
+	0x7FFF, 0x5294, 0x294A, 0x0000,
+	0x7FFF, 0x03FF, 0x012F, 0x0000,
+	0x7FFF, 0x03EF, 0x01D6, 0x0000,
+	0x7FFF, 0x42B5, 0x3DC8, 0x0000,
+	0x7E74, 0x03FF, 0x0180, 0x0000,
+	0x67FF, 0x77AC, 0x1A13, 0x2D6B,
+	0x7ED6, 0x4BFF, 0x2175, 0x0000,
+	0x53FF, 0x4A5F, 0x7E52, 0x0000,
+	0x4FFF, 0x7ED2, 0x3A4C, 0x1CE0,
+	0x03ED, 0x7FFF, 0x255F, 0x0000,
+	0x036A, 0x021F, 0x03FF, 0x7FFF,
+	0x7FFF, 0x01DF, 0x0112, 0x0000,
+	0x231F, 0x035F, 0x00F2, 0x0009,
+	0x7FFF, 0x03EA, 0x011F, 0x0000,
+	0x299F, 0x001A, 0x000C, 0x0000,
+	0x7FFF, 0x027F, 0x001F, 0x0000,
+	0x7FFF, 0x03E0, 0x0206, 0x0120,
+	0x7FFF, 0x7EEB, 0x001F, 0x7C00,
+	0x7FFF, 0x3FFF, 0x7E00, 0x001F,
+	0x7FFF, 0x03FF, 0x001F, 0x0000,
+	0x03FF, 0x001F, 0x000C, 0x0000,
+	0x7FFF, 0x033F, 0x0193, 0x0000,
+	0x0000, 0x4200, 0x037F, 0x7FFF,
+	0x7FFF, 0x7E8C, 0x7C00, 0x0000,
+	0x7FFF, 0x1BEF, 0x6180, 0x0000,
+}
+
+/*
+Palettes of the boot ROM used for OBJ0, OBJ1 and BG, as the index of
+their first colour in cgbBootColours. A few start in the middle of a
+palette and take the last colour of the one before.
+*/
+var cgbBootCombinations = [...][3]int{
+	{4 * 4, 4 * 4, 29 * 4},
+	{18 * 4, 18 * 4, 18 * 4},
+	{20 * 4, 20 * 4, 20 * 4},
+	{24 * 4, 24 * 4, 24 * 4},
+	{9 * 4, 9 * 4, 9 * 4},
+	{0 * 4, 0 * 4, 0 * 4},
+	{27 * 4, 27 * 4, 27 * 4},
+	{5 * 4, 5 * 4, 5 * 4},
+	{12 * 4, 12 * 4, 12 * 4},
+	{26 * 4, 26 * 4, 26 * 4},
+	{16 * 4, 8 * 4, 8 * 4},
+	{4 * 4, 28 * 4, 28 * 4},
+	{4 * 4, 2 * 4, 2 * 4},
+	{3 * 4, 4 * 4, 4 * 4},
+	{4 * 4, 29 * 4, 29 * 4},
+	{28 * 4, 4 * 4, 28 * 4},
+	{2 * 4, 17 * 4, 2 * 4},
+	{16 * 4, 16 * 4, 8 * 4},
+	{4 * 4, 4 * 4, 7 * 4},
+	{4 * 4, 4 * 4, 18 * 4},
+	{4 * 4, 4 * 4, 20 * 4},
+	{19 * 4, 19 * 4, 9 * 4},
+	{4*4 - 1, 4*4 - 1, 11 * 4},
+	{17 * 4, 17 * 4, 2 * 4},
+	{4 * 4, 4 * 4, 2 * 4},
+	{4 * 4, 4 * 4, 3 * 4},
+	{28 * 4, 28 * 4, 0 * 4},
+	{3 * 4, 3 * 4, 0 * 4},
+	{0 * 4, 0 * 4, 1 * 4},
+	{18 * 4, 22 * 4, 18 * 4},
+	{20 * 4, 22 * 4, 20 * 4},
+	{24 * 4, 22 * 4, 24 * 4},
+	{16 * 4, 22 * 4, 8 * 4},
+	{17 * 4, 4 * 4, 13 * 4},
+	{28*4 - 1, 0 * 4, 14 * 4},
+	{28*4 - 1, 4 * 4, 15 * 4},
+	{19 * 4, 22 * 4, 9 * 4},
+	{16 * 4, 28 * 4, 10 * 4},
+	{4 * 4, 23 * 4, 28 * 4},
+	{17 * 4, 22 * 4, 2 * 4},
+	{4 * 4, 0 * 4, 2 * 4},
+	{4 * 4, 28 * 4, 3 * 4},
+	{28 * 4, 3 * 4, 0 * 4},
+	{3 * 4, 28 * 4, 4 * 4},
+	{21 * 4, 28 * 4, 4 * 4},
+	{3 * 4, 28 * 4, 0 * 4},
+	{25 * 4, 3 * 4, 28 * 4},
+	{0 * 4, 28 * 4, 8 * 4},
+	{4 * 4, 3 * 4, 28 * 4},
+	{28 * 4, 3 * 4, 6 * 4},
+	{4 * 4, 28 * 4, 29 * 4},
+}
+
+// The palette of a combination of the boot ROM
+func cgbBootPalette(combination int) Palette {
+	var palette Palette
+	for i, layer := range []*[4]Colour{&palette.OBJ0, &palette.OBJ1, &palette.BG} {
+		for shade := range layer {
+			layer[shade] = rgb555(cgbBootColours[cgbBootCombinations[combination][i]+shade])
+		}
+	}
+	return palette
+}
+
+// Expand a RGB555 colour, the 5 bits of each component are repeated in the low bits
+func rgb555(colour uint16) Colour {
+	expand := func(value uint16) uint8 {
+		value &= 0x1F
+		return uint8(value<<3 | value>>2)
+	}
+	return Colour{expand(colour), expand(colour >> 5), expand(colour >> 10)}
+}
+
+// Colorization of a DMG game by the CGB boot ROM
+type colorization struct {
+	// Sum of the bytes of the title
+	checksum byte
+	// Fourth letter of the title, telling apart titles with the same checksum, 0 if the checksum is enough
+	letter byte
+	// Index in cgbBootCombinations
+	combination int
+}
+
+/*
+Colorization the CGB boot ROM applies to DMG games, in the order the
+boot ROM looks it up. Only games licensed by Nintendo are colorized.
+*/
+var colorizationTable = []colorization{
+	{0x00, 0, 0},
+	{0x88, 0, 4},  // ALLEY WAY
+	{0x16, 0, 5},  // YAKUMAN
+	{0x36, 0, 35}, // BASEBALL, GAME&WATCH 2
+	{0xD1, 0, 34}, // TENNIS
+	{0xDB, 0, 3},  // TETRIS
+	{0xF2, 0, 31}, // QIX
+	{0x3C, 0, 15}, // DR.MARIO
+	{0x8C, 0, 10}, // RADARMISSION
+	{0x92, 0, 5},  // F1RACE
+	{0x3D, 0, 19}, // YOSSY NO TAMAGO
+	{0x5C, 0, 36},
+	{0x58, 0, 7},  // X
+	{0xC9, 0, 37}, // MARIOLAND2
+	{0x3E, 0, 30}, // YOSSY NO COOKIE
+	{0x70, 0, 44}, // ZELDA
+	{0x1D, 0, 21},
+	{0x59, 0, 32},
+	{0x69, 0, 31}, // TETRIS FLASH
+	{0x19, 0, 20}, // DONKEY KONG
+	{0x35, 0, 5},  // MARIO'S PICROSS
+	{0xA8, 0, 33},
+	{0x14, 0, 13}, // POKEMON RED, GAMEBOYCAMERA G
+	{0xAA, 0, 14}, // POKEMON GREEN
+	{0x75, 0, 5},  // PICROSS 2
+	{0x95, 0, 29}, // YOSSY NO PANEPON
+	{0x99, 0, 5},  // KIRAKIRA KIDS
+	{0x34, 0, 18}, // GAMEBOY GALLERY
+	{0x6F, 0, 9},  // POCKETCAMERA
+	{0x15, 0, 3},
+	{0xFF, 0, 2},  // BALLOON KID
+	{0x97, 0, 26}, // KINGOFTHEZOO
+	{0x4B, 0, 25}, // DMG FOOTBALL
+	{0x90, 0, 25}, // WORLD CUP
+	{0x17, 0, 41}, // OTHELLO
+	{0x10, 0, 42}, // SUPER RC PRO-AM
+	{0x39, 0, 26}, // DYNABLASTER
+	{0xF7, 0, 45}, // BOY AND BLOB GB2
+	{0xF6, 0, 42}, // MEGAMAN
+	{0xA2, 0, 45}, // STAR WARS-NOA
+	{0x49, 0, 36},
+	{0x4E, 0, 38}, // WAVERACE
+	{0x43, 0, 26},
+	{0x68, 0, 42}, // LOLO2
+	{0xE0, 0, 30}, // YOSHI'S COOKIE
+	{0x8B, 0, 41}, // MYSTIC QUEST
+	{0xF0, 0, 34},
+	{0xCE, 0, 34}, // TOPRANKINGTENNIS
+	{0x0C, 0, 5},  // MANSELL
+	{0x29, 0, 42}, // MEGAMAN3
+	{0xE8, 0, 6},  // SPACE INVADERS
+	{0xB7, 0, 5},  // GAME&WATCH
+	{0x86, 0, 33}, // DONKEYKONGLAND95
+	{0x9A, 0, 25}, // ASTEROIDS/MISCMD
+	{0x52, 0, 42}, // STREET FIGHTER 2
+	{0x01, 0, 42}, // DEFENDER/JOUST
+	{0x9D, 0, 40}, // KILLERINSTINCT95
+	{0x71, 0, 2},  // TETRIS BLAST
+	{0x9C, 0, 16}, // PINOCCHIO
+	{0xBD, 0, 25},
+	{0x5D, 0, 42}, // BA.TOSHINDEN
+	{0x6D, 0, 42}, // NETTOU KOF 95
+	{0x67, 0, 5},
+	{0x3F, 0, 0},  // TETRIS PLUS
+	{0x6B, 0, 39}, // DONKEYKONGLAND 3
+
+	// Checksums shared by several titles
+	{0xB3, 'B', 36},
+	{0x46, 'E', 22}, // SUPER MARIOLAND
+	{0x28, 'F', 25}, // GOLF
+	{0xA5, 'A', 6},  // SOLARSTRIKER
+	{0xC6, 'A', 32}, // GBWARS
+	{0xD3, 'R', 12}, // KAERUNOTAMENI
+	{0x27, 'B', 36},
+	{0x61, 'E', 11}, // POKEMON BLUE
+	{0x18, 'K', 39}, // DONKEYKONGLAND
+	{0x66, 'E', 18}, // GAMEBOY GALLERY2
+	{0x6A, 'K', 39}, // DONKEYKONGLAND 2
+	{0xBF, ' ', 24}, // KID ICARUS
+	{0x0D, 'R', 31}, // TETRIS2
+	{0xF4, '-', 50},
+	{0xB3, 'U', 17}, // MOGURANYA
+	{0x46, 'R', 46},
+	{0x28, 'A', 6},  // GALAXIAN
+	{0xA5, 'R', 27}, // BT2RAGNAROKWORLD
+	{0xC6, ' ', 0},
+	{0xD3, 'I', 47},
+	{0x27, 'N', 41},
+	{0x61, 'A', 41},
+	{0x18, 'I', 0},
+	{0x66, 'L', 0},
+	{0x6A, 'I', 43},
+	{0xBF, 'C', 0},
+	{0x0D, 'E', 0},
+	{0xF4, ' ', 0},
+	{0xB3, 'R', 0},
+}
+
+/*
+Pick the CGB colorization palette of a DMG game from its cartridge header.
+
+0134-0143 - Title, summed up to get the checksum, 0137 is its fourth letter
+0144-0145 - New Licensee Code, used when the old code is 33h
+014B      - Old Licensee Code, 01h is Nintendo
+*/
+func colorizationPalette(rom []byte) Palette {
+	licensee := rom[0x14B]
+	nintendo := licensee == 0x01 || (licensee == 0x33 && string(rom[0x144:0x146]) == "01")
+	if nintendo {
+		checksum := byte(0)
+		for _, b := range rom[0x134:0x144] {
+			checksum += b
+		}
+		for _, entry := range colorizationTable {
+			if entry.checksum == checksum && (entry.letter == 0 || entry.letter == rom[0x137]) {
+				return cgbBootPalette(entry.combination)
+			}
+		}
+	}
+	return Palettes["cgb"]
+}
+
+/*
+Parse a palette option, which is either the name of a palette, or a
+comma separated list of hex colours like "e0f8d0,88c070,346856,081820":
+
+	4 colours  - used for the background, the window and the sprites
+	12 colours - 4 for BG, 4 for OBJ0 and 4 for OBJ1
+*/
+func ParsePalette(option string) (Palette, error) {
+	if palette, ok := Palettes[strings.ToLower(option)]; ok {
+		return palette, nil
+	}
+
+	fields := strings.Split(option, ",")
+	if len(fields) != 4 && len(fields) != 12 {
+		return Palette{}, fmt.Errorf("unknown palette %q", option)
+	}
+	colours := make([]Colour, len(fields))
+	for i, field := range fields {
+		value, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(field), "#"), 16, 32)
+		if err != nil || value > 0xFFFFFF {
+			return Palette{}, fmt.Errorf("invalid colour %q", field)
+		}
+		colours[i] = Colour{uint8(value >> 16), uint8(value >> 8), uint8(value)}
+	}
+
+	var palette Palette
+	copy(palette.BG[:], colours)
+	if len(colours) == 4 {
+		palette.OBJ0 = palette.BG
+		palette.OBJ1 = palette.BG
+	} else {
+		copy(palette.OBJ0[:], colours[4:8])
+		copy(palette.OBJ1[:], colours[8:12])
+	}
+	return palette, nil
+}
+
+/*
+Switch to another palette, see ParsePalette. "auto" selects the CGB
+colorization of the loaded game. Takes effect from the next pixel drawn.
+*/
+func (core *Core) SetPalette(option string) error {
+	if option == "" {
+		option = DefaultPalette
+	}
+	palette := Palettes["cgb"]
+	if strings.ToLower(option) == "auto" {
+		if core.Cartridge.Props != nil {
+			palette = core.Cartridge.Props.Colorization
+		}
+	} else {
+		var err error
+		if palette, err = ParsePalette(option); err != nil {
+			return err
+		}
+	}
+	core.Palette = palette
+	core.PaletteName = option
+	log.Printf("[Display] Palette: %s\n", option)
+	return nil
+}
@@ -0,0 +1,149 @@
+package gb
+
+/*
+Picture Processing Unit state.
+
+The PPU is stepped one dot (one 4.194304MHz clock) at a time. Each of the
+154 scan lines takes 456 dots:
+
+	Mode 2 - OAM search, 80 dots
+	Mode 3 - Pixel transfer, 172-289 dots depending on SCX fine scroll,
+	         the window and the sprites on the line
+	Mode 0 - H-Blank, the rest of the line
+
+Lines 144-153 are the V-Blank period (mode 1).
+
+During mode 3 a tile fetcher keeps the background FIFO filled, one pixel
+is shifted out of the FIFO every dot, mixed with the sprite FIFO and sent
+to the LCD. Registers are read while the line is being drawn, so mid-line
+writes to SCX/SCY/palettes/LCDC show up at the right place on screen.
+*/
+type PPU struct {
+	// Current mode, mirrored in the two lower STAT bits
+	Mode byte
+	// Dot counter within the current scan line (0-455)
+	Dot int
+	// X position of the next pixel sent to the LCD
+	LX int
+	// Number of frames completed, counted at the start of every V-Blank
+	Frames int
+
+	bgFIFO  pixelFIFO
+	objFIFO pixelFIFO
+	fetcher tileFetcher
+
+	// Pixels still to be thrown away because of SCX fine scroll
+	discard int
+	// Dots the pixel transfer is stalled for (initial fetch and sprite fetches)
+	stall int
+	// Background tile column of the last sprite fetch which paid the fetcher penalty
+	penaltyTile int
+
+	// Sprites found by the OAM search of the current line
+	lineSprites [40]spriteEntry
+	spriteCount int
+
+	// Whether the window is being drawn on the current line
+	windowActive bool
+	// Window internal line counter, the row of the window map drawn next.
+	// It only advances on lines where the window was actually drawn, so
+	// hiding the window for a few lines doesn't skip any of its rows.
+	WindowLine int
+	// WY was equal to LY at the start of a line of the current frame
+	windowYTriggered bool
+	// The window was started at WX=166, it then covers the whole next line
+	windowWrap bool
+
+	// The LCD was switched off and the PPU is waiting to be restarted
+	off bool
+	// Level of the STAT interrupt line, interrupts are requested on rising edges
+	statLine bool
+}
+
+/*
+A pixel in one of the FIFOs.
+*/
+type fifoPixel struct {
+	// Colour number (0-3) before the palette is applied
+	colour byte
+	// Palette register the colour number is mapped with
+	palette uint16
+	// Sprite attribute bit 7, OBJ-to-BG priority
+	bgPriority bool
+}
+
+/*
+Fixed size pixel queue. Neither the background nor the sprite FIFO
+ever holds more than 8 pixels.
+*/
+type pixelFIFO struct {
+	pixels [8]fifoPixel
+	head   int
+	size   int
+}
+
+func (fifo *pixelFIFO) push(pixel fifoPixel) {
+	fifo.pixels[(fifo.head+fifo.size)%8] = pixel
+	fifo.size++
+}
+
+func (fifo *pixelFIFO) pop() fifoPixel {
+	pixel := fifo.pixels[fifo.head]
+	fifo.head = (fifo.head + 1) % 8
+	fifo.size--
+	return pixel
+}
+
+// Get the i-th pixel counted from the head of the queue
+func (fifo *pixelFIFO) at(i int) *fifoPixel {
+	return &fifo.pixels[(fifo.head+i)%8]
+}
+
+func (fifo *pixelFIFO) clear() {
+	fifo.head = 0
+	fifo.size = 0
+}
+
+/*
+Fetcher steps, every step except pushing takes 2 dots.
+Pushing is retried every dot until the background FIFO is empty.
+*/
+const (
+	fetchTileNumber = iota
+	fetchTileDataLow
+	fetchTileDataHigh
+	fetchPush
+)
+
+/*
+Background/window tile fetcher.
+*/
+type tileFetcher struct {
+	step int
+	dots int
+	// Tile column (0-31) of the next fetch, relative to SCX or to the window start
+	tileX      byte
+	tileNumber byte
+	dataLow    byte
+	dataHigh   byte
+	// Fetching from the window tile map instead of the background map
+	window bool
+}
+
+func (fetcher *tileFetcher) reset(window bool) {
+	fetcher.step = fetchTileNumber
+	fetcher.dots = 0
+	fetcher.tileX = 0
+	fetcher.window = window
+}
+
+/*
+An OAM entry found during the OAM search.
+*/
+type spriteEntry struct {
+	y     byte
+	x     byte
+	index int
+	// Already fetched into the sprite FIFO on this line
+	fetched bool
+}
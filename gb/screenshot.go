@@ -0,0 +1,96 @@
+package gb
+
+import (
+	"image"
+	"log"
+)
+
+/*
+The last frame as displayed, after the palette (or the Super Game Boy
+colours and border) is applied. The image is a copy and can be kept.
+It's called from another goroutine while the emulation runs, the frame
+is copied between two frames so that it's whole.
+*/
+func (core *Core) Screenshot() image.Image {
+	frame := make(chan *image.RGBA, 1)
+	core.Schedule(func(core *Core) {
+		frame <- core.screenshot()
+	})
+	return <-frame
+}
+
+func (core *Core) screenshot() *image.RGBA {
+	if core.SGB.Enabled {
+		img := image.NewRGBA(image.Rect(0, 0, 256, 224))
+		for y := 0; y < 224; y++ {
+			for x := 0; x < 256; x++ {
+				i := img.PixOffset(x, y)
+				copy(img.Pix[i:i+3], core.SGBScreen[x][y][:])
+				img.Pix[i+3] = 0xFF
+			}
+		}
+		return img
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 160, 144))
+	for y := 0; y < 144; y++ {
+		for x := 0; x < 160; x++ {
+			i := img.PixOffset(x, y)
+			copy(img.Pix[i:i+3], core.Screen[x][y][:])
+			img.Pix[i+3] = 0xFF
+		}
+	}
+	return img
+}
+
+// Samples the sound may be ahead of the recorded frames
+const recordingSlack = 64
+
+// Write the frame just completed and its sound to the recording
+func (core *Core) recordFrame() {
+	rec := core.Recording
+	err := rec.WriteFrame(core.screenshot())
+	if err == nil {
+		samples := make([][2]float64, rec.PendingSamples())
+		read := core.Sound.ReadSamples(samples)
+		// The frames and the samples are rounded differently, a sample may be missing
+		for i := read; i > 0 && i < len(samples); i++ {
+			samples[i] = samples[read-1]
+		}
+		err = rec.WriteSamples(samples)
+		core.Sound.Replay(samples)
+		// Samples produced while the LCD was off have no frame
+		if surplus := core.Sound.BufferedSamples() - recordingSlack; surplus > 0 {
+			core.Sound.ReadSamples(make([][2]float64, surplus))
+		}
+	}
+	if err != nil {
+		log.Println("[Record] Recording stopped,", err)
+		core.StopRecording()
+	}
+}
+
+/*
+FinishRecording Stop the recording from another goroutine while the
+emulation runs. The emulation loop stops it between two frames, this
+returns once the files are complete.
+*/
+func (core *Core) FinishRecording() {
+	done := make(chan struct{})
+	core.Schedule(func(core *Core) {
+		core.StopRecording()
+		close(done)
+	})
+	<-done
+}
+
+// Finish the recording, if any, from the goroutine of the emulation
+func (core *Core) StopRecording() {
+	if core.Recording == nil {
+		return
+	}
+	if err := core.Recording.Close(); err != nil {
+		log.Println("[Record] Failed to finish the recording,", err)
+	}
+	core.Recording = nil
+}
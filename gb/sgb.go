@@ -0,0 +1,498 @@
+package gb
+
+import (
+	"log"
+
+	"github.com/HFO4/gbc-in-cloud/driver"
+)
+
+/*
+Super Game Boy state.
+
+Games talk to the SGB by sending 16 bytes packets through the joypad
+register (FF00), one bit per pulse on P14/P15:
+
+	P14 & P15 low  - reset, start of a packet
+	P15 low        - a 1 bit
+	P14 low        - a 0 bit
+	P14 & P15 high - between pulses
+
+The bytes are sent LSB first and a packet ends with a 0 stop bit. The
+first byte of the first packet holds the command (bits 3-7) and the
+number of packets of the command (bits 0-2).
+
+Larger blocks of data (palettes, border tiles...) are transferred
+through the screen: the game draws them as 2bpp tiles on the next frame
+after the command is sent.
+*/
+type SGB struct {
+	// Game supports the SGB and the SGB emulation is turned on
+	Enabled bool
+
+	// Packet currently being received
+	packet    [16]byte
+	bit       int
+	receiving bool
+	lastP1    byte
+	// Packets of the current command
+	command  []byte
+	expected int
+
+	// Colours of the 4 palettes applied to the game screen, colour 0
+	// is shared by all of them
+	palettes [4][4]Colour
+	// The 512 system palettes set with PAL_TRN
+	systemPalettes [512][4]Colour
+	// Palette number of every 8x8 cell of the screen
+	attributes [18][20]byte
+	// The 45 attribute files set with ATTR_TRN
+	attributeFiles [45][90]byte
+
+	// Border tiles (4bpp, 32 bytes each), map and palettes 4-7
+	borderTiles    [256 * 32]byte
+	borderMap      [32 * 28]uint16
+	borderPalettes [4][16]Colour
+
+	// MASK_EN: 0 - cancel, 1 - freeze screen, 2 - black, 3 - colour 0
+	mask byte
+	// Number of players requested with MLT_REQ and the selected one
+	players  int
+	joypadID int
+	// Button status of player 2-4, same layout as Core.JoypadStatus, see driver.PlayerButton
+	Joypads [3]byte
+
+	// VRAM transfer to be done from the next frame and its parameter byte
+	transfer      byte
+	transferFlags byte
+}
+
+// SGB command codes
+const (
+	sgbPAL01   = 0x00
+	sgbPAL23   = 0x01
+	sgbPAL03   = 0x02
+	sgbPAL12   = 0x03
+	sgbATTRBLK = 0x04
+	sgbATTRLIN = 0x05
+	sgbATTRDIV = 0x06
+	sgbATTRCHR = 0x07
+	sgbPALSET  = 0x0A
+	sgbPALTRN  = 0x0B
+	sgbMLTREQ  = 0x11
+	sgbCHRTRN  = 0x13
+	sgbPCTTRN  = 0x14
+	sgbATTRTRN = 0x15
+	sgbATTRSET = 0x16
+	sgbMASKEN  = 0x17
+)
+
+/*
+Reset the SGB and register the border screen to the display driver,
+if it can show it.
+*/
+func (core *Core) initSGB() {
+	sgb := &core.SGB
+	sgb.players = 1
+	sgb.lastP1 = 0x30
+	sgb.Joypads = [3]byte{0xFF, 0xFF, 0xFF}
+	// The default palettes are the shades of the selected palette
+	for i := range sgb.palettes {
+		sgb.palettes[i] = core.Palette.BG
+	}
+	log.Println("[SGB] Super Game Boy enhancements enabled")
+
+	if display, ok := core.DisplayDriver.(driver.SGBDisplayDriver); ok {
+		display.InitSGB(&core.SGBScreen)
+	}
+}
+
+/*
+Receive the bits of command packets written to FF00.
+*/
+func (core *Core) sgbWriteJoypad(data byte) {
+	sgb := &core.SGB
+	p1 := data & 0x30
+	last := sgb.lastP1
+	sgb.lastP1 = p1
+
+	switch p1 {
+	case 0x00:
+		// Reset pulse
+		sgb.receiving = true
+		sgb.bit = 0
+		sgb.packet = [16]byte{}
+	case 0x10, 0x20:
+		// Count a pulse only once
+		if !sgb.receiving || last != 0x30 {
+			return
+		}
+		if sgb.bit == 128 {
+			// Stop bit, the packet is complete
+			sgb.receiving = false
+			core.sgbPacket()
+			return
+		}
+		if p1 == 0x10 {
+			sgb.packet[sgb.bit/8] |= 1 << uint(sgb.bit%8)
+		}
+		sgb.bit++
+	case 0x30:
+		// With several players, the next joypad is selected when P15 goes high
+		if !sgb.receiving && sgb.players > 1 && last&0x20 == 0 {
+			sgb.joypadID = (sgb.joypadID + 1) % sgb.players
+		}
+	}
+}
+
+/*
+Add a received packet to the current command and run the command once
+all of its packets arrived.
+*/
+func (core *Core) sgbPacket() {
+	sgb := &core.SGB
+	if len(sgb.command) == 0 {
+		sgb.expected = int(sgb.packet[0] & 0x07)
+		if sgb.expected == 0 {
+			return
+		}
+	}
+	sgb.command = append(sgb.command, sgb.packet[:]...)
+	if len(sgb.command) < sgb.expected*16 {
+		return
+	}
+
+	command := sgb.command
+	sgb.command = nil
+	core.sgbCommand(command[0]>>3, command)
+}
+
+func (core *Core) sgbCommand(code byte, data []byte) {
+	sgb := &core.SGB
+	switch code {
+	case sgbPAL01:
+		sgb.setPalettes(0, 1, data)
+	case sgbPAL23:
+		sgb.setPalettes(2, 3, data)
+	case sgbPAL03:
+		sgb.setPalettes(0, 3, data)
+	case sgbPAL12:
+		sgb.setPalettes(1, 2, data)
+	case sgbATTRBLK:
+		sgb.attributeBlocks(data)
+	case sgbATTRLIN:
+		sgb.attributeLines(data)
+	case sgbATTRDIV:
+		sgb.attributeDivide(data)
+	case sgbATTRCHR:
+		sgb.attributeCharacters(data)
+	case sgbPALSET:
+		for i := 0; i < 4; i++ {
+			index := (int(data[1+i*2]) | int(data[2+i*2])<<8) & 0x1FF
+			sgb.palettes[i] = sgb.systemPalettes[index]
+		}
+		// Colour 0 of palette 0 is used by all the palettes
+		for i := 1; i < 4; i++ {
+			sgb.palettes[i][0] = sgb.palettes[0][0]
+		}
+		if data[9]&0x80 != 0 {
+			sgb.applyAttributeFile(data[9] & 0x3F)
+		}
+		if data[9]&0x40 != 0 {
+			sgb.mask = 0
+		}
+	case sgbATTRSET:
+		sgb.applyAttributeFile(data[1] & 0x3F)
+		if data[1]&0x40 != 0 {
+			sgb.mask = 0
+		}
+	case sgbMLTREQ:
+		switch data[1] & 0x03 {
+		case 1:
+			sgb.players = 2
+		case 3:
+			sgb.players = 4
+		default:
+			sgb.players = 1
+		}
+		sgb.joypadID = 0
+	case sgbMASKEN:
+		sgb.mask = data[1] & 0x03
+	case sgbPALTRN, sgbCHRTRN, sgbPCTTRN, sgbATTRTRN:
+		// The data is taken from the next frame
+		sgb.transfer = code
+		sgb.transferFlags = data[1]
+	default:
+		log.Printf("[SGB] Unsupported command %02X\n", code)
+	}
+}
+
+/*
+PAL01/PAL23/PAL03/PAL12: colour 0 shared by all palettes, then
+colours 1-3 of the first and the second palette.
+*/
+func (sgb *SGB) setPalettes(first int, second int, data []byte) {
+	colour0 := sgbColour(data[1], data[2])
+	for i := range sgb.palettes {
+		sgb.palettes[i][0] = colour0
+	}
+	for i := 0; i < 3; i++ {
+		sgb.palettes[first][i+1] = sgbColour(data[3+i*2], data[4+i*2])
+		sgb.palettes[second][i+1] = sgbColour(data[9+i*2], data[10+i*2])
+	}
+}
+
+// Convert a little endian RGB555 SNES colour
+func sgbColour(low byte, high byte) Colour {
+	value := uint16(low) | uint16(high)<<8
+	expand := func(c uint16) uint8 {
+		c &= 0x1F
+		return uint8(c<<3 | c>>2)
+	}
+	return Colour{expand(value), expand(value >> 5), expand(value >> 10)}
+}
+
+/*
+ATTR_BLK: datasets of 6 bytes, each one colours the inside, the border
+and the outside of a rectangle of cells.
+
+	byte 0 - bit 0: change inside, bit 1: change border, bit 2: change outside
+	byte 1 - palette of the inside (bits 0-1), border (2-3), outside (4-5)
+	byte 2-5 - X1, Y1, X2, Y2 of the rectangle
+*/
+func (sgb *SGB) attributeBlocks(data []byte) {
+	count := int(data[1] & 0x1F)
+	for i := 0; i < count && 2+i*6+6 <= len(data); i++ {
+		set := data[2+i*6:]
+		control := set[0] & 0x07
+		inside, border, outside := set[1]&0x03, set[1]>>2&0x03, set[1]>>4&0x03
+		// With only the inside or the outside changed, the border goes with it
+		if control == 0x01 {
+			control, border = 0x03, inside
+		} else if control == 0x04 {
+			control, border = 0x06, outside
+		}
+		x1, y1, x2, y2 := int(set[2]), int(set[3]), int(set[4]), int(set[5])
+
+		for y := 0; y < 18; y++ {
+			for x := 0; x < 20; x++ {
+				switch {
+				case x > x1 && x < x2 && y > y1 && y < y2:
+					if control&0x01 != 0 {
+						sgb.attributes[y][x] = inside
+					}
+				case x >= x1 && x <= x2 && y >= y1 && y <= y2:
+					if control&0x02 != 0 {
+						sgb.attributes[y][x] = border
+					}
+				default:
+					if control&0x04 != 0 {
+						sgb.attributes[y][x] = outside
+					}
+				}
+			}
+		}
+	}
+}
+
+/*
+ATTR_LIN: one byte per line of cells, the line number in bits 0-4,
+the palette in bits 5-6 and bit 7 set for a horizontal line.
+*/
+func (sgb *SGB) attributeLines(data []byte) {
+	count := int(data[1])
+	for i := 0; i < count && 2+i < len(data); i++ {
+		line := int(data[2+i] & 0x1F)
+		palette := data[2+i] >> 5 & 0x03
+		if data[2+i]&0x80 != 0 {
+			for x := 0; x < 20 && line < 18; x++ {
+				sgb.attributes[line][x] = palette
+			}
+		} else {
+			for y := 0; y < 18 && line < 20; y++ {
+				sgb.attributes[y][line] = palette
+			}
+		}
+	}
+}
+
+/*
+ATTR_DIV: split the screen in two at a line of cells.
+
+	byte 1 - palette below/right (bits 0-1), above/left (2-3),
+	         on the line (4-5), bit 6 set to divide horizontally
+	byte 2 - coordinate of the line
+*/
+func (sgb *SGB) attributeDivide(data []byte) {
+	after, before, on := data[1]&0x03, data[1]>>2&0x03, data[1]>>4&0x03
+	horizontal := data[1]&0x40 != 0
+	line := int(data[2])
+	for y := 0; y < 18; y++ {
+		for x := 0; x < 20; x++ {
+			position := x
+			if horizontal {
+				position = y
+			}
+			switch {
+			case position < line:
+				sgb.attributes[y][x] = before
+			case position == line:
+				sgb.attributes[y][x] = on
+			default:
+				sgb.attributes[y][x] = after
+			}
+		}
+	}
+}
+
+/*
+ATTR_CHR: palettes of consecutive cells starting at X (byte 1), Y (byte 2),
+the number of cells in bytes 3-4, byte 5 is 0 to go left to right and 1
+to go top to bottom. 4 cells per byte, the first one in bits 6-7.
+*/
+func (sgb *SGB) attributeCharacters(data []byte) {
+	x, y := int(data[1]), int(data[2])
+	count := int(data[3]) | int(data[4])<<8
+	vertical := data[5] == 1
+	for i := 0; i < count && 6+i/4 < len(data) && x < 20 && y < 18; i++ {
+		sgb.attributes[y][x] = data[6+i/4] >> uint(6-i%4*2) & 0x03
+		if vertical {
+			if y++; y == 18 {
+				y = 0
+				x++
+			}
+		} else {
+			if x++; x == 20 {
+				x = 0
+				y++
+			}
+		}
+	}
+}
+
+// Apply one of the attribute files set with ATTR_TRN
+func (sgb *SGB) applyAttributeFile(file byte) {
+	if int(file) >= len(sgb.attributeFiles) {
+		return
+	}
+	for i := 0; i < 360; i++ {
+		sgb.attributes[i/20][i%20] = sgb.attributeFiles[file][i/4] >> uint(6-i%4*2) & 0x03
+	}
+}
+
+/*
+Called at the start of every V-Blank: do the pending VRAM transfer from
+the frame just drawn and compose the screen with the border.
+*/
+func (core *Core) sgbFrame() {
+	sgb := &core.SGB
+	if sgb.transfer != 0 {
+		core.sgbTransfer()
+		sgb.transfer = 0
+	}
+
+	// The border map covers 32x28 tiles, the game screen starts at tile (6, 5)
+	backdrop := sgb.palettes[0][0]
+	for row := 0; row < 28; row++ {
+		for column := 0; column < 32; column++ {
+			entry := sgb.borderMap[row*32+column]
+			tile := sgb.borderTiles[int(entry&0xFF)*32:]
+			palette := &sgb.borderPalettes[entry>>10&0x03]
+			for y := 0; y < 8; y++ {
+				tileY := y
+				if entry&0x8000 != 0 {
+					tileY = 7 - y
+				}
+				for x := 0; x < 8; x++ {
+					bit := uint(7 - x)
+					if entry&0x4000 != 0 {
+						bit = uint(x)
+					}
+					colourNum := tile[tileY*2]>>bit&1 |
+						tile[tileY*2+1]>>bit&1<<1 |
+						tile[16+tileY*2]>>bit&1<<2 |
+						tile[16+tileY*2+1]>>bit&1<<3
+
+					colour := backdrop
+					if colourNum != 0 {
+						colour = palette[colourNum]
+					}
+					core.SGBScreen[column*8+x][row*8+y] = colour
+				}
+			}
+		}
+	}
+
+	for x := 0; x < 160; x++ {
+		for y := 0; y < 144; y++ {
+			core.SGBScreen[48+x][40+y] = core.Screen[x][y]
+		}
+	}
+}
+
+/*
+Read the 4KB of data of a VRAM transfer from the screen: the first 256
+tiles drawn, 20 per row, encoded as 2bpp tiles of the displayed shades.
+*/
+func (core *Core) sgbTransfer() {
+	var data [4096]byte
+	for i := range data {
+		tile, row := i/16, i%16/2
+		x, y := tile%20*8, tile/20*8+row
+		for bit := 0; bit < 8; bit++ {
+			shade := core.Shades[x+bit][y]
+			if i%2 == 1 {
+				shade >>= 1
+			}
+			data[i] |= (shade & 1) << uint(7-bit)
+		}
+	}
+
+	sgb := &core.SGB
+	switch sgb.transfer {
+	case sgbPALTRN:
+		for i := range sgb.systemPalettes {
+			for c := 0; c < 4; c++ {
+				sgb.systemPalettes[i][c] = sgbColour(data[i*8+c*2], data[i*8+c*2+1])
+			}
+		}
+	case sgbCHRTRN:
+		copy(sgb.borderTiles[int(sgb.transferFlags&1)*0x1000:], data[:])
+	case sgbPCTTRN:
+		for i := range sgb.borderMap {
+			sgb.borderMap[i] = uint16(data[i*2]) | uint16(data[i*2+1])<<8
+		}
+		for p := range sgb.borderPalettes {
+			for c := 0; c < 16; c++ {
+				offset := 0x800 + p*32 + c*2
+				sgb.borderPalettes[p][c] = sgbColour(data[offset], data[offset+1])
+			}
+		}
+	case sgbATTRTRN:
+		for i := range sgb.attributeFiles {
+			copy(sgb.attributeFiles[i][:], data[i*90:])
+		}
+	}
+}
+
+// Colour of a pixel of the game screen
+func (sgb *SGB) colour(x int, y int, shade byte) Colour {
+	switch sgb.mask {
+	case 2:
+		return black
+	case 3:
+		return sgb.palettes[0][0]
+	}
+	return sgb.palettes[sgb.attributes[y/8][x/8]][shade]
+}
+
+/*
+Buttons of the player selected with MLT_REQ. The ID of the selected
+player is returned as well, it's read from FF00 while both P14 and P15
+are high.
+*/
+func (sgb *SGB) selectedJoypad(player1 byte) (buttons byte, id int) {
+	if sgb.joypadID == 0 {
+		return player1, 0
+	}
+	return sgb.Joypads[sgb.joypadID-1], sgb.joypadID
+}
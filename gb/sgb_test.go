@@ -0,0 +1,61 @@
+package gb
+
+import (
+	"testing"
+
+	"github.com/HFO4/gbc-in-cloud/driver"
+)
+
+// Send a packet to the SGB through FF00, one pulse per bit as games do
+func sendSGBPacket(core *Core, packet [16]byte) {
+	core.WriteMemory(0xFF00, 0x00)
+	core.WriteMemory(0xFF00, 0x30)
+	for bit := 0; bit < 128; bit++ {
+		if packet[bit/8]&(1<<uint(bit%8)) != 0 {
+			core.WriteMemory(0xFF00, 0x10)
+		} else {
+			core.WriteMemory(0xFF00, 0x20)
+		}
+		core.WriteMemory(0xFF00, 0x30)
+	}
+	// Stop bit
+	core.WriteMemory(0xFF00, 0x20)
+	core.WriteMemory(0xFF00, 0x30)
+}
+
+// The buttons of player 2, pressed through the controller, are read back after MLT_REQ
+func TestSGBMultiplayerJoypad(t *testing.T) {
+	controller := &driver.EventQueue{}
+	core := &Core{Controller: controller, JoypadStatus: 0xFF}
+	core.SGB.Enabled = true
+	core.initSGB()
+
+	controller.Press(driver.PlayerButton(2, driver.ButtonA))
+	core.pollInput()
+
+	sendSGBPacket(core, [16]byte{sgbMLTREQ<<3 | 1, 0x01})
+	if core.SGB.players != 2 {
+		t.Fatalf("%d players after MLT_REQ, want 2", core.SGB.players)
+	}
+
+	// Player 1 is selected first, reading the buttons of player 1
+	core.WriteMemory(0xFF00, 0x10)
+	if buttons := core.ReadMemory(0xFF00) & 0x0F; buttons != 0x0F {
+		t.Errorf("player 1 buttons read %#x, want 0xf", buttons)
+	}
+	// P15 going high selects player 2
+	core.WriteMemory(0xFF00, 0x30)
+	if id := core.ReadMemory(0xFF00) & 0x0F; id != 0x0E {
+		t.Errorf("joypad ID read %#x, want 0xe", id)
+	}
+	core.WriteMemory(0xFF00, 0x10)
+	if buttons := core.ReadMemory(0xFF00) & 0x0F; buttons != 0x0E {
+		t.Errorf("player 2 buttons read %#x, want 0xe with A pressed", buttons)
+	}
+
+	controller.Release(driver.PlayerButton(2, driver.ButtonA))
+	core.pollInput()
+	if buttons := core.ReadMemory(0xFF00) & 0x0F; buttons != 0x0F {
+		t.Errorf("player 2 buttons read %#x after the release, want 0xf", buttons)
+	}
+}
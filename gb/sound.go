@@ -1,169 +1,443 @@
 package gb
 
 import (
-	"github.com/HFO4/gbc-in-cloud/util"
-	"github.com/faiface/beep"
-	"github.com/faiface/beep/effects"
-	"github.com/faiface/beep/speaker"
 	"log"
-	"math"
-	"math/rand"
+	"sync"
 	"time"
+
+	"github.com/faiface/beep"
+	"github.com/faiface/beep/speaker"
 )
 
+/*
+The APU. It's clocked with the CPU cycles by Core.Step: the frequency
+timers of the channels count cycles and a frame sequencer clocks the
+length counters (256 Hz), the sweep (128 Hz) and the envelopes (64 Hz)
+every 8192 cycles, so everything follows the emulated time whatever
+speed the emulator runs at.
+
+The output levels are band-limited (see blip.go) into a buffer of
+44100 Hz samples, read by the speaker or the recording.
+*/
 type Sound struct {
-	Channel4 Channel
-	Channel3 Channel
-	Channel2 Channel
-	Channel1 Channel
+	Channel1 SquareChannel
+	Channel2 SquareChannel
+	Channel3 WaveChannel
+	Channel4 NoiseChannel
+
+	// NR52 bit 7, all sound on/off
+	power bool
+	// Last value written to FF10-FF3F
+	registers [0x30]byte
+
+	// Step of the frame sequencer (0-7) and cycles until the next one
+	sequencerStep  int
+	sequencerTimer int
+
+	// Part of the volume turned down, see SetVolume
+	attenuation float64
+	// Channels left out of the mix, guarded by outputLock, see ToggleMute and ToggleSolo
+	muted  [4]bool
+	soloed [4]bool
+	// Recent output of every channel, see Scope
+	scope      [4][scopeLength]float64
+	scopeNext  int
+	scopePhase float64
+
+	// Samples are produced only once Init is called
+	output       bool
+	outputLock   sync.Mutex
+	left, right  blipBuffer
+	lastLeft     float64
+	lastRight    float64
+	samplePos    float64
+	latestSample [2]float64
+	// Samples read by the recording, for the speaker, see PlayRecorded
+	replaying bool
+	replayed  [][2]float64
+}
 
-	enable bool
+const (
+	SoundSampleRate = 44100
+	// Samples per CPU cycle
+	sampleStep = SoundSampleRate / 4194304.0
+	// Cycles between two steps of the frame sequencer, 512 Hz
+	sequencerPeriod = 8192
+	// Samples kept when nobody reads them fast enough, 0.2s
+	maxBufferedSamples = SoundSampleRate / 5
+	// Volume of the mixed channels
+	mixVolume = 0.5
+	// Samples kept by the scope of every channel
+	scopeLength = 2048
+)
 
-	leftVolume  uint8
-	rightVolume uint8
+/*
+Unused bits of the sound registers, read as 1. Write-only registers
+(the frequencies) read as FFh.
+*/
+var soundReadMasks = [0x30]byte{
+	0x80, 0x3F, 0x00, 0xFF, 0xBF, // NR10-NR14
+	0xFF, 0x3F, 0x00, 0xFF, 0xBF, // NR20-NR24
+	0x7F, 0xFF, 0x9F, 0xFF, 0xBF, // NR30-NR34
+	0xFF, 0xFF, 0x00, 0x00, 0xBF, // NR40-NR44
+	0x00, 0x00, 0x70, // NR50-NR52
+	0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF,
+}
 
-	VRAMCache   []byte
-	SampleCache [32]float64
+/*
+Power the APU on with the registers the boot ROM leaves, the channel 1
+still on from the boot sound, at volume 0.
+*/
+func (sound *Sound) Reset() {
+	sound.outputLock.Lock()
+	sound.Channel1 = SquareChannel{hasSweep: true}
+	sound.Channel2 = SquareChannel{}
+	sound.Channel3 = WaveChannel{}
+	sound.Channel4 = NoiseChannel{}
+	sound.power = false
+	sound.registers = [0x30]byte{}
+	sound.left, sound.right = blipBuffer{}, blipBuffer{}
+	sound.lastLeft, sound.lastRight, sound.samplePos = 0, 0, 0
+	sound.outputLock.Unlock()
+
+	sound.WriteRegister(0xFF26, 0x80)
+	for address, value := range map[uint16]byte{
+		0xFF10: 0x80, 0xFF11: 0xBF, 0xFF12: 0xF3, 0xFF14: 0x3F,
+		0xFF16: 0x3F, 0xFF17: 0x00, 0xFF19: 0x3F,
+		0xFF1A: 0x7F, 0xFF1B: 0xFF, 0xFF1C: 0x9F, 0xFF1E: 0x3F,
+		0xFF20: 0xFF, 0xFF21: 0x00, 0xFF22: 0x00, 0xFF23: 0x3F,
+		0xFF24: 0x77, 0xFF25: 0xF3,
+	} {
+		sound.WriteRegister(address, value)
+	}
+	sound.Channel1.enabled = true
+	sound.Channel1.envelope.volume = 0
+}
+
+// Start producing samples, for the speaker or a recording
+func (sound *Sound) Init() {
+	log.Println("[Sound] Initialize Sound process unit")
+	sound.outputLock.Lock()
+	sound.output = true
+	sound.outputLock.Unlock()
+}
+
+// Play the samples on the speaker
+func (sound *Sound) Play() {
+	sr := beep.SampleRate(SoundSampleRate)
+	err := speaker.Init(sr, sr.N(time.Second/30))
+	if err != nil {
+		log.Println("[Warning] Failed to init sound speaker")
+		return
+	}
+	speaker.Play(soundStream{sound: sound})
 }
 
-type Channel struct {
-	self   *Channel
-	parent *Sound
+/*
+PlayRecorded Play on the speaker the samples read by the recording, as
+they can't both read them: the recording gives them back with Replay.
+*/
+func (sound *Sound) PlayRecorded() {
+	sound.outputLock.Lock()
+	sound.replaying = true
+	sound.outputLock.Unlock()
+	sr := beep.SampleRate(SoundSampleRate)
+	err := speaker.Init(sr, sr.N(time.Second/30))
+	if err != nil {
+		log.Println("[Warning] Failed to init sound speaker")
+		return
+	}
+	speaker.Play(soundStream{sound: sound, replay: true})
+}
 
-	enable bool
+// Replay Queue samples read by the recording for the speaker, see PlayRecorded
+func (sound *Sound) Replay(samples [][2]float64) {
+	sound.outputLock.Lock()
+	defer sound.outputLock.Unlock()
+	if !sound.replaying {
+		return
+	}
+	sound.replayed = append(sound.replayed, samples...)
+	// The speaker is late, it skips the oldest ones
+	if surplus := len(sound.replayed) - maxBufferedSamples; surplus > 0 {
+		sound.replayed = sound.replayed[:copy(sound.replayed, sound.replayed[surplus:])]
+	}
+}
 
-	envelopeIncrease bool
-	envelopeInitial  byte
-	envelopeSweepNum byte
-	lastEnvelope     float64
-	envelopeTick     float64
+// Read the samples queued by Replay, up to len(samples)
+func (sound *Sound) readReplayed(samples [][2]float64) int {
+	sound.outputLock.Lock()
+	defer sound.outputLock.Unlock()
+	n := copy(samples, sound.replayed)
+	sound.replayed = sound.replayed[:copy(sound.replayed, sound.replayed[n:])]
+	if n > 0 {
+		sound.latestSample = samples[n-1]
+	}
+	return n
+}
 
-	sweepIncrease bool
-	sweepNumber   byte
-	sweepTime     int
-	lastSweep     float64
-	sweepTick     float64
-	freqInitial   int
-	freqLast      int
+// Streamer of the samples for the speaker
+type soundStream struct {
+	sound *Sound
+	// Play the samples given back by the recording
+	replay bool
+}
 
-	stopWhileTimeout bool
+/*
+The emulator produces samples in bursts, once per Update. When it's
+late the last sample is repeated rather than stopping the stream.
+*/
+func (stream soundStream) Stream(samples [][2]float64) (n int, ok bool) {
+	var read int
+	if stream.replay {
+		read = stream.sound.readReplayed(samples)
+	} else {
+		read = stream.sound.ReadSamples(samples)
+	}
+	for i := read; i < len(samples); i++ {
+		samples[i] = stream.sound.latestSample
+	}
+	return len(samples), true
+}
 
-	Freq     int
-	freqLow  uint16
-	freqHigh uint16
-	waveDuty byte
+func (stream soundStream) Err() error {
+	return nil
+}
 
-	volume float64
+/*
+Advance the APU by CPU cycles. The time is cut at every event (a
+frequency timer or the frame sequencer reaching zero) and the output
+levels are checked after each of them.
+*/
+func (sound *Sound) Update(cycles int) {
+	sound.outputLock.Lock()
+	defer sound.outputLock.Unlock()
+
+	for cycles > 0 {
+		step := cycles
+		if sound.power && sound.sequencerTimer < step {
+			step = sound.sequencerTimer
+		}
+		for _, timer := range []int{sound.Channel1.timer, sound.Channel2.timer, sound.Channel3.timer, sound.Channel4.timer} {
+			if timer > 0 && timer < step {
+				step = timer
+			}
+		}
 
-	duration   float64
-	sampleTick float64
-	tickUnit   float64
+		if sound.power {
+			sound.sequencerTimer -= step
+			if sound.sequencerTimer <= 0 {
+				sound.sequencerTimer += sequencerPeriod
+				sound.clockSequencer()
+			}
+		}
+		if sound.Channel1.enabled {
+			if sound.Channel1.timer -= step; sound.Channel1.timer <= 0 {
+				sound.Channel1.clockTimer()
+			}
+		}
+		if sound.Channel2.enabled {
+			if sound.Channel2.timer -= step; sound.Channel2.timer <= 0 {
+				sound.Channel2.clockTimer()
+			}
+		}
+		if sound.Channel3.enabled {
+			if sound.Channel3.timer -= step; sound.Channel3.timer <= 0 {
+				sound.Channel3.clockTimer()
+			}
+		}
+		if sound.Channel4.enabled {
+			if sound.Channel4.timer -= step; sound.Channel4.timer <= 0 {
+				sound.Channel4.clockTimer()
+			}
+		}
 
-	// For noise wave
-	lastGenerate     float64
-	lastGenerateTick float64
+		cycles -= step
+		sound.tapScope(step)
+		if sound.output {
+			sound.samplePos += float64(step) * sampleStep
+			sound.mix()
+		}
+	}
 
-	// Wave type
-	//		0 - Square
-	//		1 - Noise
-	//		2 - Sample
-	wave int
+	if sound.output && int(sound.samplePos) > maxBufferedSamples {
+		// Nobody reads the samples fast enough, drop the oldest
+		sound.readSamples(make([][2]float64, int(sound.samplePos)-maxBufferedSamples))
+	}
 }
 
 /*
-	Wave Duty:
-	  00: 12.5% ( _-------_-------_------- )
-	  01: 25%   ( __------__------__------ )
-	  10: 50%   ( ____----____----____---- ) (normal)
-	  11: 75%   ( ______--______--______-- )
+Frame sequencer:
+
+	Step   Length Ctr  Vol Env     Sweep
+	---------------------------------------
+	0      Clock       -           -
+	1      -           -           -
+	2      Clock       -           Clock
+	3      -           -           -
+	4      Clock       -           -
+	5      -           -           -
+	6      Clock       -           Clock
+	7      -           Clock       -
 */
-var waveDutyMap = [5]float64{
-	1: -0.25,
-	2: -0.5,
-	3: 0,
-	4: 0.5,
+func (sound *Sound) clockSequencer() {
+	switch sound.sequencerStep {
+	case 0, 2, 4, 6:
+		if !sound.Channel1.length.clock() {
+			sound.Channel1.enabled = false
+		}
+		if !sound.Channel2.length.clock() {
+			sound.Channel2.enabled = false
+		}
+		if !sound.Channel3.length.clock() {
+			sound.Channel3.enabled = false
+		}
+		if !sound.Channel4.length.clock() {
+			sound.Channel4.enabled = false
+		}
+		if sound.sequencerStep == 2 || sound.sequencerStep == 6 {
+			sound.Channel1.clockSweep()
+		}
+	case 7:
+		sound.Channel1.envelope.clock()
+		sound.Channel2.envelope.clock()
+		sound.Channel4.envelope.clock()
+	}
+	sound.sequencerStep = (sound.sequencerStep + 1) & 7
 }
 
-var sweepTime = [8]float64{
-	0: 0.0,
-	1: 1.0 / 128,
-	2: 2.0 / 128,
-	3: 3.0 / 128,
-	4: 4.0 / 128,
-	5: 5.0 / 128,
-	6: 6.0 / 128,
-	7: 7.0 / 128,
+/*
+Mix the channels into the left (SO2) and right (SO1) outputs and add
+the change of level to the buffers.
+
+	FF25 - NR51 - Selection of Sound output terminal (R/W)
+	  Bit 7-4 - Output sound 4-1 to SO2 terminal
+	  Bit 3-0 - Output sound 4-1 to SO1 terminal
+	FF24 - NR50 - Channel control / ON-OFF / Volume (R/W)
+	  Bit 6-4 - SO2 output level (volume)  (0-7)
+	  Bit 2-0 - SO1 output level (volume)  (0-7)
+*/
+func (sound *Sound) mix() {
+	if !sound.output {
+		return
+	}
+	var left, right float64
+	if sound.power {
+		panning := sound.registers[0x15]
+		for i, analog := range sound.channelOutputs() {
+			if !sound.audible(i) {
+				continue
+			}
+			if panning>>uint(i+4)&1 != 0 {
+				left += analog
+			}
+			if panning>>uint(i)&1 != 0 {
+				right += analog
+			}
+		}
+		volume := sound.registers[0x14]
+		left *= float64(volume>>4&0x7+1) / 8 / 4 * mixVolume * (1 - sound.attenuation)
+		right *= float64(volume&0x7+1) / 8 / 4 * mixVolume * (1 - sound.attenuation)
+	}
+
+	if left != sound.lastLeft {
+		sound.left.addDelta(sound.samplePos, left-sound.lastLeft)
+		sound.lastLeft = left
+	}
+	if right != sound.lastRight {
+		sound.right.addDelta(sound.samplePos, right-sound.lastRight)
+		sound.lastRight = right
+	}
 }
 
-const secondPerTick = 1 / 44100.0
+// Analog output of the DAC of every channel, -1 to 1, 0 when the DAC is off
+func (sound *Sound) channelOutputs() [4]float64 {
+	dacs := [4]bool{sound.Channel1.envelope.dacEnabled(), sound.Channel2.envelope.dacEnabled(), sound.Channel3.dacEnabled, sound.Channel4.envelope.dacEnabled()}
+	outputs := [4]byte{sound.Channel1.output(), sound.Channel2.output(), sound.Channel3.output(), sound.Channel4.output()}
+	var analog [4]float64
+	for i, output := range outputs {
+		if dacs[i] {
+			analog[i] = float64(output)/7.5 - 1
+		}
+	}
+	return analog
+}
 
-func (sound *Sound) Init() {
-	log.Println("[Sound] Initialize Sound process unit")
-	sound.enable = true
-	sound.Channel2.enable = false
-	sound.Channel2.self = &sound.Channel2
-	sound.Channel2.parent = sound
-
-	sound.Channel1.enable = false
-	sound.Channel1.self = &sound.Channel1
-	sound.Channel1.parent = sound
-
-	sound.Channel3.enable = false
-	sound.Channel3.self = &sound.Channel3
-	sound.Channel3.parent = sound
-	sound.Channel3.wave = 3
-
-	sound.Channel4.enable = false
-	sound.Channel4.self = &sound.Channel4
-	sound.Channel4.parent = sound
-	sound.Channel4.wave = 2
-
-	sound.Play()
+/*
+Read the samples produced so far, up to len(samples), returns the
+number of samples read.
+*/
+func (sound *Sound) ReadSamples(samples [][2]float64) int {
+	sound.outputLock.Lock()
+	defer sound.outputLock.Unlock()
+	return sound.readSamples(samples)
 }
 
-func (sound *Sound) Play() {
-	sr := beep.SampleRate(44100)
-	err := speaker.Init(sr, sr.N(time.Second/30))
-	if err != nil {
-		log.Println("[Warning] Failed to init sound speaker")
+func (sound *Sound) readSamples(samples [][2]float64) int {
+	// Samples before the current position don't change anymore
+	available := int(sound.samplePos)
+	left := make([]float64, len(samples))
+	right := make([]float64, len(samples))
+	n := sound.left.read(left, available)
+	sound.right.read(right, available)
+	for i := 0; i < n; i++ {
+		samples[i] = [2]float64{left[i], right[i]}
+	}
+	if n > 0 {
+		sound.latestSample = samples[n-1]
 	}
+	sound.samplePos -= float64(n)
+	return n
+}
 
-	stream := &beep.Mixer{}
-	stream.Add(sound.Channel1)
-	stream.Add(sound.Channel2)
-	stream.Add(sound.Channel3)
-	stream.Add(sound.Channel4)
-
-	//done := make(chan bool)
-	//rawStream := beep.Seq(&stream, beep.Callback(func() {
-	//	done <- true
-	//}))
-	volume := &effects.Volume{
-		Streamer: stream,
-		Base:     2,
-		Volume:   -3,
+// Number of samples which can be read
+func (sound *Sound) BufferedSamples() int {
+	sound.outputLock.Lock()
+	defer sound.outputLock.Unlock()
+	return int(sound.samplePos)
+}
+
+func (sound *Sound) ReadRegister(address uint16) byte {
+	index := address - 0xFF10
+	switch {
+	case address == 0xFF26:
+		status := byte(0x70)
+		if sound.power {
+			status |= 0x80
+		}
+		for i, enabled := range []bool{sound.Channel1.enabled, sound.Channel2.enabled, sound.Channel3.enabled, sound.Channel4.enabled} {
+			if enabled {
+				status |= 1 << uint(i)
+			}
+		}
+		return status
+	case address >= 0xFF30:
+		// While the channel 3 plays, the wave RAM reads the sample being played
+		if sound.Channel3.enabled {
+			return sound.Channel3.ram[sound.Channel3.position/2]
+		}
+		return sound.Channel3.ram[address-0xFF30]
 	}
-	speaker.Play(volume)
-	//<-done
+	return sound.registers[index] | soundReadMasks[index]
 }
 
 /*
-	When sound related memory is writen, this function will be
-	called to update sound props.
+When sound related memory is writen, update the channels. While the
+APU is off only NR52 and the wave RAM can be written.
 */
-func (sound *Sound) Trigger(address uint16, val byte, vram []byte) {
-	sound.VRAMCache = vram
-	//log.Printf("new Sound:%X : %X tick:%d\n", address, val,sound.Channel2.sampleTick)
+func (sound *Sound) WriteRegister(address uint16, val byte) {
+	sound.outputLock.Lock()
+	defer sound.outputLock.Unlock()
+
 	if address >= 0xFF30 {
-		count := 0
-		for i := 0; i < 0xF; i++ {
-			sound.SampleCache[count] = float64(vram[0x20+i]>>4) / float64(0xf)
-			count++
-			sound.SampleCache[count] = float64(vram[0x20+i]&0xF) / float64(0xf)
+		if sound.Channel3.enabled {
+			sound.Channel3.ram[sound.Channel3.position/2] = val
+		} else {
+			sound.Channel3.ram[address-0xFF30] = val
 		}
+		return
 	}
-	switch address {
-	case 0xFF26:
+	if address == 0xFF26 {
 		/*
 			FF26 - NR52 - Sound on/off
 			  Bit 7 - All sound on/off  (0: stop all sound circuits) (Read/Write)
@@ -172,75 +446,78 @@ func (sound *Sound) Trigger(address uint16, val byte, vram []byte) {
 			  Bit 1 - Sound 2 ON flag (Read Only)
 			  Bit 0 - Sound 1 ON flag (Read Only)
 		*/
-		sound.enable = util.TestBit(val, 7)
-	case 0xFF25:
-		/*
-			FF25 - NR51 - Selection of Sound output terminal (R/W)
-			  Bit 7 - Output sound 4 to SO2 terminal
-			  Bit 6 - Output sound 3 to SO2 terminal
-			  Bit 5 - Output sound 2 to SO2 terminal
-			  Bit 4 - Output sound 1 to SO2 terminal
-			  Bit 3 - Output sound 4 to SO1 terminal
-			  Bit 2 - Output sound 3 to SO1 terminal
-			  Bit 1 - Output sound 2 to SO1 terminal
-			  Bit 0 - Output sound 1 to SO1 terminal
-
-			TODO: Separate Right/Left channel
-		*/
-		if !(util.TestBit(val, 5) || util.TestBit(val, 1)) {
-			sound.Channel2.enable = false
+		power := val&0x80 != 0
+		if sound.power && !power {
+			// Turning the APU off clears all the registers, on the DMG the length counters are kept
+			for address := uint16(0xFF10); address < 0xFF26; address++ {
+				switch address {
+				case 0xFF11:
+					sound.registers[address-0xFF10] = 0
+					sound.Channel1.duty = 0
+				case 0xFF16:
+					sound.registers[address-0xFF10] = 0
+					sound.Channel2.duty = 0
+				case 0xFF1B, 0xFF20:
+					sound.registers[address-0xFF10] = 0
+				default:
+					sound.writeChannelRegister(address, 0)
+				}
+			}
+		} else if !sound.power && power {
+			sound.sequencerStep = 0
+			sound.sequencerTimer = sequencerPeriod
+			sound.Channel1.dutyStep = 0
+			sound.Channel2.dutyStep = 0
 		}
-	case 0xFF24:
-		/*
-			FF24 - NR50 - Channel control / ON-OFF / Volume (R/W)
-				The volume bits specify the "Master Volume" for Left/Right sound output.
-				  Bit 7   - Output Vin to SO2 terminal (1=Enable)
-				  Bit 6-4 - SO2 output level (volume)  (0-7)
-				  Bit 3   - Output Vin to SO1 terminal (1=Enable)
-				  Bit 2-0 - SO1 output level (volume)  (0-7)
-		*/
-		sound.leftVolume = uint8(val & 0x7)
-		sound.rightVolume = uint8((val >> 4) & 0x7)
-	// Channel 1
-	case 0xFF14:
-		if util.TestBit(val, 7) {
-			sound.Channel1.reSet()
-			//Envelope options
-			sound.Channel1.envelopeIncrease = util.TestBit(sound.VRAMCache[0x02], 3)
-			sound.Channel1.envelopeInitial = (sound.VRAMCache[0x02] & 0xF0) >> 4
-			sound.Channel1.envelopeSweepNum = sound.VRAMCache[0x02] & 0x7
-			sound.Channel1.volume = float64(sound.Channel1.envelopeInitial) / float64(0xf)
-
-			//Sweep options
-			sound.Channel1.sweepIncrease = !util.TestBit(sound.VRAMCache[0x00], 3)
-			sound.Channel1.sweepNumber = sound.VRAMCache[0x00] & 0x7
-			sound.Channel1.sweepTime = int((sound.VRAMCache[0x00] & 0x70) >> 4)
-
-			sound.Channel1.freqInitial = int(sound.Channel1.freqHigh + sound.Channel1.freqLow)
-			sound.Channel1.freqLast = int(sound.Channel1.freqHigh + sound.Channel1.freqLow)
-
-			sound.Channel1.stopWhileTimeout = util.TestBit(val, 6)
-			sound.Channel1.freqHigh = uint16((val & 0x7)) << 8
-			sound.Channel1.Freq = 131072 / (2048 - int(sound.Channel1.freqHigh+uint16(sound.VRAMCache[0x03])))
-			sound.Channel1.tickUnit = 44100.0 / float64(sound.Channel1.Freq)
-
-			sound.Channel1.waveDuty = (sound.VRAMCache[0x01] >> 6) + 1
-			sound.Channel1.duration = (64.0 - float64(sound.VRAMCache[0x01]&0x3F)) * (1.0 / 256.0)
-
-			sound.Channel1.enable = true
+		sound.power = power
+		sound.mix()
+		return
+	}
+	if !sound.power || address > 0xFF26 {
+		return
+	}
+	sound.writeChannelRegister(address, val)
+	sound.mix()
+}
 
-			//log.Println(sound.Channel1)
+func (sound *Sound) writeChannelRegister(address uint16, val byte) {
+	sound.registers[address-0xFF10] = val
+	switch address {
+	// Channel 1
+	case 0xFF10:
+		sound.Channel1.sweepRegister = val
+		// Clearing the subtraction after a subtraction was used turns the channel off
+		if val&0x08 == 0 && sound.Channel1.sweepNegated {
+			sound.Channel1.enabled = false
 		}
-		//log.Println(sound.Channel1)
 	case 0xFF11:
-		sound.Channel1.waveDuty = (sound.VRAMCache[0x01] >> 6) + 1
+		sound.Channel1.duty = val >> 6
+		sound.Channel1.length.counter = 64 - int(val&0x3F)
+	case 0xFF12:
+		sound.Channel1.envelope.register = val
+		if !sound.Channel1.envelope.dacEnabled() {
+			sound.Channel1.enabled = false
+		}
 	case 0xFF13:
-		//sound.Channel1.freqLow = uint16(val)
-		//sound.Channel1.Freq = 131072 / (2048 - int(sound.Channel1.freqHigh+sound.Channel1.freqLow))
-		//sound.Channel1.tickUnit = 44100.0 / float64(sound.Channel1.Freq)
-		//log.Println(sound.Channel1)
+		sound.Channel1.frequency = sound.Channel1.frequency&0x700 | int(val)
+	case 0xFF14:
+		sound.Channel1.frequency = sound.Channel1.frequency&0xFF | int(val&0x7)<<8
+		sound.Channel1.length.enabled = val&0x40 != 0
+		if val&0x80 != 0 {
+			sound.Channel1.trigger()
+		}
 
 	// Channel 2
+	case 0xFF16:
+		sound.Channel2.duty = val >> 6
+		sound.Channel2.length.counter = 64 - int(val&0x3F)
+	case 0xFF17:
+		sound.Channel2.envelope.register = val
+		if !sound.Channel2.envelope.dacEnabled() {
+			sound.Channel2.enabled = false
+		}
+	case 0xFF18:
+		sound.Channel2.frequency = sound.Channel2.frequency&0x700 | int(val)
 	case 0xFF19:
 		/*
 			FF19 - NR24 - Channel 2 Frequency hi data (R/W)
@@ -250,237 +527,46 @@ func (sound *Sound) Trigger(address uint16, val byte, vram []byte) {
 			  Bit 2-0 - Frequency's higher 3 bits (x) (Write Only)
 			Frequency = 131072/(2048-x) Hz
 		*/
-		if util.TestBit(val, 7) {
-			sound.Channel2.reSet()
-			sound.Channel2.envelopeIncrease = util.TestBit(sound.VRAMCache[0x07], 3)
-			sound.Channel2.envelopeInitial = (sound.VRAMCache[0x07] & 0xF0) >> 4
-			sound.Channel2.envelopeSweepNum = sound.VRAMCache[0x07] & 0x7
-			sound.Channel2.volume = float64(sound.Channel2.envelopeInitial) / float64(0xf)
-
-			sound.Channel2.stopWhileTimeout = util.TestBit(val, 6)
-			sound.Channel2.freqHigh = uint16((val & 0x7)) << 8
-			sound.Channel2.Freq = 131072 / (2048 - int(sound.Channel2.freqHigh+sound.Channel2.freqLow))
-			sound.Channel2.tickUnit = 44100.0 / float64(sound.Channel2.Freq)
-
-			sound.Channel2.waveDuty = (sound.VRAMCache[0x06] >> 6) + 1
-			sound.Channel2.duration = (64.0 - float64(sound.VRAMCache[0x06]&0x3F)) * (1.0 / 256.0)
-
-			sound.Channel2.enable = true
+		sound.Channel2.frequency = sound.Channel2.frequency&0xFF | int(val&0x7)<<8
+		sound.Channel2.length.enabled = val&0x40 != 0
+		if val&0x80 != 0 {
+			sound.Channel2.trigger()
 		}
-		//log.Println(sound.Channel2)
-	case 0xFF18:
-		/*
-			FF18 - NR23 - Channel 2 Frequency lo data (W)
-				Frequency's lower 8 bits of 11 bit data (x).
-				Next 3 bits are in NR24 ($FF19).
-		*/
-		sound.Channel2.freqLow = uint16(val)
-		sound.Channel2.Freq = 131072 / (2048 - int(sound.Channel2.freqHigh+sound.Channel2.freqLow))
-		sound.Channel2.tickUnit = 44100.0 / float64(sound.Channel2.Freq)
 
-	//Channel 3
+	// Channel 3
 	case 0xFF1A:
-		/*
-			FF1A - NR30 - Channel 3 Sound on/off (R/W)
-			  Bit 7 - Sound Channel 3 Off  (0=Stop, 1=Playback)  (Read/Write)
-		*/
-		if util.TestBit(val, 7) {
-			sound.Channel3.enable = true
-		} else {
-			sound.Channel3.enable = false
+		// FF1A - NR30 - Bit 7 - Sound Channel 3 Off  (0=Stop, 1=Playback)
+		sound.Channel3.dacEnabled = val&0x80 != 0
+		if !sound.Channel3.dacEnabled {
+			sound.Channel3.enabled = false
 		}
+	case 0xFF1B:
+		sound.Channel3.length.counter = 256 - int(val)
 	case 0xFF1C:
-		/*
-			FF1C - NR32 - Channel 3 Select output level (R/W)
-			  Bit 6-5 - Select output level (Read/Write)
-			Possible Output levels are:
-			  0: Mute (No sound)
-			  1: 100% Volume (Produce Wave Pattern RAM Data as it is)
-			  2:  50% Volume (Produce Wave Pattern RAM data shifted once to the right)
-			  3:  25% Volume (Produce Wave Pattern RAM data shifted twice to the right)
-		*/
-		switch (val & 0x60) >> 5 {
-		case 0x00:
-			sound.Channel3.volume = 0
-		case 0x01:
-			sound.Channel3.volume = 1
-		case 0x02:
-			sound.Channel3.volume = 0.5
-		case 0x03:
-			sound.Channel3.volume = 0.25
-		}
-
+		sound.Channel3.level = val >> 5 & 0x3
+	case 0xFF1D:
+		sound.Channel3.frequency = sound.Channel3.frequency&0x700 | int(val)
 	case 0xFF1E:
-		if util.TestBit(val, 7) {
-			sound.Channel3.reSet()
-			sound.Channel3.Freq = 65536 / (2048 - int(uint16((val&0x7))<<8+uint16(sound.VRAMCache[0x0D])))
-			sound.Channel3.stopWhileTimeout = util.TestBit(val, 6)
-			sound.Channel3.waveDuty = 1
-			sound.Channel3.duration = (256.0 - float64(int(sound.VRAMCache[0x0B]))) * (1.0 / 256.0)
-			sound.Channel3.enable = true
+		sound.Channel3.frequency = sound.Channel3.frequency&0xFF | int(val&0x7)<<8
+		sound.Channel3.length.enabled = val&0x40 != 0
+		if val&0x80 != 0 {
+			sound.Channel3.trigger()
 		}
 
 	// Channel 4
-	case 0xFF22:
-		/*
-			FF22 - NR43 - Channel 4 Polynomial Counter (R/W)
-				The amplitude is randomly switched between high and low at the given frequency.
-				A higher frequency will make the noise to appear 'softer'.
-				When Bit 3 is set, the output will become more regular,
-				and some frequencies will sound more like Tone than Noise.
-				  Bit 7-4 - Shift Clock Frequency (s)
-				  Bit 3   - Counter Step/Width (0=15 bits, 1=7 bits)
-				  Bit 2-0 - Dividing Ratio of Frequencies (r)
-				Frequency = 524288 Hz / r / 2^(s+1) ;For r=0 assume r=0.5 instead
-		*/
-		shiftClockFrequency := float64((val & 0xF0) >> 4)
-		dividingRatio := float64(val & 0x7)
-		if dividingRatio == 0 {
-			dividingRatio = 0.5
+	case 0xFF20:
+		sound.Channel4.length.counter = 64 - int(val&0x3F)
+	case 0xFF21:
+		sound.Channel4.envelope.register = val
+		if !sound.Channel4.envelope.dacEnabled() {
+			sound.Channel4.enabled = false
 		}
-		sound.Channel4.Freq = int(524288 / dividingRatio / math.Pow(2, shiftClockFrequency+1))
+	case 0xFF22:
+		sound.Channel4.polynomial = val
 	case 0xFF23:
-		if util.TestBit(val, 7) {
-			sound.Channel4.enable = false
-			sound.Channel4.envelopeTick = 0
-			sound.Channel4.lastEnvelope = 0
-			sound.Channel4.sampleTick = 0
-			sound.Channel4.lastEnvelope = 0
-
-			//Envelope options
-			sound.Channel4.envelopeIncrease = util.TestBit(sound.VRAMCache[0x11], 3)
-			sound.Channel4.envelopeInitial = (sound.VRAMCache[0x11] & 0xF0) >> 4
-			sound.Channel4.envelopeSweepNum = sound.VRAMCache[0x11] & 0x7
-			sound.Channel4.volume = float64(sound.Channel4.envelopeInitial) / float64(0xf)
-			sound.Channel4.waveDuty = 1
-
-			sound.Channel4.duration = 64.0 - float64(int(sound.VRAMCache[0x10]))*(1.0/256.0)
-			sound.Channel4.stopWhileTimeout = util.TestBit(val, 6)
-
-			sound.Channel4.enable = true
+		sound.Channel4.length.enabled = val&0x40 != 0
+		if val&0x80 != 0 {
+			sound.Channel4.trigger()
 		}
-
-	}
-}
-
-func (channel *Channel) shouldPlay() bool {
-
-	// Is the master sound control enabled?
-	if !channel.parent.enable {
-		return false
-	}
-
-	if channel.Freq <= 0 {
-		return false
-	}
-
-	// Is this channel enabled?
-	if !channel.enable {
-		return false
 	}
-
-	if channel.waveDuty == 0 {
-		return false
-	}
-
-	// Is this channel reach time limit?
-	if channel.stopWhileTimeout && channel.duration <= 0 {
-		return false
-	}
-	return true
-}
-
-func (channel Channel) Stream(samples [][2]float64) (n int, ok bool) {
-	for i := range samples {
-
-		channel.self.sampleTick += float64(channel.self.Freq) / 44100.0
-		if channel.self.shouldPlay() {
-			tickInCycle := channel.self.sampleTick * 2 * 3.1415926
-			switch channel.wave {
-			case 0:
-				if math.Sin(tickInCycle) <= waveDutyMap[int(channel.self.waveDuty)] {
-					samples[i][0] = 1 * channel.self.volume
-					samples[i][1] = 1 * channel.self.volume
-				} else {
-					samples[i][0] = 0
-					samples[i][1] = 0
-				}
-			case 3:
-				sampleID := math.Floor(math.Mod(channel.self.sampleTick, 1.0) * 32)
-				samples[i][0] = channel.parent.SampleCache[int(sampleID)] * channel.self.volume
-				samples[i][1] = channel.parent.SampleCache[int(sampleID)] * channel.self.volume
-			case 2:
-				if channel.self.sampleTick-channel.self.lastGenerateTick > 1 || channel.self.sampleTick-channel.self.lastGenerateTick < -1 {
-					sample := rand.Float64()*2 - 1
-					samples[i][0] = sample * channel.self.volume
-					samples[i][1] = sample * channel.self.volume
-					channel.self.lastGenerate = sample
-					channel.self.lastGenerateTick = channel.self.sampleTick
-				} else {
-					samples[i][0] = channel.self.lastGenerate * channel.self.volume
-					samples[i][1] = channel.self.lastGenerate * channel.self.volume
-				}
-			}
-
-			channel.self.duration -= secondPerTick
-		} else {
-			samples[i][0] = 0
-			samples[i][1] = 0
-		}
-
-		channel.self.Envelope()
-		channel.self.Sweep()
-	}
-	return len(samples), true
-}
-
-func (channel *Channel) Sweep() {
-	channel.sweepTick += 1 / 44100.0
-	if channel.sweepNumber > 0 {
-		if channel.sweepTick-channel.lastSweep >= sweepTime[channel.sweepTime] {
-			if channel.Freq > 0 {
-				newFreq := 0
-				if channel.sweepIncrease {
-					newFreq = channel.freqLast + channel.freqLast/2 ^ int(channel.sweepNumber)
-				} else {
-					newFreq = channel.freqLast - channel.freqLast/2 ^ int(channel.sweepNumber)
-				}
-				channel.freqLast = newFreq
-				channel.Freq = 131072 / (2048 - int(newFreq))
-				channel.lastSweep = channel.sweepTick
-			}
-		}
-	}
-}
-
-func (channel *Channel) Envelope() {
-	channel.envelopeTick += 1 / 44100.0
-	if channel.envelopeSweepNum > 0 {
-		step := float64(channel.envelopeSweepNum) * (1.0 / 64)
-		if channel.envelopeTick-channel.lastEnvelope >= step {
-			if channel.envelopeInitial > 0 {
-				channel.envelopeInitial--
-				if channel.envelopeIncrease {
-					channel.volume = 1 - float64(channel.envelopeInitial)/float64(0xf)
-				} else {
-					channel.volume = float64(channel.envelopeInitial) / float64(0xf)
-				}
-
-				channel.lastEnvelope = channel.envelopeTick
-			}
-		}
-	}
-}
-
-func (channel *Channel) reSet() {
-	channel.enable = false
-	channel.Freq = 0
-	channel.envelopeTick = 0
-	channel.lastEnvelope = 0
-	channel.sampleTick = 0
-	channel.lastEnvelope = 0
-}
-
-func (channel Channel) Err() error {
-	return nil
 }
@@ -0,0 +1,32 @@
+package gb
+
+import "testing"
+
+// On the DMG, turning the APU off with NR52 clears the registers but not the length counters
+func TestSoundPowerOffKeepsLength(t *testing.T) {
+	sound := &Sound{}
+	sound.WriteRegister(0xFF26, 0x80)
+	sound.WriteRegister(0xFF11, 0x8A)
+	sound.WriteRegister(0xFF1B, 200)
+	sound.WriteRegister(0xFF20, 0x3F)
+
+	sound.WriteRegister(0xFF26, 0x00)
+	sound.WriteRegister(0xFF26, 0x80)
+
+	for _, length := range []struct {
+		name     string
+		counter  int
+		expected int
+	}{
+		{"channel 1", sound.Channel1.length.counter, 54},
+		{"channel 3", sound.Channel3.length.counter, 56},
+		{"channel 4", sound.Channel4.length.counter, 1},
+	} {
+		if length.counter != length.expected {
+			t.Errorf("%s length counter %d after power off, want %d", length.name, length.counter, length.expected)
+		}
+	}
+	if duty := sound.ReadRegister(0xFF11) >> 6; duty != 0 {
+		t.Errorf("NR11 duty %d after power off, want 0", duty)
+	}
+}
@@ -0,0 +1,248 @@
+package gb
+
+import (
+	"log"
+	"sync/atomic"
+
+	"github.com/HFO4/gbc-in-cloud/driver"
+)
+
+const (
+	// Snapshots kept per second of play for rewinding
+	rewindRate = 2
+	// Updates emulated per tick in fast-forward, only the last one is drawn
+	fastForwardSpeed = 4
+	// Seconds of play the frontends keep to rewind
+	DefaultRewindSeconds = 10
+)
+
+/*
+State Snapshot of the emulated hardware, see SaveState. It is kept in
+memory only, the ROM and everything outside of the Game Boy (display,
+speaker, link cable, buttons held) are not part of it.
+*/
+type State struct {
+	cpu            CPU
+	memory         Memory
+	ppu            PPU
+	timer          Timer
+	speedMultiple  int
+	serialByte     byte
+	interruptCount int
+	mbc            MBC
+	sgb            SGB
+	sound          soundState
+}
+
+// Registers and channels of the APU, without the samples produced
+type soundState struct {
+	channel1       SquareChannel
+	channel2       SquareChannel
+	channel3       WaveChannel
+	channel4       NoiseChannel
+	power          bool
+	registers      [0x30]byte
+	sequencerStep  int
+	sequencerTimer int
+}
+
+/*
+SaveState Take a snapshot of the emulated hardware. It must be called
+from the emulation loop, between two frames: use Schedule from other
+goroutines.
+*/
+func (core *Core) SaveState() *State {
+	state := &State{
+		cpu:            core.CPU,
+		memory:         core.Memory,
+		ppu:            core.PPU,
+		timer:          core.Timer,
+		speedMultiple:  core.SpeedMultiple,
+		serialByte:     core.SerialByte,
+		interruptCount: core.InterruptCount,
+		mbc:            cloneMBC(core.Cartridge.MBC),
+		sgb:            core.SGB,
+		sound: soundState{
+			channel1:       core.Sound.Channel1,
+			channel2:       core.Sound.Channel2,
+			channel3:       core.Sound.Channel3,
+			channel4:       core.Sound.Channel4,
+			power:          core.Sound.power,
+			registers:      core.Sound.registers,
+			sequencerStep:  core.Sound.sequencerStep,
+			sequencerTimer: core.Sound.sequencerTimer,
+		},
+	}
+	state.sgb.command = append([]byte(nil), core.SGB.command...)
+	return state
+}
+
+/*
+LoadState Bring the emulated hardware back to a snapshot of the same
+game, from the emulation loop like SaveState. The buttons held now stay
+held, and the cartridge RAM is saved again.
+*/
+func (core *Core) LoadState(state *State) {
+	core.CPU = state.cpu
+	core.Memory = state.memory
+	core.Memory.dirty = true
+	core.PPU = state.ppu
+	core.Timer = state.timer
+	core.SpeedMultiple = state.speedMultiple
+	core.SerialByte = state.serialByte
+	core.InterruptCount = state.interruptCount
+	// The state can be loaded again, it keeps its own copy
+	core.Cartridge.MBC = cloneMBC(state.mbc)
+	core.SGB = state.sgb
+	core.SGB.command = append([]byte(nil), state.sgb.command...)
+
+	sound := &core.Sound
+	sound.Channel1 = state.sound.channel1
+	sound.Channel2 = state.sound.channel2
+	sound.Channel3 = state.sound.channel3
+	sound.Channel4 = state.sound.channel4
+	sound.power = state.sound.power
+	sound.registers = state.sound.registers
+	sound.sequencerStep = state.sound.sequencerStep
+	sound.sequencerTimer = state.sound.sequencerTimer
+}
+
+/*
+Copy of the banking registers and RAM of the cartridge, sharing the ROM
+which is never written.
+*/
+func cloneMBC(mbc MBC) MBC {
+	switch mbc := mbc.(type) {
+	case *MBCRom:
+		clone := *mbc
+		return &clone
+	case *MBC1:
+		clone := *mbc
+		clone.RAMBank = append([]byte(nil), mbc.RAMBank...)
+		return &clone
+	case *MBC2:
+		clone := *mbc
+		clone.RAMBank = append([]byte(nil), mbc.RAMBank...)
+		return &clone
+	case *MBC3:
+		clone := *mbc
+		clone.RAMBank = append([]byte(nil), mbc.RAMBank...)
+		clone.rtc = append([]byte(nil), mbc.rtc...)
+		clone.latchedRtc = append([]byte(nil), mbc.latchedRtc...)
+		return &clone
+	case *MBC5:
+		clone := *mbc
+		clone.RAMBank = append([]byte(nil), mbc.RAMBank...)
+		return &clone
+	case *MBCGBS:
+		clone := *mbc
+		return &clone
+	}
+	return mbc
+}
+
+/*
+Keep a snapshot every 1/rewindRate second of play, for RewindSeconds.
+Called after every update of the emulation loop.
+*/
+func (core *Core) recordRewind() {
+	if core.RewindSeconds <= 0 {
+		return
+	}
+	core.rewindTimer++
+	if core.rewindTimer*rewindRate < core.FPS {
+		return
+	}
+	core.rewindTimer = 0
+	if len(core.rewindStates) >= core.RewindSeconds*rewindRate {
+		core.rewindStates = append(core.rewindStates[:0], core.rewindStates[1:]...)
+	}
+	core.rewindStates = append(core.rewindStates, core.SaveState())
+}
+
+/*
+Rewind Go back about a second of play, returns false when there is no
+older snapshot. From the emulation loop, like LoadState.
+*/
+func (core *Core) Rewind() bool {
+	if len(core.rewindStates) == 0 {
+		return false
+	}
+	// Snapshots are 1/rewindRate second apart, the last one is younger than that
+	back := rewindRate
+	if back > len(core.rewindStates) {
+		back = len(core.rewindStates)
+	}
+	state := core.rewindStates[len(core.rewindStates)-back]
+	core.rewindStates = core.rewindStates[:len(core.rewindStates)-back]
+	core.rewindTimer = 0
+	core.LoadState(state)
+	return true
+}
+
+// ToggleFastForward Emulate the game faster or back at normal speed, returns whether it's faster now
+func (core *Core) ToggleFastForward() bool {
+	for {
+		old := atomic.LoadInt32(&core.fastForward)
+		if atomic.CompareAndSwapInt32(&core.fastForward, old, 1-old) {
+			return old == 0
+		}
+	}
+}
+
+// Updates emulated per tick of the emulation loop
+func (core *Core) speed() int {
+	if atomic.LoadInt32(&core.fastForward) == 1 {
+		return fastForwardSpeed
+	}
+	return 1
+}
+
+/*
+Hotkeys Actions of the emulator hotkeys, by the names of the key
+bindings: the save state slot, rewinding and fast-forward. They can be
+run from any goroutine.
+*/
+func (core *Core) Hotkeys() map[string]func() {
+	return map[string]func(){
+		driver.HotkeySaveState: func() {
+			core.Schedule(func(core *Core) {
+				core.savedState = core.SaveState()
+				log.Println("[Core] State saved")
+			})
+		},
+		driver.HotkeyLoadState: func() {
+			core.Schedule(func(core *Core) {
+				if core.savedState == nil {
+					log.Println("[Core] No state saved yet")
+					return
+				}
+				core.LoadState(core.savedState)
+				// Older snapshots belong to another timeline
+				core.rewindStates = core.rewindStates[:0]
+				log.Println("[Core] State loaded")
+			})
+		},
+		driver.HotkeyRewind: func() {
+			core.Schedule(func(core *Core) {
+				if core.Rewind() {
+					log.Println("[Core] Rewound")
+				} else {
+					log.Println("[Core] Nothing to rewind")
+				}
+			})
+		},
+		driver.HotkeyFastForward: func() {
+			if core.ToggleFastForward() {
+				log.Println("[Core] Fast-forward on")
+			} else {
+				log.Println("[Core] Fast-forward off")
+			}
+		},
+		driver.HotkeyPalette: func() {
+			core.Schedule(func(core *Core) {
+				core.SetPalette(NextPalette(core.PaletteName))
+			})
+		},
+	}
+}
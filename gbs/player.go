@@ -0,0 +1,146 @@
+package gbs
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HFO4/gbc-in-cloud/driver"
+	"github.com/HFO4/gbc-in-cloud/gb"
+	"github.com/HFO4/gbc-in-cloud/record"
+)
+
+/*
+Player of GBS music rips, on the speaker or to WAV files. The rip runs
+on a gb.Core without display, songs last Length seconds and then fade
+out during Fade seconds.
+*/
+type Player struct {
+	Path string
+	// First song played (1-based, 0 for the first song of the file)
+	Track int
+	// Seconds played before the fade out
+	Length float64
+	// Seconds of the fade out
+	Fade float64
+}
+
+func (player *Player) newCore() *gb.Core {
+	headless := new(driver.Headless)
+	return &gb.Core{
+		FPS:           60,
+		Clock:         4194304,
+		DisplayDriver: headless,
+		Controller:    headless,
+		DrawSignal:    make(chan bool),
+		GBSTrack:      player.Track,
+	}
+}
+
+// Volume of the song after the given number of frames, 0 once it's over
+func (player *Player) volume(frames int) float64 {
+	seconds := float64(frames) / record.FrameRate
+	switch {
+	case seconds < player.Length:
+		return 1
+	case seconds < player.Length+player.Fade:
+		return 1 - (seconds-player.Length)/player.Fade
+	}
+	return 0
+}
+
+/*
+Render one song to a WAV file, as fast as possible.
+*/
+func (player *Player) Render(wavPath string) error {
+	recording, err := record.Create(wavPath)
+	if err != nil {
+		return err
+	}
+	core := player.newCore()
+	core.Recording = recording
+	core.Init(player.Path)
+	if core.GBS == nil {
+		core.StopRecording()
+		return fmt.Errorf("%s is not a GBS file", player.Path)
+	}
+
+	for frame := 0; player.volume(frame) > 0; frame++ {
+		core.Sound.SetVolume(player.volume(frame))
+		core.RunFrames(1)
+	}
+	core.StopRecording()
+	return nil
+}
+
+/*
+Play the songs on the speaker one after the other. The songs are
+selected by typing their number, n (next) or p (previous) followed by
+Enter, q quits.
+*/
+func (player *Player) Play() error {
+	core := player.newCore()
+	core.ToggleSound = true
+	go core.DisplayDriver.Run(core.DrawSignal, func() {})
+	core.Init(player.Path)
+	if core.GBS == nil {
+		return fmt.Errorf("%s is not a GBS file", player.Path)
+	}
+	fmt.Printf("%s - %s (%s)\n", core.GBS.Title, core.GBS.Author, core.GBS.Copyright)
+	fmt.Printf("%d songs. Type a song number, n (next), p (previous) or q (quit) and press Enter.\n", core.GBS.Songs)
+
+	commands := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			commands <- strings.TrimSpace(scanner.Text())
+		}
+		close(commands)
+	}()
+
+	start := core.PPU.Frames
+	ticker := time.NewTicker(time.Second / time.Duration(core.FPS))
+	defer ticker.Stop()
+	for range ticker.C {
+		// Song to switch to, -1 to keep playing
+		track := -1
+		select {
+		case command, ok := <-commands:
+			switch {
+			case !ok || command == "q":
+				return nil
+			case command == "n":
+				track = core.GBSTrack + 1
+			case command == "p":
+				track = core.GBSTrack - 1
+			default:
+				if number, err := strconv.Atoi(command); err == nil {
+					track = number
+				}
+			}
+		default:
+			if player.volume(core.PPU.Frames-start) == 0 {
+				track = core.GBSTrack + 1
+			}
+		}
+
+		if track != -1 {
+			if track > core.GBS.Songs {
+				track = 1
+			} else if track < 1 {
+				track = core.GBS.Songs
+			}
+			if err := core.SelectGBSTrack(track); err != nil {
+				log.Println("[GBS]", err)
+			}
+			start = core.PPU.Frames
+		}
+		core.Sound.SetVolume(player.volume(core.PPU.Frames - start))
+		core.Update()
+	}
+	return nil
+}
@@ -17,4 +17,5 @@ require (
 	github.com/reiver/go-oi v0.0.0-20160325061615-431c83978379 // indirect
 	github.com/reiver/go-telnet v0.0.0-20180421082511-9ff0b2ab096e // indirect
 	github.com/satori/go.uuid v1.2.0
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
 )
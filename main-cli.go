@@ -4,9 +4,17 @@ import (
 	"bufio"
 	"encoding/json"
 	"flag"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
+	"github.com/HFO4/gbc-in-cloud/driver"
+	"github.com/HFO4/gbc-in-cloud/gb"
+	"github.com/HFO4/gbc-in-cloud/gbs"
+	"github.com/HFO4/gbc-in-cloud/record"
+	"github.com/HFO4/gbc-in-cloud/regression"
 	"github.com/HFO4/gbc-in-cloud/static"
 	"github.com/HFO4/gbc-in-cloud/stream"
 )
@@ -19,12 +27,31 @@ var (
 	StreamServerMode bool
 	StaticServerMode bool
 
-	ConfigPath string
-	ListenPort int
-	ROMPath    string
-	SoundOn    bool
-	FPS        int
-	Debug      bool
+	ConfigPath   string
+	Display      string
+	FixturesPath string
+	ListenPort   int
+	SSHPort      int
+	HostKey      string
+	Authorized   string
+	SSHSaves     string
+	ROMPath      string
+	Palette      string
+	SuperGameBoy bool
+	Filters      string
+	KeysPath     string
+	LinkListen   string
+	LinkJoin     string
+	PrintPath    string
+	Keys         driver.KeyBindings
+	RecordPath   string
+	GBSTrack     int
+	GBSLength    float64
+	GBSFade      float64
+	RecordFrames int
+	SoundOn      bool
+	FPS          int
+	Debug        bool
 )
 
 func init() {
@@ -32,15 +59,38 @@ func init() {
 	flag.BoolVar(&StreamServerMode, "s", false, "Start a cloud-gaming server")
 	flag.BoolVar(&StaticServerMode, "S", false, "Start a static image cloud-gaming server")
 	flag.BoolVar(&Debug, "d", false, "Use Debugger in GUI mode")
-	flag.IntVar(&ListenPort, "p", 1989, "Set the `port` for the cloud-gaming server")
+	flag.IntVar(&ListenPort, "p", 1989, "Set the `port` for the cloud-gaming server, 0 to only serve SSH")
+	flag.IntVar(&SSHPort, "e", 0, "Set the `port` of the SSH server of the cloud-gaming server, off by default")
+	flag.StringVar(&HostKey, "k", "gbdotlive_host_key", "Set the host key `file` of the SSH server, generated if it doesn't exist")
+	flag.StringVar(&Authorized, "K", "", "Only let the SSH players with a key in this authorized_keys `file` in, named by the comment of their key")
+	flag.StringVar(&SSHSaves, "a", "saves", "Set the `directory` of the saves of the SSH players")
+	flag.StringVar(&Display, "D", "auto", "Set how the screen is drawn in terminals: auto (from the terminal type and size), truecolor, 256 (colours), braille (black and white), sixel or kitty (images)")
 	flag.StringVar(&ConfigPath, "c", "", "Set the game option list `config` file path")
-	flag.StringVar(&ROMPath, "r", "", "Set `ROM` file path")
+	flag.StringVar(&FixturesPath, "t", "", "Render the regression `fixtures` listed in the config file headlessly and compare them against their reference images")
+	flag.StringVar(&Filters, "F", "", "Set the post-processing `filters` of the GUI, the static image server and the sixel and kitty displays, e.g. ghosting,scale2x,lcdgrid")
+	flag.StringVar(&KeysPath, "b", "", "Load the key bindings of the buttons and hotkeys from a JSON `file`, e.g. {\"a\": \"A\", \"F2\": \"SaveState\"}")
+	flag.StringVar(&LinkListen, "l", "", "Plug a link cable to another emulator over the network: wait for it on this `address`, e.g. :1990")
+	flag.StringVar(&LinkJoin, "j", "", "Plug a link cable to another emulator waiting with -l at this `address`, e.g. 192.168.1.2:1990")
+	flag.StringVar(&PrintPath, "o", "", "Plug a Game Boy Printer in the link port, saving the printed pages as PNG in this `directory`")
+	flag.BoolVar(&SuperGameBoy, "B", false, "Turn on the Super Game Boy enhancements (colours and border) of games supporting them")
+	flag.StringVar(&Palette, "P", "", "Set the `palette`: dmg, pocket, gray, auto (CGB colorization), a CGB palette name, or 4/12 comma separated hex colours")
+	flag.StringVar(&RecordPath, "R", "", "Record the first frames of the game headlessly, the video (.y4m, or .rgb for raw RGB) and the sound (.wav next to it) to `file`")
+	flag.IntVar(&RecordFrames, "n", 3600, "Number of `frames` to record with -R")
+	flag.IntVar(&GBSTrack, "T", 0, "Play the song `number` of a GBS file, the first song of the file by default")
+	flag.Float64Var(&GBSLength, "L", 150, "Play the songs of a GBS file for `seconds` before fading them out")
+	flag.Float64Var(&GBSFade, "X", 8, "Fade the songs of a GBS file out during `seconds`")
+	flag.StringVar(&ROMPath, "r", "", "Set `ROM` file path to be played in this terminal")
 }
 
 func runStaticServer() {
 	server := static.StaticServer{
-		Port:     ListenPort,
-		GamePath: ROMPath,
+		Port:         ListenPort,
+		GamePath:     ROMPath,
+		Palette:      Palette,
+		SuperGameBoy: SuperGameBoy,
+		Filters:      Filters,
+		Keys:         Keys,
+		PrintPath:    PrintPath,
 	}
 	server.Run()
 }
@@ -67,6 +117,13 @@ func runServer() {
 
 	streamServer := new(stream.StreamServer)
 	streamServer.Port = ListenPort
+	streamServer.Display = Display
+	streamServer.Filters = Filters
+	streamServer.Keys = Keys
+	streamServer.SSHPort = SSHPort
+	streamServer.HostKeyPath = HostKey
+	streamServer.AuthorizedKeysPath = Authorized
+	streamServer.SavePath = SSHSaves
 	var gameList []stream.GameInfo
 	err = json.Unmarshal(gameListStr, &gameList)
 	if err != nil {
@@ -76,6 +133,90 @@ func runServer() {
 	streamServer.Run()
 }
 
+/*
+Record the first frames of the game as fast as possible, without
+display or input. The recording still plays at normal speed.
+*/
+func runRecording() {
+	recording, err := record.Create(RecordPath)
+	if err != nil {
+		log.Fatal("[Error] Failed to create the recording,", err)
+	}
+	headless := new(driver.Headless)
+	core := &gb.Core{
+		FPS:           60,
+		Clock:         4194304,
+		DisplayDriver: headless,
+		Controller:    headless,
+		DrawSignal:    make(chan bool),
+		PaletteName:   Palette,
+		SuperGameBoy:  SuperGameBoy,
+		Recording:     recording,
+	}
+	core.Init(ROMPath)
+	core.RunFrames(RecordFrames)
+	core.StopRecording()
+}
+
+/*
+Play a GBS music file on the speaker, or render the song to a WAV
+file if -R is set.
+*/
+func runGBS() {
+	player := gbs.Player{
+		Path:   ROMPath,
+		Track:  GBSTrack,
+		Length: GBSLength,
+		Fade:   GBSFade,
+	}
+	var err error
+	if RecordPath != "" {
+		err = player.Render(RecordPath)
+	} else {
+		err = player.Play()
+	}
+	if err != nil {
+		log.Fatal("[Error] ", err)
+	}
+}
+
+func runRegression() {
+	fixturesFile, err := ioutil.ReadFile(FixturesPath)
+	if err != nil {
+		log.Fatal("[Error] Failed to read fixtures config file,", err)
+	}
+
+	runner := new(regression.Runner)
+	err = json.Unmarshal(fixturesFile, &runner.Fixtures)
+	if err != nil {
+		log.Fatal("Unable to decode fixtures config file.")
+	}
+	if !runner.Run() {
+		os.Exit(1)
+	}
+}
+
+/*
+Play the game in this terminal, drawn like for the players of the
+cloud-gaming server.
+*/
+func runTerminal() {
+	game := stream.LocalGame{
+		Path:         ROMPath,
+		Palette:      Palette,
+		SuperGameBoy: SuperGameBoy,
+		Display:      Display,
+		Filters:      Filters,
+		Keys:         Keys,
+		LinkListen:   LinkListen,
+		LinkJoin:     LinkJoin,
+		PrintPath:    PrintPath,
+	}
+	if err := game.Run(); err != nil {
+		log.Fatal("[Error] Failed to play in the terminal, ", err)
+	}
+}
+
 func main() {
 	flag.Parse()
 	if h {
@@ -83,6 +224,14 @@ func main() {
 		return
 	}
 
+	if KeysPath != "" {
+		var err error
+		Keys, err = driver.LoadKeyBindings(KeysPath)
+		if err != nil {
+			log.Fatal("[Error] Failed to load the key bindings, ", err)
+		}
+	}
+
 	if StreamServerMode {
 		runServer()
 		return
@@ -92,4 +241,24 @@ func main() {
 		runStaticServer()
 		return
 	}
+
+	if FixturesPath != "" {
+		runRegression()
+		return
+	}
+
+	if strings.EqualFold(filepath.Ext(ROMPath), ".gbs") {
+		runGBS()
+		return
+	}
+
+	if RecordPath != "" {
+		runRecording()
+		return
+	}
+
+	if ROMPath != "" {
+		runTerminal()
+		return
+	}
 }
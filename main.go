@@ -6,12 +6,23 @@ import (
 	"bufio"
 	"encoding/json"
 	"flag"
+	"fmt"
+	"image/png"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/HFO4/gbc-in-cloud/driver"
+	"github.com/HFO4/gbc-in-cloud/filter"
 	"github.com/HFO4/gbc-in-cloud/fyne"
 	"github.com/HFO4/gbc-in-cloud/gb"
+	"github.com/HFO4/gbc-in-cloud/gbs"
+	"github.com/HFO4/gbc-in-cloud/record"
+	"github.com/HFO4/gbc-in-cloud/regression"
 	"github.com/HFO4/gbc-in-cloud/static"
 	"github.com/HFO4/gbc-in-cloud/stream"
 )
@@ -24,12 +35,30 @@ var (
 	StreamServerMode bool
 	StaticServerMode bool
 
-	ConfigPath string
-	ListenPort int
-	ROMPath    string
-	SoundOn    bool
-	FPS        int
-	Debug      bool
+	ConfigPath   string
+	Display      string
+	FixturesPath string
+	ListenPort   int
+	SSHPort      int
+	HostKey      string
+	Authorized   string
+	SSHSaves     string
+	ROMPath      string
+	Palette      string
+	SuperGameBoy bool
+	Filters      string
+	KeysPath     string
+	LinkListen   string
+	LinkJoin     string
+	PrintPath    string
+	Keys         driver.KeyBindings
+	RecordPath   string
+	GBSTrack     int
+	GBSLength    float64
+	GBSFade      float64
+	SoundOn      bool
+	FPS          int
+	Debug        bool
 )
 
 func init() {
@@ -40,13 +69,34 @@ func init() {
 	flag.BoolVar(&StaticServerMode, "S", false, "Start a static image cloud-gaming server")
 	flag.BoolVar(&SoundOn, "m", true, "Turn on sound in GUI mode")
 	flag.BoolVar(&Debug, "d", false, "Use Debugger in GUI mode")
-	flag.IntVar(&ListenPort, "p", 1989, "Set the `port` for the cloud-gaming server")
+	flag.IntVar(&ListenPort, "p", 1989, "Set the `port` for the cloud-gaming server, 0 to only serve SSH")
+	flag.IntVar(&SSHPort, "e", 0, "Set the `port` of the SSH server of the cloud-gaming server, off by default")
+	flag.StringVar(&HostKey, "k", "gbdotlive_host_key", "Set the host key `file` of the SSH server, generated if it doesn't exist")
+	flag.StringVar(&Authorized, "K", "", "Only let the SSH players with a key in this authorized_keys `file` in, named by the comment of their key")
+	flag.StringVar(&SSHSaves, "a", "saves", "Set the `directory` of the saves of the SSH players")
 	flag.IntVar(&FPS, "f", 60, "Set the `FPS` in GUI mode")
+	flag.StringVar(&Display, "D", "auto", "Set how the screen is drawn in terminals: auto (from the terminal type and size), truecolor, 256 (colours), braille (black and white), sixel or kitty (images)")
 	flag.StringVar(&ConfigPath, "c", "", "Set the game option list `config` file path")
-	flag.StringVar(&ROMPath, "r", "", "Set `ROM` file path to be played in GUI mode")
+	flag.StringVar(&FixturesPath, "t", "", "Render the regression `fixtures` listed in the config file headlessly and compare them against their reference images")
+	flag.StringVar(&Filters, "F", "", "Set the post-processing `filters` of the GUI, the static image server and the sixel and kitty displays, e.g. ghosting,scale2x,lcdgrid")
+	flag.StringVar(&KeysPath, "b", "", "Load the key bindings of the buttons and hotkeys from a JSON `file`, e.g. {\"a\": \"A\", \"F2\": \"SaveState\"}")
+	flag.StringVar(&LinkListen, "l", "", "Plug a link cable to another emulator over the network: wait for it on this `address`, e.g. :1990")
+	flag.StringVar(&LinkJoin, "j", "", "Plug a link cable to another emulator waiting with -l at this `address`, e.g. 192.168.1.2:1990")
+	flag.StringVar(&PrintPath, "o", "", "Plug a Game Boy Printer in the link port, saving the printed pages as PNG in this `directory`")
+	flag.BoolVar(&SuperGameBoy, "B", false, "Turn on the Super Game Boy enhancements (colours and border) of games supporting them")
+	flag.StringVar(&Palette, "P", "", "Set the `palette`: dmg, pocket, gray, auto (CGB colorization), a CGB palette name, or 4/12 comma separated hex colours")
+	flag.StringVar(&RecordPath, "R", "", "Record the video (.y4m, or .rgb for raw RGB) and the sound (.wav next to it) of the game played in GUI mode to `file`")
+	flag.IntVar(&GBSTrack, "T", 0, "Play the song `number` of a GBS file, the first song of the file by default")
+	flag.Float64Var(&GBSLength, "L", 150, "Play the songs of a GBS file for `seconds` before fading them out")
+	flag.Float64Var(&GBSFade, "X", 8, "Fade the songs of a GBS file out during `seconds`")
+	flag.StringVar(&ROMPath, "r", "", "Set `ROM` file path to be played in GUI mode, or in this terminal with -g=false")
 }
 
 func startGUI(screen driver.DisplayDriver, control driver.ControllerDriver) {
+	// Both go in the serial port, refused before waiting for the other player
+	if PrintPath != "" && (LinkListen != "" || LinkJoin != "") {
+		log.Fatal("[Error] The link cable and the printer can't be plugged together")
+	}
 	core := new(gb.Core)
 	core.FPS = FPS
 	core.Clock = 4194304
@@ -56,18 +106,115 @@ func startGUI(screen driver.DisplayDriver, control driver.ControllerDriver) {
 	core.DrawSignal = make(chan bool)
 	core.SpeedMultiple = 0
 	core.ToggleSound = SoundOn
+	core.PaletteName = Palette
+	core.SuperGameBoy = SuperGameBoy
+	core.Clip = record.NewClip(10)
+	core.RewindSeconds = gb.DefaultRewindSeconds
+	if RecordPath != "" {
+		recording, err := record.Create(RecordPath)
+		if err != nil {
+			log.Fatal("[Error] Failed to create the recording,", err)
+		}
+		core.Recording = recording
+	}
 	core.Init(ROMPath)
+	link, err := driver.ConnectLink(LinkListen, LinkJoin, core.GameTitle)
+	if err != nil {
+		log.Fatal("[Error] Failed to plug the link cable, ", err)
+	}
+	if link != nil {
+		core.Serial = link
+	}
+	var printer *driver.Printer
+	if PrintPath != "" {
+		printer = driver.NewPrinter(PrintPath)
+		core.Serial = printer
+	}
+	if hotkeys, ok := control.(driver.HotkeyController); ok {
+		actions := guiHotkeys(core)
+		// Bound keys take over the debugging hotkeys
+		for key, action := range Keys.Hotkeys(core.Hotkeys()) {
+			actions[key] = action
+		}
+		hotkeys.SetHotkeys(actions)
+	}
 
 	go core.Run()
 	screen.Run(core.DrawSignal, func() {
 		core.SaveRAM()
+		core.FinishRecording()
+		if link != nil {
+			link.Close()
+		}
+		if printer != nil {
+			printer.Flush()
+		}
 	})
 }
 
+/*
+F1-F3 switch the background, window and sprites on and off, F5-F8 mute
+the sound channels 1-4 and F9 solos them one after the other. F11
+saves a screenshot and F12 a GIF of the last 10 seconds in the working
+directory.
+*/
+func guiHotkeys(core *gb.Core) map[string]func() {
+	hotkeys := map[string]func(){}
+	for key, layer := range map[string]string{"F1": "bg", "F2": "window", "F3": "sprites"} {
+		layer := layer
+		hotkeys[key] = func() {
+			core.Schedule(func(core *gb.Core) {
+				core.ToggleLayer(layer)
+			})
+		}
+	}
+	for channel := 1; channel <= 4; channel++ {
+		channel := channel
+		hotkeys[fmt.Sprintf("F%d", channel+4)] = func() {
+			core.Sound.ToggleMute(channel)
+		}
+	}
+	hotkeys["F9"] = func() {
+		core.Sound.SoloNext()
+	}
+	hotkeys["F11"] = func() {
+		saveCapture("png", func(w io.Writer) error {
+			return png.Encode(w, core.Screenshot())
+		})
+	}
+	hotkeys["F12"] = func() {
+		// Encoding takes a while, the emulation goes on meanwhile
+		go saveCapture("gif", func(w io.Writer) error {
+			return core.Clip.WriteGIF(w, 10)
+		})
+	}
+	return hotkeys
+}
+
+func saveCapture(extension string, encode func(io.Writer) error) {
+	path := fmt.Sprintf("gbdotlive-%d.%s", time.Now().Unix(), extension)
+	file, err := os.Create(path)
+	if err != nil {
+		log.Println("[Error] Failed to save capture,", err)
+		return
+	}
+	defer file.Close()
+	if err := encode(file); err != nil {
+		log.Println("[Error] Failed to save capture,", err)
+		return
+	}
+	log.Printf("[Display] Saved %s\n", path)
+}
+
 func runStaticServer() {
 	server := static.StaticServer{
-		Port:     ListenPort,
-		GamePath: ROMPath,
+		Port:         ListenPort,
+		GamePath:     ROMPath,
+		Palette:      Palette,
+		SuperGameBoy: SuperGameBoy,
+		Filters:      Filters,
+		Keys:         Keys,
+		PrintPath:    PrintPath,
 	}
 	server.Run()
 }
@@ -94,6 +241,13 @@ func runServer() {
 
 	streamServer := new(stream.StreamServer)
 	streamServer.Port = ListenPort
+	streamServer.Display = Display
+	streamServer.Filters = Filters
+	streamServer.Keys = Keys
+	streamServer.SSHPort = SSHPort
+	streamServer.HostKeyPath = HostKey
+	streamServer.AuthorizedKeysPath = Authorized
+	streamServer.SavePath = SSHSaves
 	var gameList []stream.GameInfo
 	err = json.Unmarshal(gameListStr, &gameList)
 	if err != nil {
@@ -103,6 +257,65 @@ func runServer() {
 	streamServer.Run()
 }
 
+/*
+Play a GBS music file on the speaker, or render the song to a WAV
+file if -R is set.
+*/
+func runGBS() {
+	player := gbs.Player{
+		Path:   ROMPath,
+		Track:  GBSTrack,
+		Length: GBSLength,
+		Fade:   GBSFade,
+	}
+	var err error
+	if RecordPath != "" {
+		err = player.Render(RecordPath)
+	} else {
+		err = player.Play()
+	}
+	if err != nil {
+		log.Fatal("[Error] ", err)
+	}
+}
+
+func runRegression() {
+	fixturesFile, err := ioutil.ReadFile(FixturesPath)
+	if err != nil {
+		log.Fatal("[Error] Failed to read fixtures config file,", err)
+	}
+
+	runner := new(regression.Runner)
+	err = json.Unmarshal(fixturesFile, &runner.Fixtures)
+	if err != nil {
+		log.Fatal("Unable to decode fixtures config file.")
+	}
+	if !runner.Run() {
+		os.Exit(1)
+	}
+}
+
+/*
+Play the game in this terminal, drawn like for the players of the
+cloud-gaming server.
+*/
+func runTerminal() {
+	game := stream.LocalGame{
+		Path:         ROMPath,
+		Palette:      Palette,
+		SuperGameBoy: SuperGameBoy,
+		Display:      Display,
+		Filters:      Filters,
+		Keys:         Keys,
+		LinkListen:   LinkListen,
+		LinkJoin:     LinkJoin,
+		PrintPath:    PrintPath,
+	}
+	if err := game.Run(); err != nil {
+		log.Fatal("[Error] Failed to play in the terminal, ", err)
+	}
+}
+
 func main() {
 	flag.Parse()
 	if h {
@@ -110,6 +323,14 @@ func main() {
 		return
 	}
 
+	if KeysPath != "" {
+		var err error
+		Keys, err = driver.LoadKeyBindings(KeysPath)
+		if err != nil {
+			log.Fatal("[Error] Failed to load the key bindings, ", err)
+		}
+	}
+
 	if StreamServerMode {
 		runServer()
 		return
@@ -120,13 +341,34 @@ func main() {
 		return
 	}
 
+	if FixturesPath != "" {
+		runRegression()
+		return
+	}
+
+	if strings.EqualFold(filepath.Ext(ROMPath), ".gbs") {
+		runGBS()
+		return
+	}
+
+	filters, err := filter.Parse(Filters)
+	if err != nil {
+		log.Fatal("[Error] ", err)
+	}
+
 	if FyneMode {
 		driver := new(fyne.LCD)
+		driver.Filters = filters
+		driver.Keymap = Keys.Keymap()
 		startGUI(driver, driver)
 		return
 	} else if GUIMode {
 		driver := new(driver.LCD)
+		driver.Filters = filters
+		driver.Keymap = Keys.Keymap()
 		startGUI(driver, driver)
 		return
 	}
+
+	runTerminal()
 }
@@ -0,0 +1,101 @@
+package record
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+)
+
+/*
+Write the last seconds as an animated PNG, with every frame. APNG
+delays are fractions, 1/10000s keeps them within a frame of the
+emulated time.
+
+An APNG is a PNG whose image is the first frame, followed by the other
+frames in fdAT chunks. Every frame is encoded by image/png (as RGB, so
+they all share the header) and its IDAT chunks are reused.
+*/
+func (clip *Clip) WriteAPNG(w io.Writer, seconds float64) error {
+	frames := clip.Last(seconds)
+	if len(frames) == 0 {
+		return errEmpty
+	}
+	frameDelays := delays(len(frames), 1, 10000)
+	bounds := frames[0].Bounds()
+
+	buf := new(bytes.Buffer)
+	buf.Write([]byte("\x89PNG\r\n\x1a\n"))
+	sequence := uint32(0)
+	rgba := image.NewRGBA(bounds)
+	for i, frame := range frames {
+		draw.Draw(rgba, bounds, frame, bounds.Min, draw.Src)
+		chunks, err := pngChunks(rgba)
+		if err != nil {
+			return err
+		}
+
+		if i == 0 {
+			writeChunk(buf, "IHDR", chunks["IHDR"][0])
+			// acTL: number of frames, number of plays (0 - forever)
+			writeChunk(buf, "acTL", be32(uint32(len(frames)), 0))
+		}
+
+		// fcTL: sequence, size, offset, delay and dispose/blend operations (none/source)
+		control := be32(sequence, uint32(bounds.Dx()), uint32(bounds.Dy()), 0, 0)
+		control = append(control, byte(frameDelays[i]>>8), byte(frameDelays[i]), 10000>>8, 10000&0xFF, 0, 0)
+		writeChunk(buf, "fcTL", control)
+		sequence++
+
+		for _, data := range chunks["IDAT"] {
+			if i == 0 {
+				writeChunk(buf, "IDAT", data)
+			} else {
+				writeChunk(buf, "fdAT", append(be32(sequence), data...))
+				sequence++
+			}
+		}
+	}
+	writeChunk(buf, "IEND", nil)
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Encode an image to PNG and split it in chunks, by chunk type
+func pngChunks(img image.Image) (map[string][][]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()[8:]
+	chunks := map[string][][]byte{}
+	for len(data) >= 12 {
+		length := binary.BigEndian.Uint32(data)
+		name := string(data[4:8])
+		chunks[name] = append(chunks[name], data[8:8+length])
+		data = data[12+length:]
+	}
+	return chunks, nil
+}
+
+func writeChunk(w *bytes.Buffer, name string, data []byte) {
+	binary.Write(w, binary.BigEndian, uint32(len(data)))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(name))
+	crc.Write(data)
+	w.WriteString(name)
+	w.Write(data)
+	binary.Write(w, binary.BigEndian, crc.Sum32())
+}
+
+func be32(values ...uint32) []byte {
+	res := make([]byte, 4*len(values))
+	for i, value := range values {
+		binary.BigEndian.PutUint32(res[i*4:], value)
+	}
+	return res
+}
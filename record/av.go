@@ -0,0 +1,197 @@
+package record
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Sample rate of the recorded sound
+const SampleRate = 44100
+
+/*
+Recording writes every frame and the sound of the emulation to disk,
+losslessly: the video goes to a Y4M file (4:4:4, full range BT.601) or,
+with a .rgb extension, to raw RGB24 frames, and the sound to a 16 bit
+stereo WAV file with the same name. With a .wav extension only the
+sound is recorded.
+
+The sound is counted in emulated time, every frame is followed by the
+samples played during its 70224 cycles, so the recording plays at the
+right speed whatever speed the emulator ran at.
+*/
+type Recording struct {
+	videoFile *os.File
+	video     *bufio.Writer
+	audioFile *os.File
+	audio     *bufio.Writer
+
+	raw     bool
+	bounds  image.Rectangle
+	frames  int64
+	samples int64
+}
+
+// Create the video file at path and the WAV file next to it
+func Create(path string) (*Recording, error) {
+	rec := &Recording{raw: strings.EqualFold(filepath.Ext(path), ".rgb")}
+	audioPath := strings.TrimSuffix(path, filepath.Ext(path)) + ".wav"
+	var err error
+	if !strings.EqualFold(filepath.Ext(path), ".wav") {
+		if rec.videoFile, err = os.Create(path); err != nil {
+			return nil, err
+		}
+		rec.video = bufio.NewWriter(rec.videoFile)
+	}
+	if rec.audioFile, err = os.Create(audioPath); err != nil {
+		if rec.videoFile != nil {
+			rec.videoFile.Close()
+		}
+		return nil, err
+	}
+	rec.audio = bufio.NewWriter(rec.audioFile)
+	// The sizes are filled in when the recording is closed
+	rec.writeWAVHeader(0)
+	if rec.video != nil {
+		log.Printf("[Record] Recording to %s and %s\n", path, audioPath)
+	} else {
+		log.Printf("[Record] Recording to %s\n", audioPath)
+	}
+	return rec, nil
+}
+
+/*
+Append a frame. All the frames must have the size of the first one,
+which sets the size of the video.
+*/
+func (rec *Recording) WriteFrame(frame *image.RGBA) error {
+	if rec.video == nil {
+		rec.frames++
+		return nil
+	}
+	bounds := frame.Bounds()
+	if rec.frames == 0 {
+		rec.bounds = bounds
+		if rec.raw {
+			log.Printf("[Record] Raw video: rgb24 %dx%d at 4194304/70224 fps\n", bounds.Dx(), bounds.Dy())
+		} else if _, err := fmt.Fprintf(rec.video, "YUV4MPEG2 W%d H%d F4194304:70224 Ip A1:1 C444 XCOLORRANGE=FULL\n", bounds.Dx(), bounds.Dy()); err != nil {
+			return err
+		}
+	} else if bounds.Size() != rec.bounds.Size() {
+		return fmt.Errorf("frame size changed from %v to %v", rec.bounds.Size(), bounds.Size())
+	}
+	rec.frames++
+
+	if rec.raw {
+		row := make([]byte, bounds.Dx()*3)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				i := frame.PixOffset(x, y)
+				copy(row[(x-bounds.Min.X)*3:], frame.Pix[i:i+3])
+			}
+			if _, err := rec.video.Write(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Y, Cb and Cr planes one after the other
+	size := bounds.Dx() * bounds.Dy()
+	planes := make([]byte, size*3)
+	n := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			i := frame.PixOffset(x, y)
+			planes[n], planes[size+n], planes[size*2+n] = color.RGBToYCbCr(frame.Pix[i], frame.Pix[i+1], frame.Pix[i+2])
+			n++
+		}
+	}
+	if _, err := rec.video.WriteString("FRAME\n"); err != nil {
+		return err
+	}
+	_, err := rec.video.Write(planes)
+	return err
+}
+
+// Number of samples to write to catch up with the frames written
+func (rec *Recording) PendingSamples() int {
+	return int(rec.frames*70224*SampleRate/4194304 - rec.samples)
+}
+
+// Append stereo samples, in -1 to 1
+func (rec *Recording) WriteSamples(samples [][2]float64) error {
+	buf := make([]byte, 4*len(samples))
+	for i, sample := range samples {
+		for c := 0; c < 2; c++ {
+			value := sample[c]
+			if value > 1 {
+				value = 1
+			} else if value < -1 {
+				value = -1
+			}
+			binary.LittleEndian.PutUint16(buf[i*4+c*2:], uint16(int16(value*32767)))
+		}
+	}
+	rec.samples += int64(len(samples))
+	_, err := rec.audio.Write(buf)
+	return err
+}
+
+/*
+WAV header of 16 bit stereo PCM. The RIFF and data chunk sizes are
+only known at the end.
+*/
+func (rec *Recording) writeWAVHeader(dataSize uint32) {
+	header := make([]byte, 44)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], 36+dataSize)
+	copy(header[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(header[16:], 16)
+	// PCM, 2 channels
+	binary.LittleEndian.PutUint16(header[20:], 1)
+	binary.LittleEndian.PutUint16(header[22:], 2)
+	binary.LittleEndian.PutUint32(header[24:], SampleRate)
+	// Bytes per second, bytes per sample frame, bits per sample
+	binary.LittleEndian.PutUint32(header[28:], SampleRate*4)
+	binary.LittleEndian.PutUint16(header[32:], 4)
+	binary.LittleEndian.PutUint16(header[34:], 16)
+	copy(header[36:], "data")
+	binary.LittleEndian.PutUint32(header[40:], dataSize)
+	rec.audio.Write(header)
+}
+
+// Flush the files and fill in the WAV sizes
+func (rec *Recording) Close() error {
+	var videoErr error
+	if rec.video != nil {
+		videoErr = rec.video.Flush()
+		if err := rec.videoFile.Close(); videoErr == nil {
+			videoErr = err
+		}
+	}
+
+	audioErr := rec.audio.Flush()
+	if audioErr == nil {
+		rec.audio.Reset(rec.audioFile)
+		if _, audioErr = rec.audioFile.Seek(0, 0); audioErr == nil {
+			rec.writeWAVHeader(uint32(rec.samples * 4))
+			audioErr = rec.audio.Flush()
+		}
+	}
+	if err := rec.audioFile.Close(); audioErr == nil {
+		audioErr = err
+	}
+
+	log.Printf("[Record] Recorded %d frames, %d samples\n", rec.frames, rec.samples)
+	if videoErr != nil {
+		return videoErr
+	}
+	return audioErr
+}
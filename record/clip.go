@@ -0,0 +1,134 @@
+package record
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+	"math"
+	"sync"
+)
+
+var errEmpty = errors.New("no frame recorded")
+
+// Frames per second of the Game Boy LCD, 70224 cycles of the 4194304 Hz clock each
+const FrameRate = 4194304.0 / 70224
+
+/*
+Clip keeps the last frames of the emulation, to export them as an
+animated GIF or APNG. Frames are added by the emulator as they are
+completed, so the timing of the clip follows the emulated time and
+not the speed the emulator happened to run at.
+*/
+type Clip struct {
+	frames []*image.Paletted
+	// Index where the next frame is stored
+	next  int
+	count int
+	lock  sync.Mutex
+}
+
+// Clip able to keep the given number of seconds
+func NewClip(seconds int) *Clip {
+	return &Clip{
+		frames: make([]*image.Paletted, int(math.Ceil(float64(seconds)*FrameRate))),
+	}
+}
+
+/*
+Store a frame, replacing the oldest one once the clip is full. The
+colours are indexed right away, a frame uses 4 bytes less per pixel.
+*/
+func (clip *Clip) Add(frame *image.RGBA) {
+	indexed := indexColours(frame)
+	clip.lock.Lock()
+	clip.frames[clip.next] = indexed
+	clip.next = (clip.next + 1) % len(clip.frames)
+	if clip.count < len(clip.frames) {
+		clip.count++
+	}
+	clip.lock.Unlock()
+}
+
+// The frames of the last seconds, oldest first
+func (clip *Clip) Last(seconds float64) []*image.Paletted {
+	clip.lock.Lock()
+	defer clip.lock.Unlock()
+
+	n := int(seconds * FrameRate)
+	if n > clip.count || n <= 0 {
+		n = clip.count
+	}
+	frames := make([]*image.Paletted, n)
+	start := clip.next - n + len(clip.frames)
+	for i := range frames {
+		frames[i] = clip.frames[(start+i)%len(clip.frames)]
+	}
+	return frames
+}
+
+/*
+Frame delays in 1/scale seconds. The delays can't be exactly 1/59.73s,
+they are rounded from the emulated time at which every frame starts so
+the error doesn't add up over the clip.
+*/
+func delays(frames int, frameStep int, scale float64) []int {
+	res := make([]int, frames)
+	for i := range res {
+		start := math.Round(float64(i*frameStep) / FrameRate * scale)
+		end := math.Round(float64((i+1)*frameStep) / FrameRate * scale)
+		res[i] = int(end - start)
+	}
+	return res
+}
+
+/*
+Write the last seconds as an animated GIF. GIF delays are counted in
+hundredths of a second, and most viewers play delays under 2/100s
+much slower, so only every second frame is kept (29.86 fps).
+*/
+func (clip *Clip) WriteGIF(w io.Writer, seconds float64) error {
+	frames := clip.Last(seconds)
+	animation := &gif.GIF{}
+	for i := 0; i < len(frames); i += 2 {
+		animation.Image = append(animation.Image, frames[i])
+	}
+	animation.Delay = delays(len(animation.Image), 2, 100)
+	if len(animation.Image) == 0 {
+		return errEmpty
+	}
+	return gif.EncodeAll(w, animation)
+}
+
+/*
+Index the colours of a frame. A game screen uses a few colours, the
+Super Game Boy border can bring more, in the rare case of more than
+256 colours the frame is dithered to a fixed palette.
+*/
+func indexColours(frame *image.RGBA) *image.Paletted {
+	bounds := frame.Bounds()
+	indexed := image.NewPaletted(bounds, nil)
+	indexes := map[color.RGBA]uint8{}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			i := frame.PixOffset(x, y)
+			colour := color.RGBA{R: frame.Pix[i], G: frame.Pix[i+1], B: frame.Pix[i+2], A: 0xFF}
+			index, ok := indexes[colour]
+			if !ok {
+				if len(indexed.Palette) == 256 {
+					dithered := image.NewPaletted(bounds, palette.Plan9)
+					draw.FloydSteinberg.Draw(dithered, bounds, frame, bounds.Min)
+					return dithered
+				}
+				index = uint8(len(indexed.Palette))
+				indexes[colour] = index
+				indexed.Palette = append(indexed.Palette, colour)
+			}
+			indexed.Pix[indexed.PixOffset(x, y)] = index
+		}
+	}
+	return indexed
+}
@@ -0,0 +1,384 @@
+package regression
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+)
+
+/*
+Fixtures built into the emulator. Their test ROMs are assembled on the
+fly and the expected screen is computed, so they run without any file.
+*/
+type builtinFixture struct {
+	title string
+	rom   func() []byte
+	// Expected shade (0-3) of a pixel
+	expected func(x int, y int) int
+	frames   int
+}
+
+var builtinFixtures = []builtinFixture{
+	{
+		title:    "window line counter",
+		rom:      windowLineCounterROM,
+		expected: windowLineCounterExpected,
+		frames:   10,
+	},
+	{
+		title:    "window WX<7",
+		rom:      windowLowWXROM,
+		expected: windowLowWXExpected,
+		frames:   10,
+	},
+	{
+		title:    "sprites per line",
+		rom:      spriteLimitROM,
+		expected: spriteLimitExpected,
+		frames:   10,
+	},
+	{
+		title:    "sprite priority",
+		rom:      spritePriorityROM,
+		expected: spritePriorityExpected,
+		frames:   10,
+	},
+	{
+		title:    "8x16 sprite tiles",
+		rom:      tallSpriteROM,
+		expected: tallSpriteExpected,
+		frames:   10,
+	},
+	{
+		title:    "BG over OBJ",
+		rom:      bgOverObjROM,
+		expected: bgOverObjExpected,
+		frames:   10,
+	},
+}
+
+// Render the generated ROM and compare it against the expected screen
+func (fixture builtinFixture) check() error {
+	romFile, err := ioutil.TempFile("", "gbdotlive-fixture-*.gb")
+	if err != nil {
+		return fmt.Errorf("failed to create ROM file, %s", err)
+	}
+	romFile.Write(fixture.rom())
+	romFile.Close()
+	defer os.Remove(romFile.Name())
+
+	expected := image.NewGray(image.Rect(0, 0, 160, 144))
+	for y := 0; y < 144; y++ {
+		for x := 0; x < 160; x++ {
+			expected.SetGray(x, y, color.Gray{Y: uint8(255 - fixture.expected(x, y)*85)})
+		}
+	}
+
+	actual, err := Render(romFile.Name(), fixture.frames)
+	if err != nil {
+		return err
+	}
+	if mismatch := Compare(actual, expected); mismatch != 0 {
+		return fmt.Errorf("%d pixels differ", mismatch)
+	}
+	return nil
+}
+
+/*
+Minimal ROM-only cartridge, the program starts at 0150h and the
+LCD STAT interrupt vector (0048h) jumps to 0200h.
+*/
+type romBuilder struct {
+	data []byte
+	pc   int
+}
+
+func newROM(title string) *romBuilder {
+	rom := &romBuilder{data: make([]byte, 0x8000), pc: 0x150}
+	// Entry point: NOP, JP 0150h
+	copy(rom.data[0x100:], []byte{0x00, 0xC3, 0x50, 0x01})
+	copy(rom.data[0x134:0x143], title)
+	// LCD STAT interrupt: JP 0200h
+	copy(rom.data[0x48:], []byte{0xC3, 0x00, 0x02})
+	return rom
+}
+
+func (rom *romBuilder) emit(code ...byte) {
+	copy(rom.data[rom.pc:], code)
+	rom.pc += len(code)
+}
+
+// Write a byte to a high memory register: LD A,n / LDH (n),A
+func (rom *romBuilder) setRegister(register byte, value byte) {
+	rom.emit(0x3E, value, 0xE0, register)
+}
+
+// Fill memory with a byte: LD HL,address / LD BC,length / loop: LD A,n / LD (HL+),A / DEC BC / LD A,B / OR C / JR NZ,loop
+func (rom *romBuilder) fill(address uint16, length uint16, value byte) {
+	rom.emit(0x21, byte(address), byte(address>>8), 0x01, byte(length), byte(length>>8))
+	rom.emit(0x3E, value, 0x22, 0x0B, 0x78, 0xB1, 0x20, 0xF8)
+}
+
+// Copy bytes into memory: LD HL,address / (LD A,n / LD (HL+),A)...
+func (rom *romBuilder) store(address uint16, data ...byte) {
+	rom.emit(0x21, byte(address), byte(address>>8))
+	for _, b := range data {
+		rom.emit(0x3E, b, 0x22)
+	}
+}
+
+// Common setup: wait for V-Blank, turn the LCD off and clear VRAM and OAM
+func (rom *romBuilder) setup() {
+	// DI / LD SP,FFFEh
+	rom.emit(0xF3, 0x31, 0xFE, 0xFF)
+	// wait: LDH A,(44h) / CP 144 / JR NZ,wait
+	rom.emit(0xF0, 0x44, 0xFE, 0x90, 0x20, 0xFA)
+	rom.setRegister(0x40, 0x00)
+	rom.fill(0x8000, 0x2000, 0x00)
+	rom.fill(0xFE00, 0xA0, 0x00)
+	rom.setRegister(0x47, 0xE4)
+}
+
+// Tile of a single colour (0-3)
+func solidTile(colour byte) []byte {
+	tile := make([]byte, 16)
+	for i := 0; i < 16; i += 2 {
+		tile[i] = 0xFF * (colour & 1)
+		tile[i+1] = 0xFF * (colour >> 1)
+	}
+	return tile
+}
+
+// Write the sprites to OAM, from sprite 0: Y, X, tile and attributes of each
+func (rom *romBuilder) sprites(sprites ...[4]byte) {
+	var data []byte
+	for _, sprite := range sprites {
+		data = append(data, sprite[:]...)
+	}
+	rom.store(0xFE00, data...)
+}
+
+// Loop forever, interrupts enabled: EI / JR -2
+func (rom *romBuilder) idle() {
+	rom.emit(0xFB, 0x18, 0xFE)
+}
+
+/*
+The window (WX=87, WY=16) is hidden between lines 40 and 59 by LYC
+interrupts. Tile 1 has colour (row mod 4) on every row, so each line
+shows which window row was drawn. Once the window is shown again it
+continues with row 24, not with row 44.
+*/
+func windowLineCounterROM() []byte {
+	rom := newROM("WINDOW LINES")
+	rom.setup()
+	rom.store(0x8010, 0x00, 0x00, 0xFF, 0x00, 0x00, 0xFF, 0xFF, 0xFF, 0x00, 0x00, 0xFF, 0x00, 0x00, 0xFF, 0xFF, 0xFF)
+	rom.fill(0x9C00, 0x400, 0x01)
+	rom.setRegister(0x4A, 16)
+	rom.setRegister(0x4B, 87)
+	rom.setRegister(0x45, 40)
+	rom.setRegister(0x41, 0x40)
+	rom.setRegister(0xFF, 0x02)
+	rom.setRegister(0x0F, 0x00)
+	rom.setRegister(0x40, 0xF1)
+	rom.idle()
+
+	/*
+		0200h:	PUSH AF
+			LDH A,(45h)
+			CP 40
+			JR NZ,show
+			LDH A,(40h) / RES 5,A / LDH (40h),A
+			LD A,60 / LDH (45h),A
+			POP AF / RETI
+		show:	LDH A,(40h) / SET 5,A / LDH (40h),A
+			LD A,40 / LDH (45h),A
+			POP AF / RETI
+	*/
+	rom.pc = 0x200
+	rom.emit(0xF5, 0xF0, 0x45, 0xFE, 40, 0x20, 0x0C)
+	rom.emit(0xF0, 0x40, 0xCB, 0xAF, 0xE0, 0x40)
+	rom.emit(0x3E, 60, 0xE0, 0x45, 0xF1, 0xD9)
+	rom.emit(0xF0, 0x40, 0xCB, 0xEF, 0xE0, 0x40)
+	rom.emit(0x3E, 40, 0xE0, 0x45, 0xF1, 0xD9)
+	return rom.data
+}
+
+func windowLineCounterExpected(x int, y int) int {
+	if x < 80 || y < 16 || (y >= 40 && y < 60) {
+		return 0
+	}
+	row := y - 16
+	if y >= 60 {
+		row -= 20
+	}
+	return row % 4
+}
+
+/*
+The window is drawn with WX=3 over a white background. Tile 1 has
+colour 0 in its left half and colour 3 in its right half, the first
+4 pixels of the window are cut off.
+*/
+func windowLowWXROM() []byte {
+	rom := newROM("WINDOW WX")
+	rom.setup()
+	tile := make([]byte, 16)
+	for i := range tile {
+		tile[i] = 0x0F
+	}
+	rom.store(0x8010, tile...)
+	rom.fill(0x9C00, 0x400, 0x01)
+	rom.setRegister(0x4A, 0)
+	rom.setRegister(0x4B, 3)
+	rom.setRegister(0x40, 0xF1)
+	rom.idle()
+	return rom.data
+}
+
+func windowLowWXExpected(x int, y int) int {
+	if (x+4)%8 >= 4 {
+		return 3
+	}
+	return 0
+}
+
+/*
+Twelve sprites of colour 3 on lines 16-23. The first 10 in OAM order
+are drawn from X=40, 10 pixels apart. Sprites 10 and 11, on the left of
+the screen, are past the limit of 10 sprites per line and not drawn.
+*/
+func spriteLimitROM() []byte {
+	rom := newROM("SPRITE LIMIT")
+	rom.setup()
+	rom.store(0x8010, solidTile(3)...)
+	var sprites [][4]byte
+	for i := 0; i < 10; i++ {
+		sprites = append(sprites, [4]byte{32, byte(48 + i*10), 0x01, 0x00})
+	}
+	sprites = append(sprites, [4]byte{32, 8, 0x01, 0x00}, [4]byte{32, 24, 0x01, 0x00})
+	rom.sprites(sprites...)
+	rom.setRegister(0x48, 0xE4)
+	rom.setRegister(0x40, 0x93)
+	rom.idle()
+	return rom.data
+}
+
+func spriteLimitExpected(x int, y int) int {
+	if y < 16 || y >= 24 || x < 40 || x >= 140 {
+		return 0
+	}
+	if (x-40)%10 < 8 {
+		return 3
+	}
+	return 0
+}
+
+/*
+Overlapping sprites on lines 16-23. Sprite 0 (colour 1) at X=20 is
+drawn under sprite 1 (colour 3) at X=16, the smaller X coordinate wins
+over the OAM index. Sprites 2 (colour 1) and 3 (colour 3) are both at
+X=40, the first one in OAM wins.
+*/
+func spritePriorityROM() []byte {
+	rom := newROM("SPRITE PRIORITY")
+	rom.setup()
+	rom.store(0x8010, append(solidTile(3), solidTile(1)...)...)
+	rom.sprites(
+		[4]byte{32, 28, 0x02, 0x00},
+		[4]byte{32, 24, 0x01, 0x00},
+		[4]byte{32, 48, 0x02, 0x00},
+		[4]byte{32, 48, 0x01, 0x00},
+	)
+	rom.setRegister(0x48, 0xE4)
+	rom.setRegister(0x40, 0x93)
+	rom.idle()
+	return rom.data
+}
+
+func spritePriorityExpected(x int, y int) int {
+	if y < 16 || y >= 24 {
+		return 0
+	}
+	switch {
+	case x >= 16 && x < 24:
+		return 3
+	case x >= 24 && x < 28, x >= 40 && x < 48:
+		return 1
+	}
+	return 0
+}
+
+/*
+8x16 sprites on lines 16-31 using tile 3: the lower bit of the tile
+number is ignored, so tile 2 (colour 1) is drawn above tile 3
+(colour 2). The second sprite is flipped vertically.
+*/
+func tallSpriteROM() []byte {
+	rom := newROM("TALL SPRITES")
+	rom.setup()
+	rom.store(0x8020, append(solidTile(1), solidTile(2)...)...)
+	rom.sprites(
+		[4]byte{32, 16, 0x03, 0x00},
+		[4]byte{32, 32, 0x03, 0x40},
+	)
+	rom.setRegister(0x48, 0xE4)
+	rom.setRegister(0x40, 0x97)
+	rom.idle()
+	return rom.data
+}
+
+func tallSpriteExpected(x int, y int) int {
+	if y < 16 || y >= 32 {
+		return 0
+	}
+	top := y < 24
+	switch {
+	case x >= 8 && x < 16 && top, x >= 24 && x < 32 && !top:
+		return 1
+	case x >= 8 && x < 16, x >= 24 && x < 32:
+		return 2
+	}
+	return 0
+}
+
+/*
+Background of tile 4, colour 1 in its left half and colour 0 in its
+right half. The sprite at X=16 has the BG-over-OBJ attribute and is only
+drawn over colour 0, the sprite at X=32 doesn't and is drawn whole.
+*/
+func bgOverObjROM() []byte {
+	rom := newROM("BG OVER OBJ")
+	rom.setup()
+	rom.store(0x8010, solidTile(3)...)
+	tile := make([]byte, 16)
+	for i := 0; i < 16; i += 2 {
+		tile[i] = 0xF0
+	}
+	rom.store(0x8040, tile...)
+	rom.fill(0x9800, 0x400, 0x04)
+	rom.sprites(
+		[4]byte{32, 16, 0x01, 0x80},
+		[4]byte{32, 32, 0x01, 0x00},
+	)
+	rom.setRegister(0x48, 0xE4)
+	rom.setRegister(0x40, 0x93)
+	rom.idle()
+	return rom.data
+}
+
+func bgOverObjExpected(x int, y int) int {
+	bg := 0
+	if x%8 < 4 {
+		bg = 1
+	}
+	if y < 16 || y >= 24 {
+		return bg
+	}
+	if (x >= 8 && x < 16 && bg == 0) || (x >= 24 && x < 32) {
+		return 3
+	}
+	return bg
+}
@@ -0,0 +1,55 @@
+package regression
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// The fixtures built into the emulator, their ROMs are generated
+func TestBuiltinFixtures(t *testing.T) {
+	for _, fixture := range builtinFixtures {
+		fixture := fixture
+		t.Run(fixture.title, func(t *testing.T) {
+			if err := fixture.check(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+/*
+The fixtures of regression.json at the root of the repository. Their
+paths are relative to it, fixtures whose files aren't there are skipped.
+*/
+func TestFixtures(t *testing.T) {
+	config, err := ioutil.ReadFile(filepath.Join("..", "regression.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fixtures []Fixture
+	if err := json.Unmarshal(config, &fixtures); err != nil {
+		t.Fatal(err)
+	}
+	for _, fixture := range fixtures {
+		fixture := fixture
+		fixture.Path = filepath.Join("..", fixture.Path)
+		fixture.Reference = filepath.Join("..", fixture.Reference)
+		t.Run(fixture.Title, func(t *testing.T) {
+			if missing := fixture.Missing(); missing != "" {
+				t.Skip(missing, "is missing, see the README")
+			}
+			if err := fixture.Check(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// A missing ROM is an error of the fixture, not the end of the run
+func TestRenderMissingROM(t *testing.T) {
+	if _, err := Render(filepath.Join("..", "fixtures", "missing.gb"), 1); err == nil {
+		t.Error("rendered a ROM which doesn't exist")
+	}
+}
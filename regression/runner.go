@@ -0,0 +1,168 @@
+package regression
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/HFO4/gbc-in-cloud/driver"
+	"github.com/HFO4/gbc-in-cloud/gb"
+)
+
+/*
+A regression fixture: a test ROM rendered headlessly for a number
+of frames and compared against a reference screenshot.
+*/
+type Fixture struct {
+	Title string
+	// Path of the test ROM
+	Path string
+	// Path of the 160x144 reference PNG
+	Reference string
+	// Frames to emulate before taking the screenshot
+	Frames int
+}
+
+type Runner struct {
+	Fixtures []Fixture
+}
+
+/*
+Run Render every fixture and compare it against its reference, return
+whether none of them failed. Fixtures whose ROM or reference image
+isn't there, e.g. test ROMs which aren't redistributed with the
+emulator, are skipped.
+*/
+func (runner *Runner) Run() bool {
+	passed, skipped := 0, 0
+	for _, fixture := range builtinFixtures {
+		if err := fixture.check(); err != nil {
+			log.Printf("[Regression] %s: FAILED, %s\n", fixture.title, err)
+		} else {
+			log.Printf("[Regression] %s: passed\n", fixture.title)
+			passed++
+		}
+	}
+	for _, fixture := range runner.Fixtures {
+		if missing := fixture.Missing(); missing != "" {
+			log.Printf("[Regression] %s: skipped, %s is missing\n", fixture.Title, missing)
+			skipped++
+		} else if err := fixture.Check(); err != nil {
+			log.Printf("[Regression] %s: FAILED, %s\n", fixture.Title, err)
+		} else {
+			log.Printf("[Regression] %s: passed\n", fixture.Title)
+			passed++
+		}
+	}
+	total := len(builtinFixtures) + len(runner.Fixtures)
+	log.Printf("[Regression] %d/%d fixtures passed, %d skipped\n", passed, total, skipped)
+	return passed+skipped == total
+}
+
+// Missing The file of the fixture which doesn't exist, empty if both are there
+func (fixture Fixture) Missing() string {
+	for _, path := range []string{fixture.Path, fixture.Reference} {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return path
+		}
+	}
+	return ""
+}
+
+/*
+Check Render the fixture and compare it against its reference. When
+they differ, the rendered screen is kept next to the reference.
+*/
+func (fixture Fixture) Check() error {
+	referenceFile, err := os.Open(fixture.Reference)
+	if err != nil {
+		return fmt.Errorf("failed to open reference image, %s", err)
+	}
+	reference, err := png.Decode(referenceFile)
+	referenceFile.Close()
+	if err != nil {
+		return fmt.Errorf("failed to decode reference image, %s", err)
+	}
+
+	actual, err := Render(fixture.Path, fixture.Frames)
+	if err != nil {
+		return err
+	}
+	mismatch := Compare(actual, reference)
+	if mismatch == 0 {
+		return nil
+	}
+
+	// Keep the rendered screen next to the reference for inspection
+	actualPath := strings.TrimSuffix(fixture.Reference, ".png") + ".actual.png"
+	if actualFile, err := os.Create(actualPath); err == nil {
+		png.Encode(actualFile, actual)
+		actualFile.Close()
+	}
+	return fmt.Errorf("%d pixels differ, rendered screen saved to %s", mismatch, actualPath)
+}
+
+/*
+Render Emulate a ROM headlessly and return the screen after the given
+number of frames. The ROM is checked first, the core exits when it
+fails to load one.
+*/
+func Render(romPath string, frames int) (*image.RGBA, error) {
+	if info, err := os.Stat(romPath); err != nil {
+		return nil, fmt.Errorf("failed to open ROM, %s", err)
+	} else if info.IsDir() {
+		return nil, fmt.Errorf("failed to open ROM, %s is a directory", romPath)
+	}
+	headless := new(driver.Headless)
+	core := &gb.Core{
+		FPS:           60,
+		Clock:         4194304,
+		DisplayDriver: headless,
+		Controller:    headless,
+		DrawSignal:    make(chan bool),
+		// Shades are compared as gray levels
+		PaletteName: "gray",
+	}
+	core.Init(romPath)
+	core.RunFrames(frames)
+
+	img := image.NewRGBA(image.Rect(0, 0, 160, 144))
+	for y := 0; y < 144; y++ {
+		for x := 0; x < 160; x++ {
+			img.Set(x, y, color.RGBA{R: core.Screen[x][y][0], G: core.Screen[x][y][1], B: core.Screen[x][y][2], A: 0xFF})
+		}
+	}
+	return img, nil
+}
+
+/*
+Count the pixels which differ between two screens. Pixels are
+compared as one of the four DMG shades, so references taken with
+a different palette of grays still match.
+*/
+func Compare(actual image.Image, reference image.Image) int {
+	if actual.Bounds().Size() != reference.Bounds().Size() {
+		return actual.Bounds().Dx() * actual.Bounds().Dy()
+	}
+	mismatch := 0
+	for y := 0; y < actual.Bounds().Dy(); y++ {
+		for x := 0; x < actual.Bounds().Dx(); x++ {
+			a := actual.At(actual.Bounds().Min.X+x, actual.Bounds().Min.Y+y)
+			r := reference.At(reference.Bounds().Min.X+x, reference.Bounds().Min.Y+y)
+			if shade(a) != shade(r) {
+				mismatch++
+			}
+		}
+	}
+	return mismatch
+}
+
+// Quantize a colour into one of the four shades, 0 is the lightest
+func shade(c color.Color) int {
+	gray := color.GrayModel.Convert(c).(color.Gray)
+	return (255 - int(gray.Y) + 42) / 85
+}
@@ -0,0 +1,166 @@
+package static
+
+import (
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"strconv"
+
+	"github.com/HFO4/gbc-in-cloud/filter"
+	"github.com/HFO4/gbc-in-cloud/gb"
+)
+
+// Write an image as PNG, scaled by the optional `scale` parameter (1-8)
+func writePNG(w http.ResponseWriter, req *http.Request, img *image.RGBA) {
+	scale, err := strconv.Atoi(req.URL.Query().Get("scale"))
+	if err == nil && scale > 1 && scale <= 8 {
+		img = filter.Nearest{Factor: scale}.Apply(filter.Frame{RGBA: img, Scale: 1}).RGBA
+	}
+	w.Header().Set("Cache-control", "no-cache,max-age=0")
+	w.Header().Set("Content-type", "image/png")
+	png.Encode(w, img)
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Cache-control", "no-cache,max-age=0")
+	w.Header().Set("Content-type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+// Tile data 8000h-97FFh as a tile sheet
+func showTiles(server *StaticServer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		writePNG(w, req, server.core.TileSheet())
+	}
+}
+
+// Background map `index` (0 - 9800h, 1 - 9C00h) with the viewport outlined
+func showTileMap(server *StaticServer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		index, _ := strconv.Atoi(req.URL.Query().Get("index"))
+		if index != 0 && index != 1 {
+			http.Error(w, "index must be 0 or 1", http.StatusBadRequest)
+			return
+		}
+		writePNG(w, req, server.core.TileMap(index))
+	}
+}
+
+// The 40 OAM entries
+func showOAM(server *StaticServer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, server.core.OAMEntries())
+	}
+}
+
+// BGP, OBP0 and OBP1
+func showPalettes(server *StaticServer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, server.core.PaletteRegisters())
+	}
+}
+
+/*
+Layers disabled for debugging. The bg, window and sprites parameters
+turn a layer off (1) or back on (0), e.g. /debug/layers?bg=1. The
+layers are switched between two frames, once all the parameters are
+checked.
+*/
+func setLayers(server *StaticServer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		changes := map[string]bool{}
+		for _, name := range []string{"bg", "window", "sprites"} {
+			value := req.URL.Query().Get(name)
+			if value == "" {
+				continue
+			}
+			disabled, err := strconv.ParseBool(value)
+			if err != nil {
+				http.Error(w, name+" must be 0 or 1", http.StatusBadRequest)
+				return
+			}
+			changes[name] = disabled
+		}
+		layers := make(chan gb.Layers, 1)
+		server.core.Schedule(func(core *gb.Core) {
+			for name, disabled := range changes {
+				core.SetLayer(name, disabled)
+			}
+			layers <- core.DisabledLayers
+		})
+		writeJSON(w, <-layers)
+	}
+}
+
+/*
+Mute and solo switches of the sound channels. The mute and solo
+parameters toggle a channel (1-4), e.g. /debug/sound?solo=3, once both
+are checked. The server plays no sound, the switches pick the channels
+of /debug/scope.
+*/
+func setSound(server *StaticServer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		sound := &server.core.Sound
+		toggles := map[string]func(int) (bool, error){"mute": sound.ToggleMute, "solo": sound.ToggleSolo}
+		channels := map[string]int{}
+		for name := range toggles {
+			value := req.URL.Query().Get(name)
+			if value == "" {
+				continue
+			}
+			channel, err := strconv.Atoi(value)
+			if err != nil || channel < 1 || channel > 4 {
+				http.Error(w, name+" must be a channel from 1 to 4", http.StatusBadRequest)
+				return
+			}
+			channels[name] = channel
+		}
+		for name, channel := range channels {
+			toggles[name](channel)
+		}
+		muted, soloed := sound.Switches()
+		writeJSON(w, map[string][4]bool{"Muted": muted, "Soloed": soloed})
+	}
+}
+
+/*
+Oscilloscope of the sound channels, the last samples (735 by default,
+a frame) of every channel, or of the one given with channel=1-4. The
+channels muted or left out by a solo are silent.
+*/
+func showScope(server *StaticServer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		samples := 735
+		if value := req.URL.Query().Get("samples"); value != "" {
+			var err error
+			if samples, err = strconv.Atoi(value); err != nil {
+				http.Error(w, "samples must be a number", http.StatusBadRequest)
+				return
+			}
+		}
+		channels := []int{1, 2, 3, 4}
+		if value := req.URL.Query().Get("channel"); value != "" {
+			channel, err := strconv.Atoi(value)
+			if err != nil {
+				http.Error(w, "channel must be a channel from 1 to 4", http.StatusBadRequest)
+				return
+			}
+			channels = []int{channel}
+		}
+
+		scopes := map[string][]float64{}
+		for _, channel := range channels {
+			scope, err := server.core.Sound.Scope(channel, samples)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !server.core.Sound.Audible(channel) {
+				scope = make([]float64, len(scope))
+			}
+			scopes[strconv.Itoa(channel)] = scope
+		}
+		writeJSON(w, scopes)
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"encoding/base64"
 	"fmt"
 	"github.com/HFO4/gbc-in-cloud/driver"
+	"github.com/HFO4/gbc-in-cloud/filter"
 	"github.com/HFO4/gbc-in-cloud/gb"
+	"github.com/HFO4/gbc-in-cloud/record"
 	"github.com/gorilla/websocket"
 	"image/png"
 	"io/ioutil"
@@ -20,15 +22,41 @@ import (
 type StaticServer struct {
 	Port     int
 	GamePath string
+	// Palette name or custom colours, see gb.ParsePalette
+	Palette string
+	// Show the Super Game Boy colours and border of games supporting them
+	SuperGameBoy bool
+	// Post-processing filters of the images, see filter.Parse
+	Filters string
+	// Buttons and hotkeys of the keys of the web clients, the default ones if nil
+	Keys driver.KeyBindings
+	// Plug a Game Boy Printer saving its pages in this directory, shown on /prints
+	PrintPath string
 
 	driver   *driver.StaticImage
+	core     *gb.Core
+	printer  *driver.Printer
+	hotkeys  map[string]func()
 	upgrader websocket.Upgrader
 }
 
+// Seconds of frames kept for /clip
+const clipSeconds = 30
+
 // Run Running the static-image gaming server
 func (server *StaticServer) Run() {
 	// startup the emulator
 	server.driver = &driver.StaticImage{}
+	if server.Filters != "" {
+		filters, err := filter.Parse(server.Filters)
+		if err != nil {
+			log.Fatal("[Error] ", err)
+		}
+		server.driver.Filters = filters
+	}
+	if server.Keys == nil {
+		server.Keys = driver.DefaultKeyBindings
+	}
 	server.upgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool {
 		return true
 	}}
@@ -41,9 +69,20 @@ func (server *StaticServer) Run() {
 		DrawSignal:    make(chan bool),
 		SpeedMultiple: 0,
 		ToggleSound:   false,
+		PaletteName:   server.Palette,
+		SuperGameBoy:  server.SuperGameBoy,
+		Clip:          record.NewClip(clipSeconds),
+		RewindSeconds: gb.DefaultRewindSeconds,
 	}
-	go core.DisplayDriver.Run(core.DrawSignal, func() {})
+	if server.PrintPath != "" {
+		server.printer = driver.NewPrinter(server.PrintPath)
+		core.Serial = server.printer
+	}
+	server.core = core
 	core.Init(server.GamePath)
+	// Init sets up the display driver, e.g. the SGB screen, it runs after
+	go core.DisplayDriver.Run(core.DrawSignal, func() {})
+	server.hotkeys = core.Hotkeys()
 	go core.Run()
 
 	// image and control server
@@ -51,6 +90,22 @@ func (server *StaticServer) Run() {
 	http.HandleFunc("/stream", streamImages(server))
 	http.HandleFunc("/svg", showSVG(server))
 	http.HandleFunc("/control", newInput(server))
+	http.HandleFunc("/keys", showKeys(server))
+	http.HandleFunc("/screenshot", showScreenshot(server))
+	http.HandleFunc("/clip", showClip(server))
+	if server.printer != nil {
+		http.HandleFunc("/prints", showPrints(server))
+		http.HandleFunc("/prints/", showPrint(server))
+	}
+
+	// VRAM inspection
+	http.HandleFunc("/debug/tiles", showTiles(server))
+	http.HandleFunc("/debug/map", showTileMap(server))
+	http.HandleFunc("/debug/oam", showOAM(server))
+	http.HandleFunc("/debug/palettes", showPalettes(server))
+	http.HandleFunc("/debug/layers", setLayers(server))
+	http.HandleFunc("/debug/sound", setSound(server))
+	http.HandleFunc("/debug/scope", showScope(server))
 	http.ListenAndServe(fmt.Sprintf(":%d", server.Port), nil)
 }
 
@@ -70,13 +125,18 @@ func streamImages(server *StaticServer) func(http.ResponseWriter, *http.Request)
 					log.Println(err2)
 					break
 				}
+				// Hotkeys are sent by name
+				if action, ok := server.hotkeys[stringMsg]; ok {
+					action()
+					continue
+				}
 				buttonByte, err3 := strconv.ParseUint(stringMsg, 10, 32)
 				if err3 != nil {
 					log.Println(err3)
 					continue
 				}
-				if buttonByte > 7 {
-					log.Printf("Received input (%s) > 7", stringMsg)
+				if buttonByte > uint64(driver.LastButton) {
+					log.Printf("Received input (%s) > %d", stringMsg, driver.LastButton)
 					continue
 				}
 				server.driver.EnqueueInput(byte(buttonByte))
@@ -157,7 +217,7 @@ func newInput(server *StaticServer) func(http.ResponseWriter, *http.Request) {
 		}
 
 		buttonByte, err := strconv.ParseUint(keys[0], 10, 32)
-		if err != nil || buttonByte > 7 {
+		if err != nil || buttonByte > uint64(driver.LastButton) {
 			return
 		}
 
@@ -166,3 +226,95 @@ func newInput(server *StaticServer) func(http.ResponseWriter, *http.Request) {
 		http.Redirect(w, req, callback[0], http.StatusSeeOther)
 	}
 }
+
+/*
+The key bindings of the web clients, as JSON: the action of every key,
+a button number (0-7, 8-31 for the players 2-4 of the Super Game Boy)
+or a hotkey name to send to /stream.
+*/
+func showKeys(server *StaticServer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		keys := map[string]interface{}{}
+		for key, button := range server.Keys.Keymap() {
+			keys[key] = button
+		}
+		for key := range server.Keys.Hotkeys(server.hotkeys) {
+			keys[key] = server.Keys[key]
+		}
+		// The demo client is opened from a file
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		writeJSON(w, keys)
+	}
+}
+
+// The last frame without filters, as the emulator drew it
+func showScreenshot(server *StaticServer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-control", "no-cache,max-age=0")
+		w.Header().Set("Content-type", "image/png")
+		png.Encode(w, server.core.Screenshot())
+	}
+}
+
+// The last seconds (10 by default) as an animated GIF, or APNG with format=apng
+func showClip(server *StaticServer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		seconds := 10.0
+		if value := req.URL.Query().Get("seconds"); value != "" {
+			var err error
+			seconds, err = strconv.ParseFloat(value, 64)
+			if err != nil || seconds <= 0 || seconds > clipSeconds {
+				http.Error(w, fmt.Sprintf("seconds must be between 0 and %d", clipSeconds), http.StatusBadRequest)
+				return
+			}
+		}
+
+		var buf bytes.Buffer
+		var err error
+		if req.URL.Query().Get("format") == "apng" {
+			w.Header().Set("Content-type", "image/apng")
+			err = server.core.Clip.WriteAPNG(&buf, seconds)
+		} else {
+			w.Header().Set("Content-type", "image/gif")
+			err = server.core.Clip.WriteGIF(&buf, seconds)
+		}
+		if err != nil {
+			w.Header().Del("Content-type")
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Cache-control", "no-cache,max-age=0")
+		w.Write(buf.Bytes())
+	}
+}
+
+// Gallery of the pages printed, the newest first
+func showPrints(server *StaticServer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-control", "no-cache,max-age=0")
+		w.Header().Set("Content-type", "text/html; charset=utf-8")
+		pages := server.printer.Pages()
+		fmt.Fprint(w, "<!DOCTYPE html>\n<title>Prints</title>\n<body style=\"background: #ddd\">\n")
+		if len(pages) == 0 {
+			fmt.Fprint(w, "<p>Nothing printed yet</p>\n")
+		}
+		for i := len(pages) - 1; i >= 0; i-- {
+			fmt.Fprintf(w, "<p><img src=\"/prints/%d.png\" width=\"%d\"></p>\n", i, pages[i].Bounds().Dx()*2)
+		}
+	}
+}
+
+// A printed page by its number in the gallery, e.g. /prints/0.png
+func showPrint(server *StaticServer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		name := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/prints/"), ".png")
+		pages := server.printer.Pages()
+		index, err := strconv.Atoi(name)
+		if err != nil || index < 0 || index >= len(pages) {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-type", "image/png")
+		png.Encode(w, pages[index])
+	}
+}
@@ -0,0 +1,114 @@
+package stream
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/HFO4/gbc-in-cloud/driver"
+	"github.com/HFO4/gbc-in-cloud/filter"
+)
+
+/*
+NewDisplay creates the display driver drawing in a terminal:
+
+	auto           - chosen from the terminal type and size, see TerminalInfo.Display
+	truecolor, 256 - "▀" half-blocks with 24-bit or 256 colours
+	braille        - black and white Braille, for monochrome terminals
+	sixel, kitty   - images with the true pixels, for terminals with graphics
+
+The filters only apply to the images of sixel and kitty.
+*/
+func NewDisplay(conn io.Writer, display string, filters string, terminal TerminalInfo) (driver.DisplayDriver, error) {
+	if strings.EqualFold(display, "auto") {
+		var scale string
+		display, scale = terminal.Display()
+		if filters == "" {
+			filters = scale
+		}
+	}
+
+	switch strings.ToLower(display) {
+	case "braille":
+		return &driver.ASCII{
+			Conn: conn,
+		}, nil
+	case "sixel", "kitty":
+		protocol, _ := driver.ParseImageProtocol(display)
+		chain, err := filter.Parse(filters)
+		if err != nil {
+			return nil, err
+		}
+		return &driver.TerminalImage{
+			Conn:     conn,
+			Protocol: protocol,
+			Filters:  chain,
+		}, nil
+	}
+
+	colours, err := driver.ParseTerminalColours(display)
+	if err != nil {
+		return nil, err
+	}
+	return &driver.Terminal{
+		Conn:    conn,
+		Colours: colours,
+	}, nil
+}
+
+// Terminal types with Sixel graphics, and without colours
+var (
+	sixelTerminals      = []string{"mlterm", "foot", "yaft", "contour", "xterm-sixel"}
+	monochromeTerminals = []string{"vt1", "vt2", "dumb"}
+)
+
+/*
+Display Choose the display fitting the terminal, and the filter scaling
+the images to its window, assuming characters of 8x16 pixels. Only
+"screen" is known not to show 24-bit colours, and half-blocks need a
+window of 160x73 characters, Braille 80x37.
+*/
+func (terminal TerminalInfo) Display() (display string, filters string) {
+	display = "truecolor"
+	switch {
+	case strings.Contains(terminal.Type, "kitty"):
+		display = "kitty"
+	case hasPrefix(terminal.Type, sixelTerminals):
+		display = "sixel"
+	case hasPrefix(terminal.Type, monochromeTerminals):
+		display = "braille"
+	case strings.HasPrefix(terminal.Type, "screen"):
+		display = "256"
+	}
+	if terminal.Width == 0 || terminal.Height == 0 {
+		return display, ""
+	}
+
+	switch display {
+	case "truecolor", "256":
+		if terminal.Width < 160 || terminal.Height < 73 {
+			display = "braille"
+		}
+	case "sixel", "kitty":
+		scale := terminal.Width * 8 / 160
+		if rows := terminal.Height * 16 / 144; rows < scale {
+			scale = rows
+		}
+		if scale > 4 {
+			scale = 4
+		}
+		if scale > 1 {
+			filters = fmt.Sprintf("nearest%d", scale)
+		}
+	}
+	return display, filters
+}
+
+func hasPrefix(name string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
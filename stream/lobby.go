@@ -0,0 +1,270 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/HFO4/gbc-in-cloud/driver"
+)
+
+const (
+	maxNicknameLength = 16
+	maxRoomNameLength = 24
+	maxChatLength     = 200
+	// Messages kept in the chat, the last ones are shown
+	maxChatMessages = 50
+)
+
+// ChatMessage A message of the lobby chat
+type ChatMessage struct {
+	Nickname string
+	Text     string
+	Time     time.Time
+}
+
+/*
+Room Players of the lobby playing a game together. Two players are
+linked by a cable as soon as they are both in the room, up to four by a
+four-player adapter if the room was made for it.
+*/
+type Room struct {
+	Name string
+	// Index of the game in the game list
+	Game        int
+	FourPlayers bool
+	Members     []*Player
+
+	adapter *driver.FourPlayerAdapter
+}
+
+// Full Whether no other player can join
+func (room *Room) Full() bool {
+	if room.FourPlayers {
+		return len(room.Members) >= 4
+	}
+	return len(room.Members) >= 2
+}
+
+/*
+Lobby Where the players of the stream server meet: they choose a
+nickname, create or join the room of a game and chat. It is safe to use
+from the goroutines of all the players, the subscribers of the registry
+are told about its changes.
+*/
+type Lobby struct {
+	players *Registry
+
+	mutex sync.Mutex
+	// In the order they were created
+	rooms []*Room
+	chat  []ChatMessage
+}
+
+// NewLobby Lobby of the players of the registry, without rooms
+func NewLobby(players *Registry) *Lobby {
+	return &Lobby{players: players}
+}
+
+// Check the name has only printable characters and isn't too long
+func checkName(name string, maxLength int) error {
+	if name == "" {
+		return errors.New("the name is empty")
+	}
+	if utf8.RuneCountInString(name) > maxLength {
+		return fmt.Errorf("the name is longer than %d characters", maxLength)
+	}
+	for _, r := range name {
+		if r < ' ' || r == 127 {
+			return errors.New("the name has invalid characters")
+		}
+	}
+	return nil
+}
+
+// SetNickname Name the player in the lobby, unless another player has the name already
+func (lobby *Lobby) SetNickname(player *Player, nickname string) error {
+	nickname = strings.TrimSpace(nickname)
+	if err := checkName(nickname, maxNicknameLength); err != nil {
+		return err
+	}
+	lobby.mutex.Lock()
+	defer lobby.mutex.Unlock()
+	for _, other := range lobby.players.List() {
+		if other != player && strings.EqualFold(other.nickname(), nickname) {
+			return fmt.Errorf("%s is already taken", nickname)
+		}
+	}
+	player.mutex.Lock()
+	player.nick = nickname
+	player.mutex.Unlock()
+	lobby.players.Notify()
+	return nil
+}
+
+// Rooms Copies of the rooms, in the order they were created
+func (lobby *Lobby) Rooms() []Room {
+	lobby.mutex.Lock()
+	defer lobby.mutex.Unlock()
+	rooms := make([]Room, len(lobby.rooms))
+	for i, room := range lobby.rooms {
+		rooms[i] = *room
+		rooms[i].Members = append([]*Player(nil), room.Members...)
+	}
+	return rooms
+}
+
+// Chat The last messages of the chat, the oldest first
+func (lobby *Lobby) Chat(count int) []ChatMessage {
+	lobby.mutex.Lock()
+	defer lobby.mutex.Unlock()
+	if count > len(lobby.chat) {
+		count = len(lobby.chat)
+	}
+	return append([]ChatMessage(nil), lobby.chat[len(lobby.chat)-count:]...)
+}
+
+// Say Send a message to the chat
+func (lobby *Lobby) Say(player *Player, text string) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return
+	}
+	if utf8.RuneCountInString(text) > maxChatLength {
+		text = string([]rune(text)[:maxChatLength])
+	}
+	lobby.mutex.Lock()
+	if len(lobby.chat) >= maxChatMessages {
+		lobby.chat = append(lobby.chat[:0], lobby.chat[1:]...)
+	}
+	lobby.chat = append(lobby.chat, ChatMessage{Nickname: player.nickname(), Text: text, Time: time.Now()})
+	lobby.mutex.Unlock()
+	lobby.players.Notify()
+}
+
+// Create a room for the game and put the player in it
+func (lobby *Lobby) Create(player *Player, name string, game int, fourPlayers bool) error {
+	name = strings.TrimSpace(name)
+	if err := checkName(name, maxRoomNameLength); err != nil {
+		return err
+	}
+	lobby.mutex.Lock()
+	defer lobby.mutex.Unlock()
+	if lobby.room(name) != nil {
+		return fmt.Errorf("there is already a room named %s", name)
+	}
+	room := &Room{Name: name, Game: game, FourPlayers: fourPlayers}
+	if fourPlayers {
+		room.adapter = driver.NewFourPlayerAdapter(name)
+	}
+	lobby.rooms = append(lobby.rooms, room)
+	log.Printf("[Lobby] %s created the room %s\n", player.nickname(), name)
+	return lobby.join(player, room)
+}
+
+// Join Put the player in the room, connecting it to the other players
+func (lobby *Lobby) Join(player *Player, name string) (Room, error) {
+	lobby.mutex.Lock()
+	defer lobby.mutex.Unlock()
+	room := lobby.room(name)
+	if room == nil {
+		return Room{}, fmt.Errorf("the room %s is closed", name)
+	}
+	if err := lobby.join(player, room); err != nil {
+		return Room{}, err
+	}
+	return *room, nil
+}
+
+// Put the player in the room, with the mutex held
+func (lobby *Lobby) join(player *Player, room *Room) error {
+	if room.Full() {
+		return fmt.Errorf("the room %s is full", room.Name)
+	}
+	if other := lobby.roomOf(player); other != nil {
+		return fmt.Errorf("you are already in the room %s", other.Name)
+	}
+	if room.FourPlayers {
+		port, err := room.adapter.Plug()
+		if err != nil {
+			return err
+		}
+		player.mutex.Lock()
+		player.port = port
+		player.mutex.Unlock()
+	} else if len(room.Members) == 1 {
+		other := room.Members[0]
+		other.serial.SetTarget(player.serial)
+		player.serial.SetTarget(other.serial)
+	}
+	room.Members = append(room.Members, player)
+	log.Printf("[Lobby] %s joined the room %s\n", player.nickname(), room.Name)
+	lobby.players.Notify()
+	return nil
+}
+
+// Leave Take the player out of its room, closed once empty
+func (lobby *Lobby) Leave(player *Player) {
+	lobby.mutex.Lock()
+	defer lobby.mutex.Unlock()
+	room := lobby.roomOf(player)
+	if room == nil {
+		return
+	}
+	for i, member := range room.Members {
+		if member == player {
+			room.Members = append(room.Members[:i], room.Members[i+1:]...)
+			break
+		}
+	}
+	if room.FourPlayers {
+		if port := player.adapterPort(); port != nil {
+			port.Unplug()
+		}
+		player.mutex.Lock()
+		player.port = nil
+		player.mutex.Unlock()
+	} else {
+		player.serial.SetTarget(nil)
+		for _, member := range room.Members {
+			member.serial.SetTarget(nil)
+		}
+	}
+	log.Printf("[Lobby] %s left the room %s\n", player.nickname(), room.Name)
+
+	if len(room.Members) == 0 {
+		for i, other := range lobby.rooms {
+			if other == room {
+				lobby.rooms = append(lobby.rooms[:i], lobby.rooms[i+1:]...)
+				break
+			}
+		}
+	}
+	lobby.players.Notify()
+}
+
+// The room of the name, nil if there is none, with the mutex held
+func (lobby *Lobby) room(name string) *Room {
+	for _, room := range lobby.rooms {
+		if strings.EqualFold(room.Name, name) {
+			return room
+		}
+	}
+	return nil
+}
+
+// The room the player is in, nil if none, with the mutex held
+func (lobby *Lobby) roomOf(player *Player) *Room {
+	for _, room := range lobby.rooms {
+		for _, member := range room.Members {
+			if member == player {
+				return room
+			}
+		}
+	}
+	return nil
+}
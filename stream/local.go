@@ -0,0 +1,155 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/HFO4/gbc-in-cloud/driver"
+	"github.com/HFO4/gbc-in-cloud/gb"
+)
+
+/*
+LocalGame plays a game in the terminal the emulator runs in, drawn like
+for the players of the cloud-gaming server. The keys are the same as in
+telnet unless rebound, Q quits.
+*/
+type LocalGame struct {
+	Path string
+	// Palette name or custom colours, see gb.ParsePalette
+	Palette      string
+	SuperGameBoy bool
+	// How the screen is drawn and the filters of the images, see NewDisplay
+	Display string
+	Filters string
+	// Buttons and hotkeys of the keys, the default ones if nil
+	Keys driver.KeyBindings
+	// Link cable to another emulator: the address to wait for it on, or its address
+	LinkListen string
+	LinkJoin   string
+	// Directory of the pages of a Game Boy Printer plugged instead, none if empty
+	PrintPath string
+}
+
+func (game *LocalGame) Run() error {
+	// Both go in the serial port, refused before waiting for the other player
+	if game.PrintPath != "" && (game.LinkListen != "" || game.LinkJoin != "") {
+		return errors.New("the link cable and the printer can't be plugged together")
+	}
+	display, err := NewDisplay(os.Stdout, game.Display, game.Filters, localTerminal())
+	if err != nil {
+		return err
+	}
+	controller := &driver.TelnetController{Keymap: game.Keys.Keymap()}
+	core := &gb.Core{
+		// Terminals are slower than windows, and so is drawing in them
+		FPS:           30,
+		Clock:         4194304,
+		DisplayDriver: display,
+		Controller:    controller,
+		DrawSignal:    make(chan bool),
+		PaletteName:   game.Palette,
+		SuperGameBoy:  game.SuperGameBoy,
+		RewindSeconds: gb.DefaultRewindSeconds,
+	}
+	core.Init(game.Path)
+	controller.SetHotkeys(game.Keys.Hotkeys(core.Hotkeys()))
+	// The other player is awaited before the screen is taken over
+	link, err := driver.ConnectLink(game.LinkListen, game.LinkJoin, core.GameTitle)
+	if err != nil {
+		return err
+	}
+	if link != nil {
+		core.Serial = link
+		defer link.Close()
+	}
+	if game.PrintPath != "" {
+		printer := driver.NewPrinter(game.PrintPath)
+		core.Serial = printer
+		defer printer.Flush()
+	}
+
+	restore, err := rawTerminal()
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	done := make(chan bool)
+	go func() {
+		display.Run(core.DrawSignal, func() {})
+		close(done)
+	}()
+	go core.Run()
+
+	buf := make([]byte, 512)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil || n == 0 {
+			break
+		}
+		// Q or Ctrl+C quits
+		if hasKey(buf[:n], "q", "Q", "Ctrl+C") {
+			break
+		}
+		controller.NewInput(buf[:n])
+	}
+
+	core.Exit = true
+	<-done
+	if image, ok := display.(*driver.TerminalImage); ok && image.Protocol == driver.KittyProtocol {
+		// Delete the images, clearing the screen may not
+		os.Stdout.Write([]byte("\033_Ga=d,q=2\033\\"))
+	}
+	core.SaveRAM()
+	return nil
+}
+
+// Type and size of the terminal the emulator runs in
+func localTerminal() TerminalInfo {
+	terminal := TerminalInfo{
+		Type: strings.ToLower(os.Getenv("TERM")),
+	}
+	// "rows columns"
+	if size, err := stty("size"); err == nil {
+		fmt.Sscan(size, &terminal.Height, &terminal.Width)
+	}
+	return terminal
+}
+
+/*
+Put the terminal in raw mode, so keys are read as soon as they are
+pressed and not echoed. The returned function restores it.
+*/
+func rawTerminal() (func(), error) {
+	state, err := stty("-g")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stty("raw", "-echo"); err != nil {
+		return nil, err
+	}
+	// Hide the cursor, logs would be drawn over the screen
+	os.Stdout.Write([]byte("\033[?25l"))
+	log.SetOutput(ioutil.Discard)
+
+	return func() {
+		log.SetOutput(os.Stderr)
+		if _, err := stty(strings.TrimSpace(state)); err != nil {
+			log.Println("[Display] Failed to restore the terminal,", err)
+		}
+		// Reset the colours, clear the screen and show the cursor
+		os.Stdout.Write([]byte("\033[0m\033[2J\033[H\033[?25h"))
+	}, nil
+}
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return string(out), err
+}
@@ -4,44 +4,112 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/HFO4/gbc-in-cloud/driver"
 	"github.com/HFO4/gbc-in-cloud/gb"
 	"github.com/logrusorgru/aurora"
 )
 
+// How long to wait for the terminal type and window size of a new player
+const telnetTimeout = 2 * time.Second
+
 // Player Single player model
 type Player struct {
-	Conn     net.Conn
+	Conn net.Conn
+	// Set once the game is chosen, guarded by mutex like Terminal
 	Emulator *gb.Core
 	ID       string
 	Selected int
 	GameList *[]GameInfo
-
-	SelectedPlayer   int
-	SelectedPlayerID string
+	Display  string
+	Filters  string
+	// Changed by the connection when the window is resized
+	Terminal TerminalInfo
+	// Name of the player known by an SSH key, empty for telnet players, set before joining the registry
+	User string
+	// Directory of the player's saves, next to the ROMs if empty
+	SaveDir string
+	// Buttons and hotkeys of the keys, the default ones if nil
+	Keys driver.KeyBindings
+	// Players online, and the lobby where they meet to play together
+	Players *Registry
+	Lobby   *Lobby
+
+	controller *driver.TelnetController
+	// Link cable to the player selected in the multiplayer screen
+	serial *driver.ChannelIO
+	// Display of the game, drawing it for the player and the spectators of the game
+	screen *driver.FanOut
+	// Keys of the selected game
+	bindings driver.KeyBindings
+
+	// Input of the player, closed with the error of the connection in readErr
+	inputs  chan []byte
+	readErr error
+	done    chan struct{}
+
+	/*
+		What the other players see of the player in the lobby, and
+		what the connection changes while the player is served
+	*/
+	mutex sync.Mutex
+	nick  string
+	// Four-player adapter of the room, plugged instead of the link cable
+	port *driver.AdapterPort
+	// Title of the game being played, empty until it starts
+	playing string
+	// Display of the game of another player being watched, nil if none
+	watching driver.DisplayDriver
 }
 
-// Send TELNET options
+// Negotiate TELNET options, and learn the player's terminal
 func (player *Player) InitTelnet() bool {
-	// Send telnet options
-	_, err := player.Conn.Write([]byte{255, 253, 34})
-	_, err = player.Conn.Write([]byte{255, 250, 34, 1, 0, 255, 240})
-	// NOT ECHO
-	_, err = player.Conn.Write([]byte{0xFF, 0xFB, 0x01})
+	conn := NewTelnetConn(player.Conn)
+	player.Conn = conn
+	err := conn.Negotiate(telnetTimeout)
 	if err != nil {
+		log.Println("[Telnet] Failed to negotiate with player", player.ID, err)
 		return false
 	}
+	terminal := conn.Terminal()
+	player.SetTerminal(terminal)
+	log.Printf("[Telnet] Player %s terminal: %q %dx%d\n", player.ID, terminal.Type, terminal.Width, terminal.Height)
 	return true
 }
 
+// SetTerminal Learn the terminal of the player, before the game starts
+func (player *Player) SetTerminal(terminal TerminalInfo) {
+	player.mutex.Lock()
+	player.Terminal = terminal
+	player.mutex.Unlock()
+}
+
+// The terminal of the player as last told by the connection
+func (player *Player) terminal() TerminalInfo {
+	player.mutex.Lock()
+	defer player.mutex.Unlock()
+	return player.Terminal
+}
+
 func (player *Player) Init() bool {
 
 	if player.Emulator == nil {
-		Driver := &driver.ASCII{
-			Conn: player.Conn,
+		player.controller = new(driver.TelnetController)
+		player.serial = driver.NewChannelIO()
+		Driver, err := NewDisplay(player.Conn, player.Display, player.Filters, player.terminal())
+		if err != nil {
+			log.Println("[Display]", err)
+			return false
 		}
+		player.screen = driver.NewFanOut(Driver)
 
 		core := &gb.Core{
 			// Terminal gaming dose not require high FPS,
@@ -49,14 +117,18 @@ func (player *Player) Init() bool {
 			FPS:           10,
 			Clock:         4194304,
 			Debug:         false,
-			DisplayDriver: Driver,
-			Controller:    new(driver.TelnetController),
+			DisplayDriver: player.screen,
+			Controller:    player.controller,
+			Serial:        player.serial,
 			DrawSignal:    make(chan bool),
 			SpeedMultiple: 0,
 			ToggleSound:   false,
+			RewindSeconds: gb.DefaultRewindSeconds,
 		}
 
+		player.mutex.Lock()
 		player.Emulator = core
+		player.mutex.Unlock()
 
 		log.Println("New Player:", player.ID)
 
@@ -65,11 +137,33 @@ func (player *Player) Init() bool {
 
 }
 
+/*
+	The player's window was resized, the screen is drawn again whole
+	as terminals may have moved or cleared it.
+*/
+func (player *Player) Resize(width int, height int) {
+	player.mutex.Lock()
+	player.Terminal.Width = width
+	player.Terminal.Height = height
+	emulator := player.Emulator
+	watching := player.watching
+	player.mutex.Unlock()
+	if display, ok := watching.(driver.RedrawDisplayDriver); ok {
+		display.Redraw()
+	}
+	if emulator == nil {
+		return
+	}
+	if display, ok := emulator.DisplayDriver.(driver.RedrawDisplayDriver); ok {
+		display.Redraw()
+	}
+}
+
 // Generate welcome and game selection screen
 func (player *Player) RenderWelcomeScreen() []byte {
 	res := "\033[H"
 	res += "Welcome to " + fmt.Stringer(aurora.Bold(aurora.Green("Gameboy.Live"))).String() + ", you can enjoy GAMEBOY games in your terminal with \"cloud gaming\" experience.\r\n"
-	res += "Use " + fmt.Stringer(aurora.Gray(1-1, "Direction keys").BgGray(24-1)).String() + " in your keyboard to select a game, " + fmt.Stringer(aurora.Gray(1-1, " Enter ").BgGray(24-1)).String() + " key to confirm, " + fmt.Stringer(aurora.Gray(1-1, " M ").BgGray(24-1)).String() + " key to enter multi-player mode and select a partner.\r\n"
+	res += "Use " + fmt.Stringer(aurora.Gray(1-1, "Direction keys").BgGray(24-1)).String() + " in your keyboard to select a game, " + fmt.Stringer(aurora.Gray(1-1, " Enter ").BgGray(24-1)).String() + " key to confirm, " + fmt.Stringer(aurora.Gray(1-1, " M ").BgGray(24-1)).String() + " key to enter the lobby and play with others, " + fmt.Stringer(aurora.Gray(1-1, " W ").BgGray(24-1)).String() + " key to watch the games being played.\r\n"
 	res += "\r\n\r\n"
 
 	for k, v := range *player.GameList {
@@ -98,45 +192,44 @@ func (player *Player) Welcome() int {
 		return -1
 	}
 
-	player.Init()
+	if !player.Init() {
+		return -1
+	}
 
 	for {
-		var n int
 		_, err = player.Conn.Write(player.RenderWelcomeScreen())
-		buf := make([]byte, 512)
-		n, err = player.Conn.Read(buf)
-		inputKey := buf[:n]
+		input, err := player.read()
 		if err != nil {
 			return -1
 		}
 
-		switch inputKey[len(inputKey)-1] {
-		// Up key pressed
-		case 65:
-			if player.Selected == 0 {
-				player.Selected = len(*player.GameList) - 1
-			} else {
-				player.Selected--
-			}
-		// Down key pressed
-		case 66:
-			if player.Selected == len(*player.GameList)-1 {
-				player.Selected = 0
-			} else {
-				player.Selected++
-			}
-		// Enter key pressed
-		case 10, 0:
-			return player.Selected
-		case 109:
-			player.SelectPlayer()
-			_, err = player.Conn.Write([]byte("\033[2J\033[H"))
-
-			// If choose each other, connect their serial driver
-			if player.SelectedPlayerID != "" && PlayerList[player.SelectedPlayer].SelectedPlayerID == player.ID {
-				PlayerList[player.SelectedPlayer].Emulator.Serial.SetTarget(&player.Emulator.Serial)
-				player.Emulator.Serial.SetTarget(&PlayerList[player.SelectedPlayer].Emulator.Serial)
-				log.Printf("[Serial] Player %s connect with Player %s", player.SelectedPlayerID, PlayerList[player.SelectedPlayer].SelectedPlayerID)
+		for _, key := range driver.ParseKeys(input) {
+			switch key {
+			case "Up":
+				if player.Selected == 0 {
+					player.Selected = len(*player.GameList) - 1
+				} else {
+					player.Selected--
+				}
+			case "Down":
+				if player.Selected == len(*player.GameList)-1 {
+					player.Selected = 0
+				} else {
+					player.Selected++
+				}
+			case "Enter":
+				return player.Selected
+			case "m", "M":
+				game := player.EnterLobby()
+				if game != lobbyBack {
+					return game
+				}
+				_, err = player.Conn.Write([]byte("\033[2J\033[H"))
+			case "w", "W":
+				if player.Watch() < 0 {
+					return -1
+				}
+				_, err = player.Conn.Write([]byte("\033[2J\033[H"))
 			}
 		}
 
@@ -144,83 +237,436 @@ func (player *Player) Welcome() int {
 
 }
 
+// What the player is typing in the lobby
+const (
+	typingNothing = iota
+	typingNickname
+	typingRoom
+	typingFourPlayerRoom
+	typingChat
+)
+
+const (
+	// Returned by EnterLobby to go back to the game list
+	lobbyBack = -2
+	// Messages of the chat shown in the lobby
+	lobbyChatLines = 8
+)
+
+// State of the lobby screen of a player
+type lobbyScreen struct {
+	typing int
+	line   []rune
+	// Name of the room under the cursor
+	cursor string
+	// Error of the last action
+	message string
+}
+
+// Position of the cursor in the rooms, the first one if its room closed
+func (screen *lobbyScreen) cursorIndex(rooms []Room) int {
+	for k, room := range rooms {
+		if room.Name == screen.cursor {
+			return k
+		}
+	}
+	return 0
+}
+
+// The name of the player in the lobby, empty until chosen
+func (player *Player) nickname() string {
+	player.mutex.Lock()
+	defer player.mutex.Unlock()
+	return player.nick
+}
+
+// The four-player adapter port of the room of the player, nil if none is plugged
+func (player *Player) adapterPort() *driver.AdapterPort {
+	player.mutex.Lock()
+	defer player.mutex.Unlock()
+	return player.port
+}
+
+// A key of the help of the lobby, like the keys of the other screens
+func keyHint(name string) string {
+	return fmt.Stringer(aurora.Gray(1-1, " "+name+" ").BgGray(24-1)).String()
+}
+
 /*
-	Render select multiplayer screen
+	Render the lobby: the rooms, the players online, the chat, and
+	the line being typed.
 */
-func (player *Player) RenderSelectPlayer() []byte {
+func (player *Player) renderLobby(screen *lobbyScreen, rooms []Room, players []*Player) []byte {
+	games := *player.GameList
 	res := "\033[2J\033[H"
-	res += "You can play multiplayer game with your friend or strangers. The list below lists players who are currently online. Both of you need to choose each other, so that the connection can be established.\r\n"
-	res += "Your player ID: " + fmt.Stringer(aurora.Gray(1-1, player.ID).BgGray(24-1)).String() + "\r\n"
-	res += "Player list (Press R to refresh):\r\n\r\n"
-
-	for k, v := range PlayerList {
+	res += fmt.Stringer(aurora.Bold(aurora.Green("Lobby"))).String()
+	if nickname := player.nickname(); nickname != "" {
+		res += ", you are " + fmt.Stringer(aurora.Bold(nickname)).String()
+	}
+	res += ".\r\n"
+	switch screen.typing {
+	case typingNothing:
+		res += keyHint("↑↓") + " choose a room, " + keyHint("Enter") + " join it, " + keyHint("C") + " create a room for " + games[player.Selected].Title + ", " + keyHint("F") + " create a four-player room for it, " + keyHint("T") + " chat, " + keyHint("N") + " change your nickname, " + keyHint("Esc") + " go back to the game list.\r\n"
+	default:
+		res += keyHint("Enter") + " to confirm, " + keyHint("Esc") + " to cancel.\r\n"
+	}
 
-		if player.SelectedPlayer == k {
-			res += "    " + fmt.Stringer(aurora.Gray(1-1, v.ID+"\r\n").BgGray(24-1)).String()
+	res += "\r\nRooms:\r\n"
+	if len(rooms) == 0 {
+		res += "    No room yet, create one to play with others.\r\n"
+	}
+	selected := screen.cursorIndex(rooms)
+	for k, room := range rooms {
+		var members []string
+		for _, member := range room.Members {
+			members = append(members, member.nickname())
+		}
+		line := room.Name + " - " + games[room.Game].Title
+		if room.FourPlayers {
+			line += fmt.Sprintf(" (four-player adapter, %d/4)", len(room.Members))
+		} else {
+			line += fmt.Sprintf(" (link cable, %d/2)", len(room.Members))
+		}
+		line += ": " + strings.Join(members, ", ")
+		if selected == k && screen.typing == typingNothing {
+			res += "    " + fmt.Stringer(aurora.Gray(1-1, line).BgGray(24-1)).String() + "\r\n"
 		} else {
-			res += "    " + v.ID + "\r\n"
+			res += "    " + line + "\r\n"
 		}
+	}
 
+	var online []string
+	for _, other := range players {
+		if nickname := other.nickname(); nickname != "" {
+			online = append(online, nickname)
+		}
+	}
+	res += "\r\nPlayers online: " + strings.Join(online, ", ") + "\r\n"
+
+	res += "\r\nChat:\r\n"
+	for _, message := range player.Lobby.Chat(lobbyChatLines) {
+		res += "    " + message.Time.Format("15:04") + " " + fmt.Stringer(aurora.Bold(message.Nickname)).String() + ": " + message.Text + "\r\n"
+	}
+
+	if screen.message != "" {
+		res += "\r\n" + fmt.Stringer(aurora.Yellow(screen.message)).String() + "\r\n"
+	}
+	switch screen.typing {
+	case typingNickname:
+		res += "\r\nYour nickname: "
+	case typingRoom:
+		res += "\r\nName of the room for " + games[player.Selected].Title + ": "
+	case typingFourPlayerRoom:
+		res += "\r\nName of the four-player room for " + games[player.Selected].Title + ": "
+	case typingChat:
+		res += "\r\nSay: "
+	}
+	if screen.typing != typingNothing {
+		res += string(screen.line) + "_"
 	}
 	return []byte(res)
 }
 
 /*
-	Select multiplayer
+	The lobby, drawn again whenever the players online, the rooms or
+	the chat change. Returns the game of the room joined, lobbyBack to
+	go back to the game list or -1 if the player left.
 */
-func (player *Player) SelectPlayer() int {
+func (player *Player) EnterLobby() int {
+	changes, unsubscribe := player.Players.Subscribe()
+	defer unsubscribe()
+
+	screen := &lobbyScreen{}
+	if player.nickname() == "" {
+		// SSH players are known by their key already
+		screen.typing = typingNickname
+		screen.line = []rune(player.User)
+	}
 
 	for {
-		var n int
-		_, err := player.Conn.Write(player.RenderSelectPlayer())
+		rooms := player.Lobby.Rooms()
+		_, err := player.Conn.Write(player.renderLobby(screen, rooms, player.Players.List()))
 		if err != nil {
 			return -1
 		}
-		buf := make([]byte, 512)
-		n, err = player.Conn.Read(buf)
-		inputKey := buf[:n]
-		if err != nil {
+		var input []byte
+		select {
+		case <-changes:
+			continue
+		case input = <-player.inputs:
+		}
+		if input == nil {
 			return -1
 		}
 
-		switch inputKey[len(inputKey)-1] {
-		// Up key pressed
-		case 65:
-			if player.SelectedPlayer == 0 {
-				player.SelectedPlayer = len(PlayerList) - 1
-			} else {
-				player.SelectedPlayer--
-			}
-		// Down key pressed
-		case 66:
-			if player.SelectedPlayer == len(PlayerList)-1 {
-				player.SelectedPlayer = 0
+		for _, key := range driver.ParseKeys(input) {
+			var game int
+			if screen.typing != typingNothing {
+				game = player.typeInLobby(screen, key)
 			} else {
-				player.SelectedPlayer++
+				game = player.moveInLobby(screen, key)
 			}
-		// Enter key pressed
-		case 10, 0:
-			// Cannot choose yourself
-			if PlayerList[player.SelectedPlayer].ID == player.ID {
-				continue
+			if game != -1 {
+				return game
 			}
+		}
+	}
+}
 
-			// Choose none
-			if player.SelectedPlayer == 0 {
-				player.SelectedPlayerID = ""
-				return 0
+// A key pressed while typing in the lobby, returns the game to play or lobbyBack if any
+func (player *Player) typeInLobby(screen *lobbyScreen, key string) int {
+	switch key {
+	case "Escape":
+		screen.message = ""
+		// A nickname is needed to stay
+		if player.nickname() == "" {
+			return lobbyBack
+		}
+		screen.typing = typingNothing
+	case "Backspace":
+		if len(screen.line) > 0 {
+			screen.line = screen.line[:len(screen.line)-1]
+		}
+	case "Enter":
+		var err error
+		line := string(screen.line)
+		switch screen.typing {
+		case typingNickname:
+			err = player.Lobby.SetNickname(player, line)
+		case typingRoom, typingFourPlayerRoom:
+			err = player.Lobby.Create(player, line, player.Selected, screen.typing == typingFourPlayerRoom)
+			if err == nil {
+				return player.Selected
 			}
+		case typingChat:
+			player.Lobby.Say(player, line)
+		}
+		if err != nil {
+			screen.message = err.Error()
+			return -1
+		}
+		screen.message = ""
+		screen.typing = typingNothing
+	default:
+		// Printable characters are named by themselves
+		if utf8.RuneCountInString(key) == 1 && len(screen.line) < maxChatLength {
+			screen.line = append(screen.line, []rune(key)...)
+		}
+	}
+	return -1
+}
+
+// A key pressed in the lobby, returns the game to play or lobbyBack if any
+func (player *Player) moveInLobby(screen *lobbyScreen, key string) int {
+	// The rooms may have changed since they were drawn
+	rooms := player.Lobby.Rooms()
+	selected := screen.cursorIndex(rooms)
+	screen.message = ""
+	switch key {
+	case "Up":
+		if selected == 0 {
+			selected = len(rooms) - 1
+		} else {
+			selected--
+		}
+	case "Down":
+		if selected == len(rooms)-1 {
+			selected = 0
+		} else {
+			selected++
+		}
+	case "Enter":
+		if len(rooms) == 0 {
+			return -1
+		}
+		room, err := player.Lobby.Join(player, rooms[selected].Name)
+		if err != nil {
+			screen.message = err.Error()
+			return -1
+		}
+		player.Selected = room.Game
+		return room.Game
+	case "c", "C":
+		screen.typing = typingRoom
+		screen.line = nil
+	case "f", "F":
+		screen.typing = typingFourPlayerRoom
+		screen.line = nil
+	case "t", "T":
+		screen.typing = typingChat
+		screen.line = nil
+	case "n", "N":
+		screen.typing = typingNickname
+		screen.line = []rune(player.nickname())
+	case "Escape", "q", "Q":
+		return lobbyBack
+	}
+	if selected >= 0 && selected < len(rooms) {
+		screen.cursor = rooms[selected].Name
+	}
+	return -1
+}
+
+// Name of the player shown to the others: its nickname, the name of its SSH key or its ID
+func (player *Player) displayName() string {
+	if nickname := player.nickname(); nickname != "" {
+		return nickname
+	}
+	if player.User != "" {
+		return player.User
+	}
+	return player.ID
+}
+
+// Title of the game the player is playing, empty if none
+func (player *Player) game() string {
+	player.mutex.Lock()
+	defer player.mutex.Unlock()
+	return player.playing
+}
+
+// The other players playing a game, which can be watched
+func (player *Player) playersWatchable() []*Player {
+	var players []*Player
+	for _, other := range player.Players.List() {
+		if other != player && other.game() != "" {
+			players = append(players, other)
+		}
+	}
+	return players
+}
+
+/*
+	Render the list of the games being played, with the number of
+	spectators of each.
+*/
+func (player *Player) RenderWatchList(players []*Player, cursor string) []byte {
+	res := "\033[2J\033[H"
+	res += "Watch the games being played, the list is updated as they start and end. " + keyHint("Enter") + " to watch the selected one, " + keyHint("Q") + " to stop watching and go back, here and while watching.\r\n\r\n"
+	if len(players) == 0 {
+		res += "    Nobody is playing right now.\r\n"
+	}
+	for _, other := range players {
+		line := fmt.Sprintf("%s playing %s (%d watching)", other.displayName(), other.game(), other.screen.Count())
+		if other.ID == cursor {
+			res += "    " + fmt.Stringer(aurora.Gray(1-1, line).BgGray(24-1)).String() + "\r\n"
+		} else {
+			res += "    " + line + "\r\n"
+		}
+	}
+	return []byte(res)
+}
+
+/*
+	Choose a game being played and watch it, returns -1 if the
+	player left.
+*/
+func (player *Player) Watch() int {
+	changes, unsubscribe := player.Players.Subscribe()
+	defer unsubscribe()
 
-			player.SelectedPlayerID = PlayerList[player.SelectedPlayer].ID
-			return 0
-		// R key pressed
-		case 114:
+	cursor := ""
+	for {
+		players := player.playersWatchable()
+		selected := 0
+		for k, other := range players {
+			if other.ID == cursor {
+				selected = k
+			}
+		}
+		if len(players) > 0 {
+			cursor = players[selected].ID
+		}
+		_, err := player.Conn.Write(player.RenderWatchList(players, cursor))
+		if err != nil {
+			return -1
+		}
+		var input []byte
+		select {
+		case <-changes:
 			continue
+		case input = <-player.inputs:
+		}
+		if input == nil {
+			return -1
 		}
 
-		log.Println(inputKey)
+		for _, key := range driver.ParseKeys(input) {
+			switch key {
+			case "Up":
+				if selected == 0 {
+					selected = len(players) - 1
+				} else {
+					selected--
+				}
+			case "Down":
+				if selected == len(players)-1 {
+					selected = 0
+				} else {
+					selected++
+				}
+			case "Enter":
+				if len(players) == 0 {
+					continue
+				}
+				if player.spectate(players[selected], changes) < 0 {
+					return -1
+				}
+			case "q", "Q", "Escape":
+				return 0
+			}
+			if selected >= 0 && selected < len(players) {
+				cursor = players[selected].ID
+			}
+		}
+	}
+}
+
+/*
+	Show the frames of the game of the other player until Q is
+	pressed or the game ends, the input goes nowhere else. The frames
+	are drawn for the terminal of the spectator, with its display.
+	Returns -1 if the player left.
+*/
+func (player *Player) spectate(other *Player, changes <-chan struct{}) int {
+	_, err := player.Conn.Write([]byte("\033[2J\033[H"))
+	if err != nil {
+		return -1
+	}
+	display, err := NewDisplay(player.Conn, player.Display, player.Filters, player.terminal())
+	if err != nil {
+		log.Println("[Display]", err)
+		return 0
+	}
+	player.mutex.Lock()
+	player.watching = display
+	player.mutex.Unlock()
+	other.screen.Add(display)
+	defer func() {
+		other.screen.Remove(display)
+		player.mutex.Lock()
+		player.watching = nil
+		player.mutex.Unlock()
+	}()
+	log.Printf("[Spectator] %s watches %s playing %s\n", player.displayName(), other.displayName(), other.game())
+	player.Players.Notify()
+	defer player.Players.Notify()
+
+	for {
+		select {
+		case <-changes:
+			if player.Players.Get(other.ID) == nil {
+				return 0
+			}
+		case input := <-player.inputs:
+			if input == nil {
+				return -1
+			}
+			if hasKey(input, "q", "Q", "Escape") {
+				return 0
+			}
+		}
 	}
-	return 0
 }
 
 /*
@@ -231,21 +677,23 @@ func (player *Player) SelectPlayer() int {
 func (player *Player) Instruction() int {
 	ret := "Here's the key instruction, press " + fmt.Stringer(aurora.Gray(1-1, "Enter").BgGray(24-1)).String() + " key to enter the game, " + fmt.Stringer(aurora.Gray(1-1, " Q ").BgGray(24-1)).String() + " to quit the game.\r\n\r\n"
 	ret += "                      __________________________\r\n" + "                     |OFFo oON                  |\r\n" + "                     | .----------------------. |\r\n" + "                     | |  .----------------.  | |\r\n" + "                     | |  |                |  | |\r\n" + "                     | |))|                |  | |\r\n" + "                     | |  |                |  | |\r\n" + "                     | |  |                |  | |\r\n" + "                     | |  |                |  | |\r\n" + "                     | |  |                |  | |\r\n" + "                     | |  |                |  | |\r\n" + "                     | |  '----------------'  | |\r\n" + "                     | |__GAME BOY____________/ |\r\n" + "    Keyboard:Up↑ <--------+     ________        |\r\n" + "                     |    +    (Nintendo)       |\r\n" + "                     |  _| |_   \"\"\"\"\"\"\"\"   .-.  |\r\n" + "  Keyboard:Left← <----+[_   _]---+    .-. ( +---------> Keyboard:X\r\n" + "                     |   |_|     |   (   ) '-'  |\r\n" + "                     |    +      |    '-+   A   |\r\n" + "  Keyboard:Down↓ <--------+ +----+     B+-------------> Keyboard:Z\r\n" + "                     |      |   ___   ___       |\r\n" + "                     |      |  (___) (___)  ,., |\r\n" + "Keyboard:Right→ <-----------+ select st+rt ;:;: |\r\n" + "                     |           +     |  ,;:;' /\r\n" + "                  jgs|           |     | ,:;:'.'\r\n" + "                     '-----------------------`\r\n" + "                                 |     |\r\n" + "           Keyboard:Backspace <--+     +-> Keyboard:Enter\r\n"
+	// The drawing shows the default keys
+	if !reflect.DeepEqual(player.bindings.Keymap(), driver.DefaultKeymap) {
+		ret += "\r\nButtons: " + player.bindings.DescribeButtons() + "\r\n"
+	}
+	ret += "\r\nHotkeys: " + player.bindings.DescribeHotkeys() + "\r\n"
 	// Clean screen
 	_, err := player.Conn.Write([]byte("\033[2J\033[H" + ret))
 	if err != nil {
 		return -1
 	}
 	for {
-		buf := make([]byte, 512)
-		n, err := player.Conn.Read(buf)
-		inputKey := buf[:n]
+		input, err := player.read()
 		if err != nil {
 			return -1
 		}
 
-		// Enter key pressed
-		if inputKey[len(inputKey)-1] == 0 || inputKey[len(inputKey)-1] == 10 {
+		if hasKey(input, "Enter") {
 			return 1
 		}
 	}
@@ -253,24 +701,45 @@ func (player *Player) Instruction() int {
 
 func (player *Player) Logout() {
 	// Disconnect serial port
-	if player.Emulator.Serial.Target != nil {
-		player.Emulator.Serial.Target.Target = nil
-	}
+	player.Lobby.Leave(player)
+	player.Players.Remove(player.ID)
+}
 
-	playerIndex := 0
-	for k, v := range PlayerList {
-		if v.ID == player.ID {
-			playerIndex = k
-			break
+/*
+	Read the input of the player in the background, the screens wait
+	for it with read or along with other events.
+*/
+func (player *Player) readInputs() {
+	for {
+		buf := make([]byte, 512)
+		n, err := player.Conn.Read(buf)
+		if err != nil {
+			player.readErr = err
+			close(player.inputs)
+			return
+		}
+		select {
+		case player.inputs <- buf[:n]:
+		case <-player.done:
+			return
 		}
 	}
+}
 
-	if playerIndex != 0 {
-		PlayerList = append(PlayerList[:playerIndex], PlayerList[playerIndex+1:]...)
+// The next input of the player
+func (player *Player) read() ([]byte, error) {
+	input, ok := <-player.inputs
+	if !ok {
+		return nil, player.readErr
 	}
+	return input, nil
 }
 
 func (player *Player) Serve() {
+	player.inputs = make(chan []byte)
+	player.done = make(chan struct{})
+	defer close(player.done)
+	go player.readInputs()
 
 	game := player.Welcome()
 
@@ -279,6 +748,8 @@ func (player *Player) Serve() {
 		player.Logout()
 		return
 	}
+	info := (*player.GameList)[player.Selected]
+	player.bindings = player.Keys.Merge(info.Keys)
 
 	if player.Instruction() < 0 {
 		log.Println("User quit")
@@ -286,14 +757,29 @@ func (player *Player) Serve() {
 		return
 	}
 
-	// Set the display driver to TELNET
+	player.Emulator.PaletteName = info.Palette
+	if player.SaveDir != "" {
+		if err := os.MkdirAll(player.SaveDir, 0755); err != nil {
+			log.Println("[Core] Failed to create the save directory,", err)
+		}
+		player.Emulator.RamPath = filepath.Join(player.SaveDir, filepath.Base(info.Path)+".sav")
+	}
+	player.controller.Keymap = player.bindings.Keymap()
+	if port := player.adapterPort(); port != nil {
+		player.Emulator.Serial = port
+	}
+	player.Emulator.Init(info.Path)
+	// Set the display driver to TELNET, once Init set it up
 	go player.Emulator.DisplayDriver.Run(player.Emulator.DrawSignal, func() {})
-	player.Emulator.Init((*player.GameList)[player.Selected].Path)
+	player.controller.SetHotkeys(player.bindings.Hotkeys(player.Emulator.Hotkeys()))
 	go player.Emulator.Run()
+	player.mutex.Lock()
+	player.playing = info.Title
+	player.mutex.Unlock()
+	player.Players.Notify()
 
 	for {
-		buf := make([]byte, 512)
-		n, err := player.Conn.Read(buf)
+		input, err := player.read()
 		if err != nil {
 			log.Println("Error reading", err.Error())
 			player.Emulator.Exit = true
@@ -301,7 +787,7 @@ func (player *Player) Serve() {
 			return
 		}
 		// If "Q" was pressed ,close the connection
-		if buf[n-1] == 113 {
+		if hasKey(input, "q", "Q") {
 			log.Println("User quit")
 			player.Emulator.Exit = true
 			err := player.Conn.Close()
@@ -312,6 +798,18 @@ func (player *Player) Serve() {
 			return
 		}
 		// Handle user input
-		player.Emulator.Controller.NewInput(buf[:n])
+		player.controller.NewInput(input)
+	}
+}
+
+// Whether one of the keys was pressed in the input
+func hasKey(input []byte, names ...string) bool {
+	for _, key := range driver.ParseKeys(input) {
+		for _, name := range names {
+			if key == name {
+				return true
+			}
+		}
 	}
+	return false
 }
@@ -0,0 +1,100 @@
+package stream
+
+import "sync"
+
+/*
+Registry Players online, by ID. It is safe to use from the goroutines
+of all the players, and tells its subscribers when players join, leave
+or change their multiplayer choices.
+*/
+type Registry struct {
+	mutex   sync.RWMutex
+	players map[string]*Player
+	// IDs in the order the players joined, for listing them
+	order       []string
+	subscribers map[chan struct{}]struct{}
+}
+
+// NewRegistry Registry without players
+func NewRegistry() *Registry {
+	return &Registry{
+		players:     map[string]*Player{},
+		subscribers: map[chan struct{}]struct{}{},
+	}
+}
+
+// Add a player, replacing the one with the same ID
+func (registry *Registry) Add(player *Player) {
+	registry.mutex.Lock()
+	if _, ok := registry.players[player.ID]; !ok {
+		registry.order = append(registry.order, player.ID)
+	}
+	registry.players[player.ID] = player
+	registry.mutex.Unlock()
+	registry.Notify()
+}
+
+// Remove the player of the ID, if online
+func (registry *Registry) Remove(id string) {
+	registry.mutex.Lock()
+	if _, ok := registry.players[id]; !ok {
+		registry.mutex.Unlock()
+		return
+	}
+	delete(registry.players, id)
+	for i, other := range registry.order {
+		if other == id {
+			registry.order = append(registry.order[:i], registry.order[i+1:]...)
+			break
+		}
+	}
+	registry.mutex.Unlock()
+	registry.Notify()
+}
+
+// Get The player of the ID, nil if offline
+func (registry *Registry) Get(id string) *Player {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	return registry.players[id]
+}
+
+// List The players online in the order they joined
+func (registry *Registry) List() []*Player {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	players := make([]*Player, 0, len(registry.order))
+	for _, id := range registry.order {
+		players = append(players, registry.players[id])
+	}
+	return players
+}
+
+/*
+Subscribe Get a value on the channel after changes, several changes in
+a row may come as one. Call the returned function to unsubscribe.
+*/
+func (registry *Registry) Subscribe() (<-chan struct{}, func()) {
+	changes := make(chan struct{}, 1)
+	registry.mutex.Lock()
+	registry.subscribers[changes] = struct{}{}
+	registry.mutex.Unlock()
+	return changes, func() {
+		registry.mutex.Lock()
+		delete(registry.subscribers, changes)
+		registry.mutex.Unlock()
+	}
+}
+
+// Notify Tell the subscribers something changed, e.g. the choices of a player
+func (registry *Registry) Notify() {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	for changes := range registry.subscribers {
+		// Subscribers not done with the last change will see this one too
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package stream
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// Players joining and leaving from their own goroutines while others list them, run with -race
+func TestRegistryConcurrent(t *testing.T) {
+	registry := NewRegistry()
+	changes, cancel := registry.Subscribe()
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; n < 100; n++ {
+				id := strconv.Itoa(i) + "-" + strconv.Itoa(n)
+				player := &Player{ID: id, User: "user" + id, Players: registry}
+				registry.Add(player)
+				if registry.Get(id) != player {
+					t.Errorf("player %s missing after Add", id)
+				}
+				for _, other := range registry.List() {
+					other.displayName()
+				}
+				registry.Notify()
+				registry.Remove(id)
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for n := 0; n < 100; n++ {
+			_, cancel := registry.Subscribe()
+			registry.List()
+			cancel()
+		}
+	}()
+	wg.Wait()
+
+	select {
+	case <-changes:
+	default:
+		t.Error("no change notified")
+	}
+	if players := registry.List(); len(players) != 0 {
+		t.Errorf("%d players left after they all left", len(players))
+	}
+}
+
+// Players are listed in the order they joined, a player joining again keeps its place
+func TestRegistryOrder(t *testing.T) {
+	registry := NewRegistry()
+	for _, id := range []string{"a", "b", "c"} {
+		registry.Add(&Player{ID: id})
+	}
+	registry.Add(&Player{ID: "a"})
+	registry.Remove("b")
+	registry.Remove("unknown")
+
+	var ids []string
+	for _, player := range registry.List() {
+		ids = append(ids, player.ID)
+	}
+	if len(ids) != 2 || ids[0] != "a" || ids[1] != "c" {
+		t.Errorf("players listed %v, want [a c]", ids)
+	}
+	if registry.Get("b") != nil {
+		t.Error("player b still online after Remove")
+	}
+}
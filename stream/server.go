@@ -1,38 +1,74 @@
 package stream
 
 import (
+	"github.com/HFO4/gbc-in-cloud/driver"
 	"github.com/satori/go.uuid"
 	"log"
 	"net"
+	"path/filepath"
 	"strconv"
 )
 
 type StreamServer struct {
 	Port     int
 	GameList []GameInfo
+	// How the screen is drawn, see NewDisplay
+	Display string
+	// Filters of the sixel and kitty displays, see filter.Parse
+	Filters string
+	// Buttons and hotkeys of the keys, the default ones if nil
+	Keys driver.KeyBindings
+
+	// SSH server, off if the port is 0. The telnet server is off if Port is 0
+	SSHPort int
+	// Host key of the SSH server, generated if the file doesn't exist
+	HostKeyPath string
+	// authorized_keys file of the players, naming them by the comment of their key. Any key is accepted if empty
+	AuthorizedKeysPath string
+	// Directory of the saves of the SSH players, one directory each. Saved next to the ROMs if empty
+	SavePath string
+
+	players *Registry
+	lobby   *Lobby
 }
 
 type GameInfo struct {
 	Title string
 	Path  string
+	// Palette name or custom colours, see gb.ParsePalette
+	Palette string
+	// Keys rebound for this game, over the ones of the server
+	Keys driver.KeyBindings
 }
 
-var PlayerList []*Player
-
 // Run Running the cloud gaming server
 func (server *StreamServer) Run() {
+	if _, err := NewDisplay(nil, server.Display, server.Filters, TerminalInfo{}); err != nil {
+		log.Fatal("Invalid display, ", err.Error())
+	}
+	for _, game := range server.GameList {
+		if err := game.Keys.Check(); err != nil {
+			log.Fatalf("Invalid keys of %s, %s", game.Title, err)
+		}
+	}
+
+	server.players = NewRegistry()
+	server.lobby = NewLobby(server.players)
+
+	if server.SSHPort != 0 {
+		if server.Port == 0 {
+			server.runSSH()
+			return
+		}
+		go server.runSSH()
+	}
+
 	listener, err := net.Listen("tcp", ":"+strconv.Itoa(server.Port))
 	if err != nil {
 		log.Fatal("Error listening", err.Error())
 	}
 	log.Println("Listen port:", server.Port)
 
-	// Set the first player to None
-
-	NonePlayer := new(Player)
-	NonePlayer.ID = "None"
-	PlayerList = append(PlayerList, NonePlayer)
-
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
@@ -40,18 +76,38 @@ func (server *StreamServer) Run() {
 			return
 		}
 
-		// Generate unique ID for each player
-		PlayerID := uuid.NewV4()
-		player := &Player{
-			Conn:     conn,
-			ID:       PlayerID.String(),
-			GameList: &server.GameList,
-		}
+		player := server.newPlayer(conn, "")
 
-		PlayerList = append(PlayerList, player)
+		// Negotiating waits for the player, don't keep the others waiting
+		go func() {
+			if player.InitTelnet() {
+				player.Serve()
+			} else {
+				player.Logout()
+			}
+		}()
+	}
+}
 
-		if player.InitTelnet() {
-			go player.Serve()
-		}
+// Add a player connected with conn to the players online, user is the name of its SSH key if any
+func (server *StreamServer) newPlayer(conn net.Conn, user string) *Player {
+	// Generate unique ID for each player
+	PlayerID := uuid.NewV4()
+	player := &Player{
+		Conn:     conn,
+		ID:       PlayerID.String(),
+		GameList: &server.GameList,
+		Display:  server.Display,
+		Filters:  server.Filters,
+		Keys:     server.Keys,
+		Players:  server.players,
+		Lobby:    server.lobby,
+		User:     user,
 	}
+	if user != "" && server.SavePath != "" {
+		player.SaveDir = filepath.Join(server.SavePath, saveDirName(user))
+	}
+
+	server.players.Add(player)
+	return player
 }
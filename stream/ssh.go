@@ -0,0 +1,277 @@
+package stream
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var errNoDeadline = errors.New("deadlines are not supported by SSH channels")
+
+/*
+Accept the players connecting with SSH. They go through the same
+screens as telnet players, but are known by their public key: their
+saves are kept apart, and they are listed under their name.
+*/
+func (server *StreamServer) runSSH() {
+	config, err := server.sshConfig()
+	if err != nil {
+		log.Fatal("[SSH] ", err)
+	}
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(server.SSHPort))
+	if err != nil {
+		log.Fatal("Error listening", err.Error())
+	}
+	log.Println("[SSH] Listen port:", server.SSHPort)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Println("Error accepting", err.Error())
+			return
+		}
+		go server.serveSSH(conn, config)
+	}
+}
+
+func (server *StreamServer) sshConfig() (*ssh.ServerConfig, error) {
+	hostKey, err := loadHostKey(server.HostKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var authorized map[string]string
+	if server.AuthorizedKeysPath != "" {
+		authorized, err = loadAuthorizedKeys(server.AuthorizedKeysPath)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("[SSH] %d authorized keys\n", len(authorized))
+	}
+
+	config := &ssh.ServerConfig{
+		/*
+			The player's name is the comment of the key in the authorized
+			keys, or comes from the fingerprint of the key: the user name is
+			chosen by the client, alone it would let anybody take someone
+			else's saves.
+		*/
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			name := ""
+			if authorized != nil {
+				var ok bool
+				name, ok = authorized[string(key.Marshal())]
+				if !ok {
+					return nil, fmt.Errorf("unknown public key for %q", meta.User())
+				}
+				if name == "" {
+					name = "key@" + keyFingerprint(key)
+				}
+			} else {
+				name = meta.User() + "@" + keyFingerprint(key)
+			}
+			return &ssh.Permissions{
+				Extensions: map[string]string{"player": name},
+			}, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+	return config, nil
+}
+
+/*
+Load the host key of the server, a new one is generated and saved if
+the file doesn't exist.
+*/
+func loadHostKey(path string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			return nil, err
+		}
+		log.Println("[SSH] Generated a new host key in", path)
+	} else if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(data)
+}
+
+// Short fingerprint of a public key, telling the players apart
+func keyFingerprint(key ssh.PublicKey) string {
+	fingerprint := sha256.Sum256(key.Marshal())
+	return hex.EncodeToString(fingerprint[:6])
+}
+
+// Read an authorized_keys file, the keys are mapped to their comment
+func loadAuthorizedKeys(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]string{}
+	for len(strings.TrimSpace(string(data))) > 0 {
+		key, comment, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, err
+		}
+		keys[string(key.Marshal())] = comment
+		data = rest
+	}
+	return keys, nil
+}
+
+/*
+Handle an SSH connection. The game starts in the first session asking
+for a shell, with the terminal type and size of its PTY.
+*/
+func (server *StreamServer) serveSSH(tcpConn net.Conn, config *ssh.ServerConfig) {
+	conn, channels, requests, err := ssh.NewServerConn(tcpConn, config)
+	if err != nil {
+		log.Println("[SSH] Handshake failed,", err)
+		tcpConn.Close()
+		return
+	}
+	name := conn.Permissions.Extensions["player"]
+	log.Printf("[SSH] %s connected from %s\n", name, conn.RemoteAddr())
+	go ssh.DiscardRequests(requests)
+
+	started := false
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" || started {
+			newChannel.Reject(ssh.UnknownChannelType, "only one session is supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			log.Println("[SSH] Failed to accept the session,", err)
+			continue
+		}
+		started = true
+
+		player := server.newPlayer(&sshConn{Channel: channel, conn: conn}, name)
+		go handleSessionRequests(player, requests)
+	}
+}
+
+/*
+Handle the requests of the session: the PTY and its size changes, and
+the shell starting the game. Commands and subsystems are refused.
+*/
+func handleSessionRequests(player *Player, requests <-chan *ssh.Request) {
+	playing := false
+	for request := range requests {
+		ok := false
+		switch request.Type {
+		case "pty-req":
+			// string TERM, uint32 columns, uint32 rows, then pixel sizes and modes
+			var pty struct {
+				Term          string
+				Columns, Rows uint32
+				Rest          []byte `ssh:"rest"`
+			}
+			if ssh.Unmarshal(request.Payload, &pty) == nil {
+				player.SetTerminal(TerminalInfo{
+					Type:   strings.ToLower(pty.Term),
+					Width:  int(pty.Columns),
+					Height: int(pty.Rows),
+				})
+				ok = true
+			}
+		case "window-change":
+			if len(request.Payload) >= 8 {
+				player.Resize(int(binary.BigEndian.Uint32(request.Payload)), int(binary.BigEndian.Uint32(request.Payload[4:])))
+			}
+		case "shell":
+			if !playing {
+				playing = true
+				ok = true
+				go player.Serve()
+			}
+		}
+		if request.WantReply {
+			request.Reply(ok, nil)
+		}
+	}
+	// The session closed before the game started
+	if !playing {
+		player.Logout()
+	}
+}
+
+/*
+Name of the save directory of a player, without the characters unsafe
+in file names. Names made of dots only would point to the save
+directory itself or its parent, they get an underscore first.
+*/
+func saveDirName(name string) string {
+	dir := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("@._-", r) {
+			return r
+		}
+		return '_'
+	}, name)
+	if strings.Trim(dir, ".") == "" {
+		return "_" + dir
+	}
+	return dir
+}
+
+/*
+The session channel of an SSH connection, as the connection of a
+Player. Closing it ends the connection, with a successful exit status.
+*/
+type sshConn struct {
+	ssh.Channel
+	conn *ssh.ServerConn
+}
+
+func (conn *sshConn) Close() error {
+	conn.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+	conn.Channel.Close()
+	return conn.conn.Close()
+}
+
+func (conn *sshConn) LocalAddr() net.Addr {
+	return conn.conn.LocalAddr()
+}
+
+func (conn *sshConn) RemoteAddr() net.Addr {
+	return conn.conn.RemoteAddr()
+}
+
+func (conn *sshConn) SetDeadline(t time.Time) error {
+	return errNoDeadline
+}
+
+func (conn *sshConn) SetReadDeadline(t time.Time) error {
+	return errNoDeadline
+}
+
+func (conn *sshConn) SetWriteDeadline(t time.Time) error {
+	return errNoDeadline
+}
@@ -0,0 +1,340 @@
+package stream
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"time"
+)
+
+// Telnet commands, RFC 854
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+)
+
+// Telnet options
+const (
+	optionEcho     = 1
+	optionSGA      = 3
+	optionTTYPE    = 24
+	optionNAWS     = 31
+	optionLinemode = 34
+)
+
+/*
+Longest subnegotiation kept: NAWS takes 5 bytes, TTYPE a terminal name
+of up to 40 characters (RFC 1010). Longer ones are dropped.
+*/
+const maxSubnegotiation = 64
+
+// States of the input parser
+const (
+	stateData = iota
+	stateIAC
+	stateOption
+	stateSB
+	stateSBIAC
+	stateCR
+)
+
+/*
+TelnetConn is a telnet connection negotiating a character at a time
+mode with the client: the server echoes (so the client doesn't) and
+nobody sends Go Ahead. It asks the client for its window size (NAWS,
+RFC 1073) and terminal type (TTYPE, RFC 1091). Telnet commands are
+stripped from what is read, and 0xFF bytes escaped in what is written.
+*/
+type TelnetConn struct {
+	net.Conn
+
+	// Options enabled on our side and on the client's side
+	local, remote [256]bool
+	// Options we asked for on both sides, the replies to them are not answered
+	askedLocal, askedRemote [256]bool
+	// Replies awaited by Negotiate
+	waiting map[byte]bool
+
+	// Input parser
+	state int
+	verb  byte
+	sb    []byte
+	// The subnegotiation being read is too long, it is dropped
+	sbOverflow bool
+	pending    []byte
+
+	lock     sync.Mutex
+	writeMux sync.Mutex
+	terminal TerminalInfo
+}
+
+// What the client told about its terminal
+type TerminalInfo struct {
+	// Terminal type in lower case, e.g. "xterm-256color", empty if unknown
+	Type string
+	// Window size in characters, 0 if unknown
+	Width, Height int
+}
+
+func NewTelnetConn(conn net.Conn) *TelnetConn {
+	return &TelnetConn{
+		Conn:    conn,
+		waiting: map[byte]bool{},
+	}
+}
+
+/*
+Negotiate the options with the client, and wait for its window size and
+terminal type until the timeout. Clients that don't know telnet never
+answer, so this simply gives up.
+*/
+func (conn *TelnetConn) Negotiate(timeout time.Duration) error {
+	conn.lock.Lock()
+	conn.waiting[optionNAWS] = true
+	conn.waiting[optionTTYPE] = true
+	var out []byte
+	for _, option := range []byte{optionEcho, optionSGA} {
+		conn.askedLocal[option] = true
+		out = append(out, telnetIAC, telnetWILL, option)
+	}
+	for _, option := range []byte{optionSGA, optionNAWS, optionTTYPE, optionLinemode} {
+		conn.askedRemote[option] = true
+		out = append(out, telnetIAC, telnetDO, option)
+	}
+	conn.lock.Unlock()
+	if _, err := conn.writeRaw(out); err != nil {
+		return err
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, 512)
+	for {
+		conn.lock.Lock()
+		done := len(conn.waiting) == 0
+		conn.lock.Unlock()
+		if done {
+			return nil
+		}
+
+		n, err := conn.Conn.Read(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return nil
+			}
+			return err
+		}
+		// Keys pressed meanwhile are kept for Read
+		conn.pending = append(conn.pending, conn.parse(buf[:n])...)
+	}
+}
+
+// Terminal What the client told about its terminal so far
+func (conn *TelnetConn) Terminal() TerminalInfo {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.terminal
+}
+
+// Read data sent by the client, without the telnet commands
+func (conn *TelnetConn) Read(b []byte) (int, error) {
+	for len(conn.pending) == 0 {
+		n, err := conn.Conn.Read(b)
+		if n > 0 {
+			conn.pending = conn.parse(b[:n])
+		}
+		if err != nil && len(conn.pending) == 0 {
+			return 0, err
+		}
+	}
+	n := copy(b, conn.pending)
+	conn.pending = conn.pending[n:]
+	return n, nil
+}
+
+// Write data to the client, IAC bytes are doubled
+func (conn *TelnetConn) Write(b []byte) (int, error) {
+	if bytes.IndexByte(b, telnetIAC) < 0 {
+		return conn.writeRaw(b)
+	}
+	escaped := bytes.Replace(b, []byte{telnetIAC}, []byte{telnetIAC, telnetIAC}, -1)
+	if _, err := conn.writeRaw(escaped); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Frames and negotiation replies are written by different goroutines
+func (conn *TelnetConn) writeRaw(b []byte) (int, error) {
+	conn.writeMux.Lock()
+	defer conn.writeMux.Unlock()
+	return conn.Conn.Write(b)
+}
+
+/*
+Run the received bytes through the telnet state machine, returns the
+data bytes. Replies to the commands are sent right away.
+*/
+func (conn *TelnetConn) parse(in []byte) []byte {
+	conn.lock.Lock()
+	var data, reply []byte
+	for _, b := range in {
+		switch conn.state {
+		case stateData, stateCR:
+			// CR NUL is a lone CR, RFC 854
+			if conn.state == stateCR && b == 0 {
+				conn.state = stateData
+				continue
+			}
+			conn.state = stateData
+			if b == telnetIAC {
+				conn.state = stateIAC
+			} else {
+				data = append(data, b)
+				if b == '\r' {
+					conn.state = stateCR
+				}
+			}
+		case stateIAC:
+			switch b {
+			case telnetIAC:
+				data = append(data, b)
+				conn.state = stateData
+			case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+				conn.verb = b
+				conn.state = stateOption
+			case telnetSB:
+				conn.sb = conn.sb[:0]
+				conn.sbOverflow = false
+				conn.state = stateSB
+			default:
+				// NOP, GA, AYT... nothing to do
+				conn.state = stateData
+			}
+		case stateOption:
+			reply = append(reply, conn.option(conn.verb, b)...)
+			conn.state = stateData
+		case stateSB:
+			if b == telnetIAC {
+				conn.state = stateSBIAC
+			} else {
+				conn.appendSB(b)
+			}
+		case stateSBIAC:
+			switch b {
+			case telnetSE:
+				if !conn.sbOverflow {
+					conn.subnegotiation(conn.sb)
+				}
+				conn.state = stateData
+			case telnetIAC:
+				conn.appendSB(b)
+				conn.state = stateSB
+			default:
+				conn.state = stateData
+			}
+		}
+	}
+	conn.lock.Unlock()
+
+	if len(reply) > 0 {
+		conn.writeRaw(reply)
+	}
+	return data
+}
+
+// Add a byte to the subnegotiation being read, unless it is too long
+func (conn *TelnetConn) appendSB(b byte) {
+	if len(conn.sb) >= maxSubnegotiation {
+		conn.sbOverflow = true
+		return
+	}
+	conn.sb = append(conn.sb, b)
+}
+
+/*
+Handle WILL/WONT/DO/DONT of an option, returns the reply. Options are
+only acknowledged when their state changes, so the two sides never loop.
+*/
+func (conn *TelnetConn) option(verb byte, option byte) []byte {
+	var reply []byte
+	switch verb {
+	case telnetWILL:
+		switch option {
+		case optionSGA, optionNAWS, optionTTYPE, optionLinemode:
+			if !conn.remote[option] {
+				conn.remote[option] = true
+				if !conn.askedRemote[option] {
+					reply = append(reply, telnetIAC, telnetDO, option)
+				}
+			}
+			if option == optionTTYPE {
+				// IAC SB TTYPE SEND IAC SE
+				reply = append(reply, telnetIAC, telnetSB, optionTTYPE, 1, telnetIAC, telnetSE)
+			}
+			if option == optionLinemode {
+				// Editing is done by the server: IAC SB LINEMODE MODE 0 IAC SE
+				reply = append(reply, telnetIAC, telnetSB, optionLinemode, 1, 0, telnetIAC, telnetSE)
+			}
+		default:
+			reply = append(reply, telnetIAC, telnetDONT, option)
+		}
+	case telnetWONT:
+		delete(conn.waiting, option)
+		if conn.remote[option] {
+			reply = append(reply, telnetIAC, telnetDONT, option)
+		}
+		conn.remote[option] = false
+	case telnetDO:
+		switch option {
+		case optionEcho, optionSGA:
+			if !conn.local[option] {
+				conn.local[option] = true
+				if !conn.askedLocal[option] {
+					reply = append(reply, telnetIAC, telnetWILL, option)
+				}
+			}
+		default:
+			reply = append(reply, telnetIAC, telnetWONT, option)
+		}
+	case telnetDONT:
+		if conn.local[option] {
+			reply = append(reply, telnetIAC, telnetWONT, option)
+		}
+		conn.local[option] = false
+	}
+	if verb == telnetWILL || verb == telnetWONT {
+		conn.askedRemote[option] = false
+	} else {
+		conn.askedLocal[option] = false
+	}
+	return reply
+}
+
+// Handle the window size and terminal type sent by the client
+func (conn *TelnetConn) subnegotiation(sb []byte) {
+	if len(sb) == 0 {
+		return
+	}
+	switch sb[0] {
+	case optionNAWS:
+		if len(sb) >= 5 {
+			conn.terminal.Width = int(sb[1])<<8 | int(sb[2])
+			conn.terminal.Height = int(sb[3])<<8 | int(sb[4])
+			delete(conn.waiting, optionNAWS)
+		}
+	case optionTTYPE:
+		// TTYPE IS <name>
+		if len(sb) >= 2 && sb[1] == 0 {
+			conn.terminal.Type = string(bytes.ToLower(sb[2:]))
+			delete(conn.waiting, optionTTYPE)
+		}
+	}
+}
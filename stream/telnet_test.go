@@ -0,0 +1,30 @@
+package stream
+
+import (
+	"bytes"
+	"testing"
+)
+
+// A subnegotiation never ended doesn't grow without bound, and the next ones still work
+func TestTelnetSubnegotiationLimit(t *testing.T) {
+	conn := NewTelnetConn(nil)
+	conn.parse([]byte{telnetIAC, telnetSB, optionTTYPE, 0})
+	for i := 0; i < 1000; i++ {
+		conn.parse(bytes.Repeat([]byte{'x'}, 1024))
+	}
+	if len(conn.sb) > maxSubnegotiation {
+		t.Errorf("subnegotiation of %d bytes kept", len(conn.sb))
+	}
+	conn.parse([]byte{telnetIAC, telnetSE})
+	if conn.Terminal().Type != "" {
+		t.Errorf("terminal type %q taken from a dropped subnegotiation", conn.Terminal().Type)
+	}
+
+	data := conn.parse([]byte{telnetIAC, telnetSB, optionNAWS, 0, 80, 0, 24, telnetIAC, telnetSE, 'a'})
+	if terminal := conn.Terminal(); terminal.Width != 80 || terminal.Height != 24 {
+		t.Errorf("window of %dx%d, want 80x24", terminal.Width, terminal.Height)
+	}
+	if string(data) != "a" {
+		t.Errorf("read %q, want \"a\"", data)
+	}
+}